@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+type PathAccess struct { //Path globs restricting which paths may be proxied at all, see globMatch.
+	Allow []string //Allow: When non-empty, only paths matching one of these globs are proxied.
+	Deny  []string //Deny: Paths matching one of these globs are refused, even when also allowed.
+}
+
+func (a PathAccess) allowed(path string) bool {
+	// Reports whether path may be proxied: it must match no deny glob and, if there are allow globs, at least one of those.
+	for _, pattern := range a.Deny {
+		if globMatch(pattern, path) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range a.Allow {
+		if globMatch(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a PathAccess) middleware(next http.Handler) http.Handler {
+	/* Wraps next so refused paths get 403 before anything is looked up in the cache or forwarded.
+	The path is checked after decoding and after ServeMux has cleaned it, so /%61dmin or /x/../admin can't slip past a /admin* deny.*/
+	if len(a.Allow) == 0 && len(a.Deny) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowed(r.URL.Path) {
+			log.Printf("Refusing request for %s: path not allowed", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPathAccess(t *testing.T) {
+	var forwarded atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.Write([]byte("ok"))
+	})
+	access := PathAccess{Allow: []string{"/api/*", "/static/*"}, Deny: []string{"/api/admin*"}}
+	mux := http.NewServeMux()
+	mux.Handle("/", access.middleware(http.HandlerFunc(p.handleProxy)))
+	srv := serveTest(t, mux)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/users", http.StatusOK},
+		{"/static/app.js", http.StatusOK},
+		{"/api/admin/users", http.StatusForbidden},
+		{"/api/%61dmin", http.StatusForbidden},
+		{"/internal/metrics", http.StatusForbidden},
+		{"/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		before := forwarded.Load()
+		resp, err := client.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s = %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+		if sent := forwarded.Load() - before; (sent == 1) != (tt.want == http.StatusOK) {
+			t.Errorf("%s forwarded %d times", tt.path, sent)
+		}
+	}
+
+	// A dot-segment path is redirected to its clean form by the mux, which is then checked again.
+	resp, err := client.Get(srv.URL + "/static/../api/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("dot segments got past the deny list")
+	}
+}
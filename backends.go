@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type cacheRoute struct { //Sends requests for paths matching a glob to another backend's cache than the default one (route-backends).
+	glob    string //glob: Path glob, matched as pin-paths are.
+	backend string //backend: Name of the backend, memory or redis.
+	cache   *Cache //cache: The backend's cache, set once the backends are opened.
+}
+
+func parseRouteBackends(list string) ([]cacheRoute, error) {
+	/* Parses a comma-separated list of glob=backend pairs, e.g. "/media/*=redis,/api/*=memory".
+	Order is kept: a path goes to the first route whose glob matches.*/
+	var routes []cacheRoute
+	for _, item := range splitList(list) {
+		glob, backend, found := strings.Cut(item, "=")
+		glob, backend = strings.TrimSpace(glob), strings.TrimSpace(backend)
+		if !found || glob == "" {
+			return nil, fmt.Errorf("%q must be glob=backend", item)
+		}
+		if backend != "memory" && backend != "redis" {
+			return nil, fmt.Errorf("invalid backend %q for %s: must be memory or redis", backend, glob)
+		}
+		routes = append(routes, cacheRoute{glob: glob, backend: backend})
+	}
+	return routes, nil
+}
+
+func (p *ProxyServer) cacheFor(path string) *Cache {
+	// Returns the cache requests for path are looked up in and stored to: the first matching route's, else the default cache.
+	for _, route := range p.cacheRoutes {
+		if globMatch(route.glob, path) {
+			return route.cache
+		}
+	}
+	return p.cache
+}
+
+func (p *ProxyServer) caches() []*Cache {
+	// Returns every cache the proxy stores to, the default one first, each once, for purges and stats that span them all.
+	caches := []*Cache{p.cache}
+	for _, route := range p.cacheRoutes {
+		if !slices.Contains(caches, route.cache) {
+			caches = append(caches, route.cache)
+		}
+	}
+	return caches
+}
+
+func (p *ProxyServer) cacheSummary() CacheSummary {
+	// Adds up the Summary of every cache.
+	var total CacheSummary
+	for _, c := range p.caches() {
+		summary := c.Summary()
+		total.Entries += summary.Entries
+		total.Bytes += summary.Bytes
+		if !summary.Oldest.IsZero() && (total.Oldest.IsZero() || summary.Oldest.Before(total.Oldest)) {
+			total.Oldest = summary.Oldest
+		}
+		if summary.Newest.After(total.Newest) {
+			total.Newest = summary.Newest
+		}
+	}
+	return total
+}
+
+func (p *ProxyServer) cacheEvictions() int64 {
+	// Adds up the evictions of every cache.
+	var total int64
+	for _, c := range p.caches() {
+		total += c.evictions.Load()
+	}
+	return total
+}
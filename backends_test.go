@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRouteBackends(t *testing.T) {
+	routes, err := parseRouteBackends(" /media/*=redis, /api/*=memory ")
+	if err != nil || len(routes) != 2 || routes[0] != (cacheRoute{glob: "/media/*", backend: "redis"}) || routes[1] != (cacheRoute{glob: "/api/*", backend: "memory"}) {
+		t.Fatalf("parseRouteBackends = %+v, %v", routes, err)
+	}
+	for _, list := range []string{"/media/*", "=redis", "/media/*=disk"} {
+		if _, err := parseRouteBackends(list); err == nil {
+			t.Errorf("%q was accepted", list)
+		}
+	}
+}
+
+func TestRouteBackendsStoreByPath(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body of " + r.URL.Path))
+	})
+	media := newGobStore()
+	p.cacheRoutes = []cacheRoute{{glob: "/media/*", backend: "redis", cache: &Cache{store: media}}}
+
+	for _, path := range []string{"/media/clip.mp4", "/page"} {
+		for _, want := range []string{"MISS", "HIT"} {
+			if rec := get(p, path); rec.Header().Get("X-Cache") != want || rec.Body.String() != "body of "+path {
+				t.Fatalf("%s = %s %q, want a %s", path, rec.Header().Get("X-Cache"), rec.Body.String(), want)
+			}
+		}
+	}
+	if len(media.setKeys) != 1 || entryCount(p.cache) != 1 {
+		t.Fatalf("media store got %d entries and the default cache %d, want one each", len(media.setKeys), entryCount(p.cache))
+	}
+
+	rec := httptest.NewRecorder()
+	p.cacheStatsHandler(rec, httptest.NewRequest(http.MethodGet, "/cache-stats", nil))
+	var stats struct{ Entries int }
+	if json.Unmarshal(rec.Body.Bytes(), &stats); stats.Entries != 2 {
+		t.Fatalf("cache-stats entries = %d, want both caches counted", stats.Entries)
+	}
+
+	if rec := do(p, httptest.NewRequest(methodPurge, "/media/clip.mp4", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("PURGE of a routed path = %d, want it found in its backend", rec.Code)
+	}
+	p.clearCacheHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/clear-cache", nil))
+	if n := entryCount(p.cacheRoutes[0].cache) + entryCount(p.cache); n != 0 {
+		t.Fatalf("%d entries left after clear-cache, want every backend cleared", n)
+	}
+}
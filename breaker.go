@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const breakerThreshold = 5 // Consecutive backend failures after which the circuit opens.
+
+type circuitBreaker struct { //Stops calling a failing cache backend for a while, so an outage costs requests nothing instead of a timeout each.
+	cooldown time.Duration //cooldown: How long the circuit stays open before a single call is let through to probe the backend.
+
+	mu        sync.Mutex //mu: Guards the fields below.
+	failures  int        //failures: Consecutive failed calls; the circuit is open from breakerThreshold on.
+	openUntil time.Time  //openUntil: When the next probe may go out.
+	probing   bool       //probing: A probe is in flight; other calls keep skipping the backend until it reports back.
+}
+
+func (b *circuitBreaker) allow() bool {
+	/* Reports whether a call may go to the backend: always while the circuit is closed, and once it is open,
+	only a single probe after each cooldown. A nil breaker always allows.*/
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(err error) {
+	/* Reports the outcome of a call allow let through. A success closes the circuit; a failure counts towards opening it,
+	or keeps it open for another cooldown when the probe failed.*/
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		if b.failures >= breakerThreshold {
+			log.Printf("Cache backend is answering again, caching resumes")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= breakerThreshold {
+		if b.failures == breakerThreshold {
+			log.Printf("Cache backend failed %d times in a row, passing requests through to the upstream: %v", b.failures, err)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	b := &circuitBreaker{cooldown: time.Minute}
+	failure := errors.New("connection refused")
+	for range breakerThreshold {
+		if !b.allow() {
+			t.Fatal("breaker skipped the backend before reaching the threshold")
+		}
+		b.record(failure)
+	}
+	if b.allow() {
+		t.Fatalf("breaker let a call through after %d failures in a row", breakerThreshold)
+	}
+
+	b.openUntil = time.Now() // Ends the cooldown.
+	if !b.allow() {
+		t.Fatal("breaker sent no probe after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("breaker sent a second call while the probe was in flight")
+	}
+	b.record(failure)
+	if b.allow() {
+		t.Fatal("breaker closed after a failed probe")
+	}
+
+	b.openUntil = time.Now()
+	if !b.allow() {
+		t.Fatal("breaker sent no probe after the second cooldown")
+	}
+	b.record(nil)
+	for range 2 {
+		if !b.allow() {
+			t.Fatal("breaker stayed open after a successful probe")
+		}
+	}
+}
+
+func TestSuccessResetsTheFailureCount(t *testing.T) {
+	b := &circuitBreaker{cooldown: time.Minute}
+	for range 3 {
+		for range breakerThreshold - 1 {
+			b.record(errors.New("timeout"))
+		}
+		b.record(nil)
+	}
+	if !b.allow() {
+		t.Fatal("breaker opened on failures that were never consecutive")
+	}
+}
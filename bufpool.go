@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+type bufferPool struct { //Reusable buffers for reading upstream bodies, so a miss doesn't allocate a fresh one each time.
+	pool    sync.Pool //pool: Idle *bytes.Buffer values.
+	maxSize int       //maxSize: Buffers that grew beyond this many bytes are dropped instead of pooled, bounding idle memory.
+}
+
+func newBufferPool(maxSize int) *bufferPool {
+	// Creates a pool keeping buffers of up to maxSize bytes.
+	return &bufferPool{
+		pool:    sync.Pool{New: func() any { return new(bytes.Buffer) }},
+		maxSize: maxSize,
+	}
+}
+
+func (bp *bufferPool) readAll(r io.Reader) (*bytes.Buffer, error) {
+	/* Reads r into a buffer from the pool. The buffer must be handed back with put once its bytes are no longer
+	referenced; anything kept longer, like a cache entry, needs its own copy. A nil pool allocates a new buffer.*/
+	var buf *bytes.Buffer
+	if bp == nil {
+		buf = new(bytes.Buffer)
+	} else {
+		buf = bp.pool.Get().(*bytes.Buffer)
+		buf.Reset()
+	}
+	_, err := buf.ReadFrom(r)
+	return buf, err
+}
+
+func (bp *bufferPool) put(buf *bytes.Buffer) {
+	// Returns a buffer to the pool, unless the pool is nil or the buffer outgrew maxSize.
+	if bp == nil || buf.Cap() > bp.maxSize {
+		return
+	}
+	bp.pool.Put(buf)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPooledBuffersAreNotRetainedByEntries(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		// Equal lengths, so the second body lands in exactly the bytes the first one used.
+		w.Write([]byte(strings.Repeat(r.URL.Path[1:], 1000)))
+	})
+	p.bodyBuffers = newBufferPool(1 << 20)
+	for _, target := range []string{"/a", "/b", "/c"} {
+		get(p, target)
+	}
+	for _, target := range []string{"/a", "/b", "/c"} {
+		rec := get(p, target)
+		if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != strings.Repeat(target[1:], 1000) {
+			t.Fatalf("%s = %s, body starting %q; a cached entry shares a pooled buffer", target, rec.Header().Get("X-Cache"), rec.Body.String()[:10])
+		}
+	}
+}
+
+func TestBufferPoolDropsOversizedBuffers(t *testing.T) {
+	bp := newBufferPool(16)
+	big, _ := bp.readAll(strings.NewReader(strings.Repeat("x", 1000)))
+	bp.put(big)
+	if buf, _ := bp.readAll(strings.NewReader("small")); buf == big {
+		t.Fatal("a buffer beyond maxSize was pooled")
+	}
+
+	var nilPool *bufferPool
+	buf, err := nilPool.readAll(strings.NewReader("body"))
+	if err != nil || buf.String() != "body" {
+		t.Fatalf("nil pool read %q, %v", buf.String(), err)
+	}
+	nilPool.put(buf)
+}
+
+func BenchmarkMiss(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 64<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body)
+	}))
+	defer srv.Close()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, pool := range []*bufferPool{nil, newBufferPool(1 << 20)} {
+		name := "unpooled"
+		if pool != nil {
+			name = "pooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			p := &ProxyServer{targetHost: srv.URL, cache: &Cache{store: MemoryStore{}}, bodyBuffers: pool}
+			b.ReportAllocs()
+			for i := range b.N {
+				get(p, "/page?i="+strconv.Itoa(i))
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type BypassHeader struct { //A request header that makes the proxy skip the cache, e.g. X-No-Cache: 1 while debugging.
+	Name  string //Name: Canonical header name, "" when bypassing is off.
+	Value string //Value: Value the header must carry, "" for any value.
+	Store bool   //Store: Whether the fresh response still replaces the cached entry.
+}
+
+func parseBypassHeader(value string, store bool) (BypassHeader, error) {
+	// Parses the bypass-header flag: "Name: value", "Name" for any value, or "" for no bypass header.
+	if value == "" {
+		return BypassHeader{}, nil
+	}
+	name, want, _ := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !validHeaderName(name) {
+		return BypassHeader{}, fmt.Errorf("invalid bypass-header %q, want Name or Name: value", value)
+	}
+	return BypassHeader{Name: http.CanonicalHeaderKey(name), Value: strings.TrimSpace(want), Store: store}, nil
+}
+
+func (b BypassHeader) matches(r *http.Request) bool {
+	// Reports whether r asks to bypass the cache.
+	if b.Name == "" {
+		return false
+	}
+	values, found := r.Header[b.Name]
+	if !found || b.Value == "" {
+		return found
+	}
+	for _, v := range values {
+		if strings.TrimSpace(v) == b.Value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBypassHeaderForcesFreshFetch(t *testing.T) {
+	for _, store := range []bool{true, false} {
+		var version atomic.Int32
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("version " + strconv.Itoa(int(version.Add(1)))))
+		})
+		bypass, err := parseBypassHeader("x-no-cache: 1", store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.bypass = bypass
+		bypassing := func(value string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/page", nil)
+			r.Header.Set("X-No-Cache", value)
+			return do(p, r)
+		}
+
+		get(p, "/page")
+		if rec := bypassing("0"); rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("store=%v: a non-matching value gave %s, want a HIT", store, rec.Header().Get("X-Cache"))
+		}
+		if rec := bypassing("1"); rec.Header().Get("X-Cache") != "BYPASS" || rec.Body.String() != "version 2" {
+			t.Fatalf("store=%v: bypass = %s %q, want a fresh BYPASS", store, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+		want := "version 1"
+		if store {
+			want = "version 2"
+		}
+		if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != want {
+			t.Fatalf("store=%v: next GET = %s %q, want a HIT on %q", store, rec.Header().Get("X-Cache"), rec.Body.String(), want)
+		}
+	}
+}
+
+func TestParseBypassHeader(t *testing.T) {
+	if b, err := parseBypassHeader("X-Debug", true); err != nil || b.Name != "X-Debug" || b.Value != "" {
+		t.Fatalf("name only = %+v, %v", b, err)
+	}
+	nameOnly := BypassHeader{Name: "X-Debug"}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if nameOnly.matches(r) {
+		t.Fatal("matched a request without the header")
+	}
+	r.Header.Set("X-Debug", "whatever")
+	if !nameOnly.matches(r) {
+		t.Fatal("a name-only bypass header did not match any value")
+	}
+	if _, err := parseBypassHeader("Bad Name: 1", true); err == nil {
+		t.Fatal("an invalid header name was accepted")
+	}
+}
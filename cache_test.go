@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newDedupCache() *Cache {
+	// Returns a cache storing identical bodies once.
+	return &Cache{store: MemoryStore{}, bodies: map[string]*sharedBody{}}
+}
+
+func TestDedupSharesIdenticalBodies(t *testing.T) {
+	c := newDedupCache()
+	c.Set("a", CacheEntry{Response: []byte("same body"), TTL: time.Hour, Created: time.Now()})
+	c.Set("b", CacheEntry{Response: []byte("same body"), TTL: time.Hour, Created: time.Now()})
+	c.Set("c", CacheEntry{Response: []byte("other body"), TTL: time.Hour, Created: time.Now()})
+	if len(c.bodies) != 2 {
+		t.Fatalf("body table holds %d bodies, want 2", len(c.bodies))
+	}
+	a, _ := c.Get("a")
+	b, _ := c.Get("b")
+	if &a.Response[0] != &b.Response[0] {
+		t.Fatal("identical bodies are stored twice")
+	}
+	if got := c.Summary().Bytes; got != int64(len("same body")+len("other body")) {
+		t.Fatalf("Summary().Bytes = %d, want the shared body counted once", got)
+	}
+}
+
+func TestDedupBodySurvivesUntilLastReferenceGoes(t *testing.T) {
+	c := newDedupCache()
+	c.Set("a", CacheEntry{Response: []byte("shared"), TTL: time.Hour, Created: time.Now()})
+	c.Set("b", CacheEntry{Response: []byte("shared"), TTL: time.Hour, Created: time.Now()})
+	hash := bodyHash([]byte("shared"))
+
+	c.Purge("a")
+	if shared := c.bodies[hash]; shared == nil || shared.refs != 1 {
+		t.Fatalf("after removing one of two entries the body is %+v, want it kept with one reference", shared)
+	}
+	if b, found := c.Get("b"); !found || string(b.Response) != "shared" {
+		t.Fatalf("b = %q, %v after a was removed", b.Response, found)
+	}
+	// Replacing b with a different body drops the last reference.
+	c.Set("b", CacheEntry{Response: []byte("new"), TTL: time.Hour, Created: time.Now()})
+	if _, found := c.bodies[hash]; found {
+		t.Fatal("body still stored after its last entry was replaced")
+	}
+}
+
+func TestDedupRefcountsUnderConcurrency(t *testing.T) {
+	// Sets, replacements and removals race on shared bodies; run with -race.
+	c := newDedupCache()
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 300 {
+				key := fmt.Sprint((g + i) % 20)
+				body := fmt.Sprint("body-", i%3)
+				c.Set(key, CacheEntry{Response: []byte(body), TTL: time.Hour, Created: time.Now()})
+				if i%7 == 0 {
+					c.Purge(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	refs := map[string]int{}
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		refs[entry.BodyHash]++
+		return true
+	})
+	if len(refs) != len(c.bodies) {
+		t.Fatalf("entries reference %d bodies, the body table holds %d", len(refs), len(c.bodies))
+	}
+	for hash, shared := range c.bodies {
+		if shared.refs != refs[hash] {
+			t.Errorf("body %.8s has refcount %d, %d entries use it", hash, shared.refs, refs[hash])
+		}
+	}
+}
+
+func TestMaxStaleCapsStaleServing(t *testing.T) {
+	var failing atomic.Bool
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("good"))
+	})
+	p.cache.maxStale = time.Minute
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	failing.Store(true)
+
+	clock.advance(p.defaultTTL + 30*time.Second)
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "good" {
+		t.Fatalf("within max-stale: %d %s %q, want the stale entry", rec.Code, rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	clock.advance(time.Minute)
+	if rec := get(p, "/page"); rec.Code != http.StatusServiceUnavailable || rec.Body.String() == "good" {
+		t.Fatalf("past max-stale: %d %q, want the upstream's error", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStaleIsNotServedWithoutMaxStale(t *testing.T) {
+	var failing atomic.Bool
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("good"))
+	})
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	failing.Store(true)
+	clock.advance(p.defaultTTL + time.Second)
+	if rec := get(p, "/page"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the upstream's 503", rec.Code)
+	}
+}
+
+func TestStaleWarnings(t *testing.T) {
+	var failing atomic.Bool
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("good"))
+	})
+	// A shared store, as the fetch lock only coordinates instances sharing one cache.
+	p.cache = &Cache{store: newGobStore(), maxStale: time.Hour}
+	p.staleWarnings = true
+	clock := newFakeClock(p.cache)
+	get(p, "/error")
+	get(p, "/locked")
+	clock.advance(p.defaultTTL + time.Second)
+
+	// Stale because the upstream failed.
+	failing.Store(true)
+	if rec := get(p, "/error"); rec.Header().Get("X-Cache") != "STALE" || rec.Header().Get("Warning") != warnRevalidationFailed {
+		t.Fatalf("stale-if-error: %s with Warning %q, want %q", rec.Header().Get("X-Cache"), rec.Header().Get("Warning"), warnRevalidationFailed)
+	}
+
+	// Stale while another instance holds the fetch lock and refetches.
+	lock := newFakeLock()
+	lock.TryLock(generateCacheKey(httptest.NewRequest(http.MethodGet, "/locked", nil), p.keyOptions), time.Minute)
+	p.fetchLock, p.fetchLockWait = lock, time.Minute
+	if rec := get(p, "/locked"); rec.Header().Get("X-Cache") != "STALE" || rec.Header().Get("Warning") != warnResponseStale {
+		t.Fatalf("stale while refetching: %s with Warning %q, want %q", rec.Header().Get("X-Cache"), rec.Header().Get("Warning"), warnResponseStale)
+	}
+
+	p.staleWarnings = false
+	if rec := get(p, "/locked"); rec.Header().Get("X-Cache") != "STALE" || rec.Header().Get("Warning") != "" {
+		t.Fatalf("with warnings off: %s with Warning %q, want a STALE without one", rec.Header().Get("X-Cache"), rec.Header().Get("Warning"))
+	}
+}
+
+func TestHitCountsUnderConcurrentGets(t *testing.T) {
+	c := &Cache{store: MemoryStore{}}
+	c.Set("a", CacheEntry{Response: []byte("a"), TTL: time.Hour, Created: time.Now()})
+	c.Set("b", CacheEntry{Response: []byte("b"), TTL: time.Hour, Created: time.Now()})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				c.Get("a")
+				if i%5 == 0 {
+					c.Get("b")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	top := c.TopHits(3)
+	if len(top) != 2 || top[0].Key != "a" || top[0].Hits != 8*500 || top[1].Key != "b" || top[1].Hits != 8*100 {
+		t.Fatalf("TopHits = %+v; want a with %d hits, then b with %d", top, 8*500, 8*100)
+	}
+	if top := c.TopHits(1); len(top) != 1 || top[0].Key != "a" {
+		t.Fatalf("TopHits(1) = %+v, want just a", top)
+	}
+	// Replacing an entry starts its count over.
+	c.Set("a", CacheEntry{Response: []byte("a2"), TTL: time.Hour, Created: time.Now()})
+	if top := c.TopHits(1); top[0].Key != "b" {
+		t.Fatalf("TopHits after replacing a = %+v, want b first", top)
+	}
+}
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	// Readers of one hot entry; with hits counted under the read lock they never wait on each other.
+	c := &Cache{store: MemoryStore{}}
+	c.Set("hot", CacheEntry{Response: []byte("body"), TTL: time.Hour, Created: time.Now()})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Get("hot")
+		}
+	})
+}
+
+func TestClearCacheRacesWithSet(t *testing.T) {
+	// Writers and clears on the same keys; run with -race.
+	c := newDedupCache()
+	c.metaIndex = map[string]map[string]struct{}{}
+	var wg sync.WaitGroup
+	for g := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				if g%4 == 0 && i%20 == 0 {
+					c.ClearCache()
+					continue
+				}
+				c.Set(fmt.Sprint(i%10), CacheEntry{Response: []byte("body"), Metadata: map[string]string{"g": fmt.Sprint(g)}, TTL: time.Hour, Created: time.Now()})
+				c.Get(fmt.Sprint(i % 7))
+			}
+		}()
+	}
+	wg.Wait()
+	c.ClearCache()
+	if n := entryCount(c); n != 0 || len(c.bodies) != 0 || len(c.metaIndex) != 0 {
+		t.Fatalf("after ClearCache: %d entries, %d bodies, %d index keys", n, len(c.bodies), len(c.metaIndex))
+	}
+}
+
+func TestVaryKeepsVariantsApart(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("lang " + r.Header.Get("Accept-Language")))
+	})
+	request := func(lang string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("Accept-Language", lang)
+		return do(p, r)
+	}
+	for _, want := range []string{"MISS", "HIT"} {
+		for _, lang := range []string{"en", "de"} {
+			rec := request(lang)
+			if rec.Body.String() != "lang "+lang || rec.Header().Get("X-Cache") != want {
+				t.Fatalf("%s client got %q as %s, want its own variant as %s", lang, rec.Body.String(), rec.Header().Get("X-Cache"), want)
+			}
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("upstream fetches = %d, want one per variant", n)
+	}
+}
+
+func TestVaryAcceptEncodingSeparatesClients(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			w.Write([]byte("br client"))
+			return
+		}
+		w.Write([]byte("plain client"))
+	})
+	request := func(encoding string) string {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		return do(p, r).Body.String()
+	}
+	request("br")
+	if body := request("identity"); body != "plain client" {
+		t.Fatalf("identity client got %q", body)
+	}
+	if body := request("br"); body != "br client" {
+		t.Fatalf("br client got %q", body)
+	}
+}
+
+func TestVaryStarIsNeverServedFromCache(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Vary", "*")
+		w.Write([]byte("body"))
+	})
+	for range 3 {
+		if rec := get(p, "/page"); rec.Header().Get("X-Cache") == "HIT" {
+			t.Fatal("a Vary: * response was served from the cache")
+		}
+	}
+	if n := fetches.Load(); n != 3 {
+		t.Fatalf("upstream fetches = %d, want 3", n)
+	}
+}
+
+func TestVaryIsForgottenWithTheLastVariant(t *testing.T) {
+	varied := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("body"))
+	}
+	varyCount := func(c *Cache) int {
+		c.variesMu.RLock()
+		defer c.variesMu.RUnlock()
+		return len(c.varies)
+	}
+	t.Run("expiry", func(t *testing.T) {
+		p := newTestProxy(t, varied)
+		clock := newFakeClock(p.cache)
+		get(p, "/a")
+		get(p, "/b")
+		clock.advance(p.defaultTTL + time.Second)
+		p.cache.Sweep()
+		if n := varyCount(p.cache); n != 0 {
+			t.Fatalf("%d Vary records left after every entry expired, want 0", n)
+		}
+	})
+	t.Run("eviction", func(t *testing.T) {
+		p := newTestProxy(t, varied)
+		p.cache.maxEntries = 1
+		get(p, "/a")
+		get(p, "/b")
+		if n := varyCount(p.cache); n != 1 {
+			t.Fatalf("%d Vary records with one entry left, want 1", n)
+		}
+	})
+	t.Run("replaced", func(t *testing.T) {
+		p := newTestProxy(t, varied)
+		clock := newFakeClock(p.cache)
+		get(p, "/a")
+		clock.advance(p.defaultTTL + time.Second)
+		get(p, "/a")
+		if rec := get(p, "/a"); rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("after refetching the only variant = %s, want a HIT", rec.Header().Get("X-Cache"))
+		}
+	})
+	t.Run("shared", func(t *testing.T) {
+		p := newTestProxy(t, varied)
+		p.cache = &Cache{store: newGobStore()}
+		clock := newFakeClock(p.cache)
+		get(p, "/a")
+		p.cache.Sweep()
+		if n := varyCount(p.cache); n != 1 {
+			t.Fatalf("%d Vary records while the variant is fresh, want 1", n)
+		}
+		clock.advance(p.defaultTTL + time.Second)
+		p.cache.Sweep()
+		if n := varyCount(p.cache); n != 0 {
+			t.Fatalf("%d Vary records after the shared variants expired, want 0", n)
+		}
+	})
+}
+
+func TestChangedVaryDropsOldVariants(t *testing.T) {
+	var vary atomic.Value
+	vary.Store("Accept-Language")
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", vary.Load().(string))
+		w.Write([]byte(vary.Load().(string) + " " + r.Header.Get("Accept-Language")))
+	})
+	request := func(lang string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("Accept-Language", lang)
+		return do(p, r)
+	}
+	request("en")
+	request("de")
+	if n := entryCount(p.cache); n != 2 {
+		t.Fatalf("%d entries, want one per language", n)
+	}
+
+	vary.Store("User-Agent")
+	request("fr")
+	if n := entryCount(p.cache); n != 1 {
+		t.Fatalf("%d entries after Vary changed, want only the new variant", n)
+	}
+	// Language no longer selects the variant, so en gets the variant stored for fr.
+	if rec := request("en"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "User-Agent fr" {
+		t.Fatalf("en after the change = %s %q, want the new variant", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	vary.Store("")
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("User-Agent", "other")
+	do(p, r)
+	// With Vary gone, the response fetched for the other agent answers everyone.
+	if rec := request("de"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != " " {
+		t.Fatalf("de after Vary was dropped = %s %q, want the unvaried entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if n := entryCount(p.cache); n != 1 {
+		t.Fatalf("%d entries after Vary was dropped, want 1", n)
+	}
+}
+
+func TestSweeperRemovesExpiredEntriesWithoutReads(t *testing.T) {
+	c := &Cache{store: MemoryStore{}}
+	for i := range 5 {
+		c.Set(fmt.Sprint("short", i), CacheEntry{Response: []byte("x"), TTL: 20 * time.Millisecond, Created: time.Now()})
+	}
+	c.Set("long", CacheEntry{Response: []byte("x"), TTL: time.Hour, Created: time.Now()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		c.runSweeper(ctx, 10*time.Millisecond)
+		close(stopped)
+	}()
+	waitFor(t, "the expired entries to be swept", func() bool { return entryCount(c) == 1 })
+	if _, found := c.Get("long"); !found {
+		t.Fatal("the sweeper removed an entry that had not expired")
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the sweeper did not stop when its context was cancelled")
+	}
+}
+
+func TestFakeClockDrivesExpiry(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	})
+	p.cache.maxStale = time.Minute
+	clock := newFakeClock(p.cache)
+	start := clock.now
+	get(p, "/page")
+	key := generateCacheKey(httptest.NewRequest(http.MethodGet, "/page", nil), p.keyOptions)
+	if entry, _ := p.cache.Get(key); !entry.Created.Equal(start) {
+		t.Fatalf("entry created at %v, want the fake clock's %v", entry.Created, start)
+	}
+
+	clock.advance(p.defaultTTL)
+	if _, found := p.cache.Get(key); !found {
+		t.Fatal("expired exactly at its TTL, want it valid up to and including the TTL")
+	}
+	clock.advance(time.Nanosecond)
+	if _, found := p.cache.Get(key); found {
+		t.Fatal("still fresh past its TTL")
+	}
+	if _, found := p.cache.GetStale(key); !found {
+		t.Fatal("not served stale within max-stale")
+	}
+	clock.advance(time.Minute)
+	if removed := p.cache.Sweep(); removed != 1 {
+		t.Fatalf("Sweep removed %d entries past max-stale, want 1", removed)
+	}
+}
+
+func TestOnEvictFiresOutsideTheLock(t *testing.T) {
+	c := &Cache{store: MemoryStore{}, maxEntries: 2}
+	clock := newFakeClock(c)
+	var evicted []string
+	c.OnEvict = func(key string, entry CacheEntry) {
+		// Reads the cache from inside the callback, which would deadlock if it ran under the lock.
+		entryCount(c)
+		if _, found := c.Get(key); found {
+			t.Errorf("%s still cached when reported evicted", key)
+		}
+		evicted = append(evicted, key+"="+string(entry.Response))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, key := range []string{"a", "b", "c"} {
+			c.Set(key, CacheEntry{Response: []byte(key), TTL: time.Minute, Created: clock.now})
+		}
+		clock.advance(2 * time.Minute)
+		c.Sweep()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEvict deadlocked")
+	}
+	slices.Sort(evicted[1:])
+	if want := []string{"a=a", "b=b", "c=c"}; !slices.Equal(evicted, want) {
+		t.Fatalf("evicted %v, want a for space, then b and c on expiry", evicted)
+	}
+	if n := c.evictions.Load(); n != 3 {
+		t.Fatalf("evictions = %d, want 3", n)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type CookieRewrite struct { //Rewrites the Domain and Path attributes of Set-Cookie headers forwarded to clients.
+	DomainFrom string //DomainFrom: Cookie domain set by the target, "" to leave domains alone.
+	DomainTo   string //DomainTo: Public domain replacing DomainFrom, "" to drop the attribute and make the cookie host-only.
+	PathFrom   string //PathFrom: Path prefix set by the target, "" to leave paths alone.
+	PathTo     string //PathTo: Prefix replacing PathFrom.
+}
+
+func parseRewrite(value string) (from, to string, err error) {
+	// Parses a "from=to" rewrite flag; an empty value disables the rewrite.
+	if value == "" {
+		return "", "", nil
+	}
+	from, to, found := strings.Cut(value, "=")
+	if !found || strings.TrimSpace(from) == "" {
+		return "", "", fmt.Errorf("invalid rewrite %q, want from=to", value)
+	}
+	return strings.TrimSpace(from), strings.TrimSpace(to), nil
+}
+
+func (c CookieRewrite) apply(h http.Header) {
+	/* Rewrites every Set-Cookie value in h. The values get a fresh slice, since h may share
+	its slices with the upstream response.*/
+	cookies := h.Values("Set-Cookie")
+	if len(cookies) == 0 || (c.DomainFrom == "" && c.PathFrom == "") {
+		return
+	}
+	rewritten := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		rewritten[i] = c.rewrite(cookie)
+	}
+	h["Set-Cookie"] = rewritten
+}
+
+func (c CookieRewrite) rewrite(cookie string) string {
+	// Rewrites the attributes of a single Set-Cookie value; the name=value pair and other attributes are kept as sent.
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case c.DomainFrom != "" && strings.EqualFold(strings.TrimSpace(name), "Domain") &&
+			strings.EqualFold(strings.TrimPrefix(value, "."), strings.TrimPrefix(c.DomainFrom, ".")):
+			if c.DomainTo == "" {
+				continue
+			}
+			part = " Domain=" + c.DomainTo
+		case c.PathFrom != "" && strings.EqualFold(strings.TrimSpace(name), "Path"):
+			if rest, ok := cutPathPrefix(value, c.PathFrom); ok {
+				part = " Path=" + joinPath(c.PathTo, rest)
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
+
+func cutPathPrefix(p, prefix string) (string, bool) {
+	// Strips prefix from p when it matches whole path segments, so /app does not match /application.
+	prefix = strings.TrimSuffix(prefix, "/")
+	if p == prefix {
+		return "", true
+	}
+	if rest, ok := strings.CutPrefix(p, prefix+"/"); ok {
+		return "/" + rest, true
+	}
+	return "", false
+}
+
+func joinPath(prefix, rest string) string {
+	// Joins a replacement prefix with the remainder of a rewritten path without doubling slashes.
+	joined := strings.TrimSuffix(prefix, "/") + rest
+	if joined == "" {
+		return "/"
+	}
+	return joined
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCookieRewrite(t *testing.T) {
+	c := CookieRewrite{DomainFrom: "origin.internal", DomainTo: "www.example.com", PathFrom: "/app", PathTo: "/"}
+	tests := map[string]string{
+		"sid=1; Domain=origin.internal; Path=/app; HttpOnly": "sid=1; Domain=www.example.com; Path=/; HttpOnly",
+		"sid=1; domain=.Origin.Internal; path=/app/account":  "sid=1; Domain=www.example.com; Path=/account",
+		"sid=1; Domain=other.com; Path=/application":         "sid=1; Domain=other.com; Path=/application",
+		"sid=1; Secure":                     "sid=1; Secure",
+		"pref=a=b; Path=/app; SameSite=Lax": "pref=a=b; Path=/; SameSite=Lax",
+	}
+	for in, want := range tests {
+		if got := c.rewrite(in); got != want {
+			t.Errorf("rewrite(%q) = %q, want %q", in, got, want)
+		}
+	}
+	hostOnly := CookieRewrite{DomainFrom: "origin.internal"}
+	if got := hostOnly.rewrite("sid=1; Domain=origin.internal; Path=/"); got != "sid=1; Path=/" {
+		t.Errorf("with an empty target domain got %q, want the Domain attribute dropped", got)
+	}
+}
+
+func TestCookieRewriteHandlesEverySetCookie(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1; Domain=origin.internal; Path=/app")
+		w.Header().Add("Set-Cookie", "b=2; Domain=origin.internal; Path=/app/cart")
+		w.Write([]byte("ok"))
+	})
+	p.cookieRewrite = CookieRewrite{DomainFrom: "origin.internal", DomainTo: "shop.example", PathFrom: "/app", PathTo: "/shop"}
+	got := get(p, "/page").Header().Values("Set-Cookie")
+	want := []string{"a=1; Domain=shop.example; Path=/shop", "b=2; Domain=shop.example; Path=/shop/cart"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("Set-Cookie = %q, want %q", got, want)
+	}
+}
+
+func TestParseRewrite(t *testing.T) {
+	if from, to, err := parseRewrite(" origin.internal = www.example.com "); err != nil || from != "origin.internal" || to != "www.example.com" {
+		t.Errorf("parseRewrite = %q, %q, %v", from, to, err)
+	}
+	if from, _, err := parseRewrite(""); err != nil || from != "" {
+		t.Errorf("empty rewrite = %q, %v; want it disabled", from, err)
+	}
+	for _, value := range []string{"origin.internal", "=www.example.com"} {
+		if _, _, err := parseRewrite(value); err == nil {
+			t.Errorf("parseRewrite(%q) accepted", value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func acceptsEncoding(r *http.Request, coding string) bool {
+	/* Reports whether the request's Accept-Encoding allows the given content coding.
+	A coding listed with q=0 is refused, and * stands for any coding not listed explicitly.*/
+	wildcard := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		acceptable := true
+		if q, found := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); found {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				acceptable = false
+			}
+		}
+		switch name {
+		case coding:
+			return acceptable
+		case "*":
+			wildcard = acceptable
+		}
+	}
+	return wildcard
+}
+
+func (p *ProxyServer) negotiateEncoding(r *http.Request, entry CacheEntry) (CacheEntry, bool) {
+	/*
+		Adapts a cached entry to the client's Accept-Encoding before it is served as a hit.
+		A gzip body going to a client that doesn't accept gzip is decompressed on the fly when gzipMismatch is "decompress" or upstreamEncoding is set;
+		otherwise, or when the body can't be decompressed, false is returned and the request is treated as a miss.
+		The cached entry itself is never modified.
+	*/
+	entry, ok := expandEntry(r, entry)
+	if !ok {
+		return CacheEntry{}, false
+	}
+	if !strings.EqualFold(entry.Headers.Get("Content-Encoding"), "gzip") || acceptsEncoding(r, "gzip") {
+		return entry, true
+	}
+	if p.gzipMismatch != "decompress" && p.upstreamEncoding == "" {
+		// With upstreamEncoding a refetch would bring back the same gzip body, so it is decompressed regardless.
+		return CacheEntry{}, false
+	}
+	body, err := gunzip(entry.Response)
+	if err != nil {
+		return CacheEntry{}, false
+	}
+	headers := entry.Headers.Clone()
+	headers.Del("Content-Encoding")
+	headers.Del("Content-Length")
+	entry.Headers = headers
+	entry.Response = body
+	return entry, true
+}
+
+func decodeForClient(r *http.Request, h http.Header, body []byte) []byte {
+	/* Decompresses a freshly fetched gzip body in place of the response for a client that doesn't accept gzip,
+	which happens when the upstream Accept-Encoding is normalized. h is the outgoing header set and is adjusted to match.*/
+	if !strings.EqualFold(h.Get("Content-Encoding"), "gzip") || acceptsEncoding(r, "gzip") {
+		return body
+	}
+	decoded, err := gunzip(body)
+	if err != nil {
+		return body
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	return decoded
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	// Decompresses a gzip body.
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+const compressMinSize = 1024 // Bodies smaller than this are stored as they are; gzip's overhead would eat most of the saving.
+
+type gzipPool struct { //Reusable gzip writers at one compression level, so compress-bodies doesn't allocate a fresh writer per entry.
+	pool  sync.Pool //pool: Idle *gzip.Writer values.
+	level int       //level: Compression level of every writer, see compress/gzip.
+}
+
+func newGzipPool(level int) (*gzipPool, error) {
+	// Creates a pool of writers compressing at level, which must be gzip.DefaultCompression or between gzip.HuffmanOnly and gzip.BestCompression.
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	gp := &gzipPool{level: level}
+	gp.pool.New = func() any {
+		zw, _ := gzip.NewWriterLevel(io.Discard, level)
+		return zw
+	}
+	return gp, nil
+}
+
+func (gp *gzipPool) compressBody(h http.Header, body []byte) ([]byte, bool) {
+	/* Gzips a body for storage when compress-bodies is on, reporting whether it did. Bodies the upstream already
+	encoded, small bodies and bodies that don't shrink, such as images, are left alone.
+	A nil pool compresses at the default level with a new writer.*/
+	if len(body) < compressMinSize || h.Get("Content-Encoding") != "" {
+		return body, false
+	}
+	var buf bytes.Buffer
+	var zw *gzip.Writer
+	if gp == nil {
+		zw = gzip.NewWriter(&buf)
+	} else {
+		zw = gp.pool.Get().(*gzip.Writer)
+		zw.Reset(&buf)
+		defer gp.pool.Put(zw)
+	}
+	zw.Write(body)
+	if err := zw.Close(); err != nil || buf.Len() >= len(body) {
+		return body, false
+	}
+	return buf.Bytes(), true
+}
+
+func expandEntry(r *http.Request, entry CacheEntry) (CacheEntry, bool) {
+	/*
+		Prepares an entry the proxy stored compressed for the client. A client accepting gzip gets the stored bytes as is,
+		with Content-Encoding: gzip and the ETag weakened, since these bytes are not the upstream's representation;
+		any other client gets the body decompressed. Either way Vary: Accept-Encoding tells downstream caches the
+		response depends on it. Entries stored as they came are returned unchanged, and so is the cached entry itself.
+	*/
+	if !entry.Compressed {
+		return entry, true
+	}
+	headers := entry.Headers.Clone()
+	headers.Del("Content-Length")
+	if names, _ := varyHeaders(headers); !slices.Contains(names, "Accept-Encoding") {
+		headers.Add("Vary", "Accept-Encoding")
+	}
+	if acceptsEncoding(r, "gzip") {
+		headers.Set("Content-Encoding", "gzip")
+		if etag := headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			headers.Set("ETag", "W/"+etag)
+		}
+	} else {
+		body, err := gunzip(entry.Response)
+		if err != nil {
+			return CacheEntry{}, false
+		}
+		entry.Response = body
+	}
+	entry.Headers = headers
+	entry.Compressed = false
+	return entry, true
+}
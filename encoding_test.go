@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	// Returns s gzip-compressed.
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0", false},
+		{"*", true},
+		{"br, *;q=0", false},
+		{"*, gzip;q=0", false},
+		{"identity", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsEncoding(r, "gzip"); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, gzip) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGzipCachedEntryForClientWithoutGzip(t *testing.T) {
+	for _, mode := range []string{"decompress", "refetch"} {
+		t.Run(mode, func(t *testing.T) {
+			var fetches atomic.Int32
+			compressed := gzipped(t, "hello")
+			p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				// Answers in the client's encoding but, like a misconfigured origin, without Vary.
+				fetches.Add(1)
+				if acceptsEncoding(r, "gzip") {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Write(compressed)
+					return
+				}
+				w.Write([]byte("hello"))
+			})
+			p.gzipMismatch = mode
+
+			r := httptest.NewRequest(http.MethodGet, "/page", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			if rec := do(p, r); !bytes.Equal(rec.Body.Bytes(), compressed) {
+				t.Fatalf("gzip client got %q, want the compressed body", rec.Body.Bytes())
+			}
+
+			rec := get(p, "/page")
+			if rec.Body.String() != "hello" || rec.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("plain client got %q with Content-Encoding %q, want the plain body", rec.Body.Bytes(), rec.Header().Get("Content-Encoding"))
+			}
+			if cl := rec.Header().Get("Content-Length"); cl != "5" {
+				t.Fatalf("Content-Length = %q, want the decompressed length", cl)
+			}
+			wantCache, wantFetches := "HIT", int32(1)
+			if mode == "refetch" {
+				wantCache, wantFetches = "MISS", 2
+			}
+			if rec.Header().Get("X-Cache") != wantCache || fetches.Load() != wantFetches {
+				t.Fatalf("plain client got a %s after %d fetches, want a %s after %d", rec.Header().Get("X-Cache"), fetches.Load(), wantCache, wantFetches)
+			}
+		})
+	}
+}
+
+func TestUpstreamAcceptEncodingIsNormalized(t *testing.T) {
+	var forwarded []string
+	compressed := gzipped(t, "hello")
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get("Accept-Encoding"))
+		if acceptsEncoding(r, "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(compressed)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+	p.upstreamEncoding = "gzip"
+
+	for i, accept := range []string{"br, deflate", "gzip, br", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/page?n="+strconv.Itoa(i), nil)
+		if accept != "" {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		rec := do(p, r)
+		wantBody, wantEncoding := []byte("hello"), ""
+		if acceptsEncoding(r, "gzip") {
+			wantBody, wantEncoding = compressed, "gzip"
+		}
+		if !bytes.Equal(rec.Body.Bytes(), wantBody) || rec.Header().Get("Content-Encoding") != wantEncoding {
+			t.Errorf("Accept-Encoding %q: got %q encoded %q, want %q encoded %q", accept, rec.Body.Bytes(), rec.Header().Get("Content-Encoding"), wantBody, wantEncoding)
+		}
+	}
+	for _, got := range forwarded {
+		if got != "gzip" {
+			t.Fatalf("forwarded Accept-Encoding values %q, want gzip every time", forwarded)
+		}
+	}
+}
+
+func TestNormalizedEncodingSharesOneVariant(t *testing.T) {
+	var fetches atomic.Int32
+	var forwarded sync.Map
+	compressed := gzipped(t, "hello")
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		forwarded.Store(r.Header.Get("Accept-Encoding"), true)
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed)
+	})
+	p.upstreamEncoding = "gzip"
+	p.refreshWindow = 30 * time.Second
+	clock := newFakeClock(p.cache)
+
+	for _, accept := range []string{"gzip", "gzip, br", "br", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		rec := do(p, r)
+		if want := acceptsEncoding(r, "gzip"); (rec.Header().Get("Content-Encoding") == "gzip") != want {
+			t.Errorf("Accept-Encoding %q got Content-Encoding %q", accept, rec.Header().Get("Content-Encoding"))
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("upstream fetches = %d, want every Accept-Encoding served from one variant", n)
+	}
+
+	clock.advance(p.defaultTTL - 10*time.Second)
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("Accept-Encoding", "br")
+	r.Header.Set("If-None-Match", `"v1"`)
+	do(p, r)
+	waitFor(t, "the background refresh", func() bool { return fetches.Load() == 2 })
+	forwarded.Range(func(value, _ any) bool {
+		if value != "gzip" {
+			t.Errorf("upstream saw Accept-Encoding %q, want gzip on the foreground and refresh fetches alike", value)
+		}
+		return true
+	})
+}
+
+func TestCompressedBodiesRoundTrip(t *testing.T) {
+	page := strings.Repeat("<p>compressible text</p>\n", 500)
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(page))
+	})
+	p.compressBodies = true
+	get(p, "/page")
+	if summary := p.cache.Summary(); summary.Bytes*10 > int64(len(page)) {
+		t.Fatalf("stored %d bytes for a %d-byte page, want it compressed", summary.Bytes, len(page))
+	}
+
+	rec := get(p, "/page")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != page || rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("plain client got %s, %d bytes, Content-Encoding %q; want the original page", rec.Header().Get("X-Cache"), rec.Body.Len(), rec.Header().Get("Content-Encoding"))
+	}
+	if rec.Header().Get("Content-Length") != strconv.Itoa(len(page)) {
+		t.Fatalf("plain client Content-Length = %q, want %d", rec.Header().Get("Content-Length"), len(page))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec = do(p, r)
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("ETag") != `W/"v1"` || !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+		t.Fatalf("gzip client headers = %v", rec.Header())
+	}
+	body, err := gunzip(rec.Body.Bytes())
+	if err != nil || string(body) != page {
+		t.Fatalf("gzip client body did not decompress to the page: %v", err)
+	}
+}
+
+func TestCompressBodySkipsWhatWontShrink(t *testing.T) {
+	var gp *gzipPool
+	if _, compressed := gp.compressBody(http.Header{}, []byte("short")); compressed {
+		t.Error("a body below compressMinSize was compressed")
+	}
+	long := []byte(strings.Repeat("a", 4096))
+	if _, compressed := gp.compressBody(http.Header{"Content-Encoding": {"br"}}, long); compressed {
+		t.Error("an already encoded body was compressed")
+	}
+	if _, compressed := gp.compressBody(http.Header{}, gzipped(t, strings.Repeat("random-ish 1234567890", 300))); compressed {
+		t.Error("a body that doesn't shrink was compressed")
+	}
+}
+
+func TestCompressLevels(t *testing.T) {
+	page := []byte(strings.Repeat("<p>compressible text</p>\n", 500))
+	for _, level := range []int{gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression} {
+		gp, err := newGzipPool(level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 3 {
+			body, compressed := gp.compressBody(http.Header{}, page)
+			if !compressed {
+				t.Fatalf("level %d did not compress the page", level)
+			}
+			if plain, err := gunzip(body); err != nil || !bytes.Equal(plain, page) {
+				t.Fatalf("level %d output did not decompress to the page: %v", level, err)
+			}
+		}
+	}
+	if _, err := newGzipPool(10); err == nil {
+		t.Fatal("level 10 was accepted")
+	}
+}
+
+func TestGzipPoolReusesWriters(t *testing.T) {
+	gp, err := newGzipPool(gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created int
+	gp.pool.New = func() any {
+		created++
+		zw, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+		return zw
+	}
+	page := []byte(strings.Repeat("<p>compressible text</p>\n", 500))
+	for range 100 {
+		gp.compressBody(http.Header{}, page)
+	}
+	// sync.Pool may drop idle values, at a GC or at random under the race detector, so allow some, but not one per body.
+	if created > 50 {
+		t.Fatalf("created %d writers for 100 bodies, want them reused", created)
+	}
+}
+
+func BenchmarkCompressBody(b *testing.B) {
+	page := []byte(strings.Repeat("<p>compressible text</p>\n", 500))
+	pooled, _ := newGzipPool(gzip.DefaultCompression)
+	for name, gp := range map[string]*gzipPool{"unpooled": nil, "pooled": pooled} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				gp.compressBody(http.Header{}, page)
+			}
+		})
+	}
+}
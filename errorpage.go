@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const gatewayRetryAfter = 10 * time.Second // Retry hint offered on gateway error pages.
+
+type errorPage struct { //A template rendered in place of the bare text of 502 and 504 responses.
+	tmpl interface{ Execute(io.Writer, any) error } //tmpl: The parsed template, html/template or text/template.
+	html bool                                       //html: Whether tmpl renders HTML, served only to clients accepting text/html.
+}
+
+type errorPageData struct { //Variables available to error templates.
+	Status     int    //Status: The HTTP status code, e.g. 502.
+	StatusText string //StatusText: The standard text for Status, e.g. "Bad Gateway".
+	Message    string //Message: What went wrong, as in the plain-text response.
+	RequestID  string //RequestID: The client's X-Request-ID, or a generated one to quote in support requests.
+	RetryAfter int    //RetryAfter: Suggested number of seconds to wait before retrying.
+}
+
+func loadErrorPage(path string) (*errorPage, error) {
+	/* Parses an error template file. Files ending in .html or .htm are HTML templates with contextual escaping;
+	anything else is a text template.*/
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		tmpl, err := htmltemplate.New(filepath.Base(path)).Parse(string(content))
+		if err != nil {
+			return nil, err
+		}
+		return &errorPage{tmpl: tmpl, html: true}, nil
+	}
+	tmpl, err := template.New(filepath.Base(path)).Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return &errorPage{tmpl: tmpl}, nil
+}
+
+func (p *ProxyServer) gatewayError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	/* Answers a failed upstream exchange. Without an error template, or for a client that wouldn't accept an
+	HTML template's output, this is the usual plain-text http.Error.*/
+	page := p.errorPage
+	if page == nil || (page.html && !strings.Contains(r.Header.Get("Accept"), "text/html")) {
+		http.Error(w, message, status)
+		return
+	}
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  requestID(r),
+		RetryAfter: int(gatewayRetryAfter.Seconds()),
+	}
+	var out bytes.Buffer
+	if err := page.tmpl.Execute(&out, data); err != nil {
+		log.Printf("Rendering error template failed: %v", err)
+		http.Error(w, message, status)
+		return
+	}
+	if page.html {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(out.Bytes())
+}
+
+func requestID(r *http.Request) string {
+	// Returns the request's X-Request-ID, or a random one when the client sent none.
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
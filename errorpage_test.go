@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func failingProxy(t *testing.T, template, name string) *ProxyServer {
+	// Returns a proxy whose upstream is closed, rendering gateway errors with template written to a file called name.
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(template), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, http.NotFound)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	p.targetHost = closed.URL
+	closed.Close()
+	page, err := loadErrorPage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.errorPage = page
+	return p
+}
+
+func TestErrorTemplateSubstitutesVariables(t *testing.T) {
+	p := failingProxy(t, "{{.Status}} {{.StatusText}} id={{.RequestID}} retry={{.RetryAfter}}", "error.txt")
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("X-Request-ID", "abc123")
+	rec := do(p, r)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", rec.Code)
+	}
+	if want := "502 Bad Gateway id=abc123 retry=10"; rec.Body.String() != want {
+		t.Fatalf("body = %q, want %q", rec.Body.String(), want)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("Content-Type = %q, want text/plain", ct)
+	}
+}
+
+func TestHTMLErrorTemplateIsNegotiated(t *testing.T) {
+	p := failingProxy(t, "<h1>{{.StatusText}}</h1><p>{{.RequestID}}</p>", "error.html")
+	request := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("Accept", accept)
+		r.Header.Set("X-Request-ID", "<script>")
+		return do(p, r)
+	}
+
+	rec := request("text/html,application/xhtml+xml")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("browser got Content-Type %q, want text/html", ct)
+	}
+	if want := "<h1>Bad Gateway</h1><p>&lt;script&gt;</p>"; rec.Body.String() != want {
+		t.Fatalf("browser got %q, want %q", rec.Body.String(), want)
+	}
+
+	rec = request("application/json")
+	if rec.Code != http.StatusBadGateway || strings.Contains(rec.Body.String(), "<h1>") {
+		t.Fatalf("API client got %d %q, want the plain-text error", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLoadErrorPageRejectsBrokenTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "error.txt")
+	os.WriteFile(path, []byte("{{.Status"), 0o644)
+	if _, err := loadErrorPage(path); err == nil {
+		t.Fatal("an unparsable template was accepted")
+	}
+	if _, err := loadErrorPage(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Fatal("a missing template was accepted")
+	}
+}
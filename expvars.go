@@ -0,0 +1,14 @@
+package main
+
+import "expvar"
+
+const expvarPath = "/debug/vars" // Where the expvar handler is served, as the expvar package does on http.DefaultServeMux.
+
+func (p *ProxyServer) publishExpvars() {
+	/* Publishes the cache counters through expvar, next to the runtime's cmdline and memstats, for monitoring without Prometheus.
+	The values are read when /debug/vars is fetched. Publishing the same name twice panics, so this runs once, from main.*/
+	expvar.Publish("cache_hits", expvar.Func(func() any { return p.stats.hits.Load() }))
+	expvar.Publish("cache_misses", expvar.Func(func() any { return p.stats.misses.Load() }))
+	expvar.Publish("cache_entries", expvar.Func(func() any { return p.cacheSummary().Entries }))
+	expvar.Publish("upstream_errors", expvar.Func(func() any { return p.stats.upstreamErrors.Load() }))
+}
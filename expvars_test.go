@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpvarsArePublished(t *testing.T) {
+	// Publishing a name twice panics, so this is the only test that publishes, and only on its first run.
+	if expvar.Get("cache_hits") != nil {
+		t.Skip("published by an earlier run")
+	}
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	})
+	p.publishExpvars()
+	get(p, "/a")
+	get(p, "/a")
+	get(p, "/b")
+
+	rec := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, expvarPath, nil))
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("/debug/vars is not JSON: %v", err)
+	}
+	for name, want := range map[string]string{"cache_hits": "1", "cache_misses": "2", "cache_entries": "2", "upstream_errors": "0"} {
+		if got := string(vars[name]); got != want {
+			t.Errorf("%s = %s, want %s", name, got, want)
+		}
+	}
+	if _, found := vars["memstats"]; !found {
+		t.Error("the runtime's memstats are missing")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+type flight struct { //An upstream fetch in progress that other requests for the same key wait on.
+	done chan struct{} //done: Closed once the fetch has finished and its response is stored.
+	err  error         //err: Why the fetch failed, nil on success; set before done is closed.
+}
+
+type flightGroup struct { //Fetches in progress by cache key, so concurrent requests for a key share one upstream call; the zero value is ready to use.
+	mu      sync.Mutex         //A mutex guarding flights.
+	flights map[string]*flight //flights: The fetch in progress for each key.
+}
+
+func (g *flightGroup) start(key string) (f *flight, leader bool) {
+	/* Registers a fetch for key. The first caller becomes the leader, does the fetch and must call finish;
+	later callers get the leader's flight to wait on.*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, found := g.flights[key]; found {
+		return f, false
+	}
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	g.flights[key] = &flight{done: make(chan struct{})}
+	return nil, true
+}
+
+func (g *flightGroup) finish(key string, err error) {
+	// Ends the leader's fetch for key with its outcome and wakes every request waiting on it.
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f := g.flights[key]
+	f.err = err
+	close(f.done)
+	delete(g.flights, key)
+}
+
+func (p *ProxyServer) joinFetch(w http.ResponseWriter, r *http.Request, baseKey, key string, revalidating bool) (served bool, finish func(error)) {
+	/*
+		Makes sure a missing or expired key is fetched from the upstream once, however many requests want it at the same time.
+		The first request fetches, without being cancelled if its own client goes away,
+		and must call finish with the fetch's error, if any, once the response is stored;
+		after a revalidation, finish also drops the expired entry if the refetch didn't replace it.
+		The others wait and are answered from the stored entry. If the fetch failed they get a stale copy or the same 502
+		without trying again; if it succeeded but left nothing cached, e.g. a private response, they fetch on their own.
+	*/
+	f, leader := p.fetches.start(key)
+	if leader {
+		return false, func(err error) {
+			if revalidating {
+				p.cacheFor(r.URL.Path).DropExpired(key)
+			}
+			p.fetches.finish(key, err)
+		}
+	}
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		return true, nil
+	}
+	if f.err != nil {
+		if !p.serveStale(w, r, key, warnRevalidationFailed) {
+			p.gatewayError(w, r, http.StatusBadGateway, "Error while sending request")
+		}
+		return true, nil
+	}
+	if entry, found := p.lookup(r, key); found && p.serveHit(w, r, baseKey, entry) {
+		return true, nil
+	}
+	log.Printf("Shared fetch of %s left nothing cached, fetching", r.URL.Path)
+	return false, func(error) {}
+}
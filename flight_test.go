@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpiringKeyIsRefreshedOnce(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		n := fetches.Add(1)
+		time.Sleep(20 * time.Millisecond) // Keeps the refresh in flight while the other requests arrive.
+		w.Write([]byte{'0' + byte(n)})
+	})
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	clock.advance(p.defaultTTL + time.Second)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 50)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies[i] = get(p, "/page").Body.String()
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("upstream fetches = %d, want the first and a single refresh", n)
+	}
+	for i, body := range bodies {
+		if body != "2" {
+			t.Fatalf("request %d got %q, want the refreshed body", i, body)
+		}
+	}
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "2" {
+		t.Fatalf("after the refresh = %s %q, want the refreshed entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestExpiredEntryIsDroppedWhenRefreshStoresNothing(t *testing.T) {
+	var private atomic.Bool
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if private.Load() {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		w.Write([]byte("body"))
+	})
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	clock.advance(p.defaultTTL + time.Second)
+	private.Store(true)
+	get(p, "/page")
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("%d entries left after a refresh that stored nothing, want the expired one dropped", n)
+	}
+}
+
+func TestConcurrentColdRequestsFetchOnce(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("shared body"))
+	})
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 50)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = get(p, "/cold")
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("upstream fetches = %d, want 1", n)
+	}
+	misses := 0
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "shared body" {
+			t.Fatalf("request %d = %d %q", i, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("X-Cache") == "MISS" {
+			misses++
+		}
+	}
+	if misses != 1 {
+		t.Fatalf("%d responses were MISSes, want only the one that fetched", misses)
+	}
+}
+
+func TestFetchErrorReachesEveryWaiter(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-proceed
+		// Breaks the connection, so the leader's fetch fails.
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		codes[0] = get(p, "/down").Code
+	}()
+	<-arrived
+	for i := 1; i < len(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = get(p, "/down").Code
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // Lets the waiters reach the flight before the leader fails.
+	close(proceed)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusBadGateway {
+			t.Errorf("request %d = %d, want 502", i, code)
+		}
+	}
+	select {
+	case <-arrived:
+		t.Fatal("a waiter retried the failed fetch")
+	default:
+	}
+}
+
+func TestLeaderDisconnectDoesNotFailWaiters(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-proceed
+		w.Write([]byte("shared body"))
+	})
+	ctx, disconnect := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		do(p, httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx))
+	}()
+	<-arrived
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, 5)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = get(p, "/slow")
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // Lets the waiters reach the flight before the leader's client goes away.
+	disconnect()
+	time.Sleep(20 * time.Millisecond)
+	close(proceed)
+	wg.Wait()
+	<-leaderDone
+	for i, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "shared body" {
+			t.Errorf("waiter %d = %d %q, want the shared response", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := p.stats.upstreamErrors.Load(); n != 0 {
+		t.Fatalf("upstream errors = %d after the leader's client left, want 0", n)
+	}
+	select {
+	case <-arrived:
+		t.Fatal("a waiter refetched instead of sharing the leader's fetch")
+	default:
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+type ForwardProxy struct { //Forward proxy mode: clients name the upstream in absolute-form request URIs such as GET http://host/path.
+	Hosts    []string //Hosts: Globs of host names clients may reach this way, "*" for any; empty turns forward proxying off.
+	Required bool     //Required: Origin-form requests are refused, set when there is no target to send them to.
+}
+
+func (f ForwardProxy) forwards(r *http.Request) bool {
+	// Reports whether r goes to the host in its own URI rather than to the target.
+	return len(f.Hosts) > 0 && r.URL.IsAbs()
+}
+
+func (f ForwardProxy) allowed(host string) bool {
+	// Reports whether host, without its port, matches one of the allowed globs, case-insensitively.
+	host = strings.ToLower(host)
+	for _, pattern := range f.Hosts {
+		if globMatch(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f ForwardProxy) middleware(next http.Handler) http.Handler {
+	/* Wraps next so absolute-form requests for hosts outside the allowlist get 403 before anything is looked up in the cache
+	or forwarded, keeping the proxy from being used as an open relay. Only http and https URIs are forwarded; CONNECT is not supported.
+	Entries stay apart per host because the cache key is built from the full request URI.*/
+	if len(f.Hosts) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			if f.Required {
+				http.Error(w, "Absolute-form request URI required", http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if (r.URL.Scheme != "http" && r.URL.Scheme != "https") || !f.allowed(r.URL.Hostname()) {
+			log.Printf("Refusing forward proxy request for %s://%s: host not allowed", r.URL.Scheme, r.URL.Host)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
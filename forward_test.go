@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForwardProxyCachesPerHost(t *testing.T) {
+	var fetches atomic.Int32
+	origin := func(name string) *httptest.Server {
+		return serveTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+	first, second := origin("first"), origin("second")
+	p := newTestProxy(t, http.NotFound)
+	p.targetHost = ""
+	p.forward = ForwardProxy{Hosts: []string{"127.0.0.*"}, Required: true}
+	h := p.forward.middleware(http.HandlerFunc(p.handleProxy))
+	request := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	for _, want := range []string{"MISS", "HIT"} {
+		for name, srv := range map[string]*httptest.Server{"first": first, "second": second} {
+			rec := request(srv.URL + "/page")
+			if rec.Body.String() != name+" /page" || rec.Header().Get("X-Cache") != want {
+				t.Fatalf("%s = %s %q, want %s from its own host", name, rec.Header().Get("X-Cache"), rec.Body.String(), want)
+			}
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("upstream fetches = %d, want one per host", n)
+	}
+
+	localhost := strings.Replace(first.URL, "127.0.0.1", "localhost", 1)
+	if rec := request(localhost + "/page"); rec.Code != http.StatusForbidden {
+		t.Fatalf("host outside the allowlist = %d, want 403", rec.Code)
+	}
+	if rec := request("ftp://127.0.0.1/file"); rec.Code != http.StatusForbidden {
+		t.Fatalf("ftp URI = %d, want 403", rec.Code)
+	}
+	if rec := request("/page"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("origin-form request without a target = %d, want 400", rec.Code)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("refused requests reached an upstream: %d fetches", n)
+	}
+}
+
+func TestForwardedAdminPathsReachTheOrigin(t *testing.T) {
+	origin := serveTest(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin " + r.URL.Path))
+	}))
+	p := newTestProxy(t, http.NotFound)
+	p.forward = ForwardProxy{Hosts: []string{"127.0.0.1"}}
+	admin := http.NewServeMux()
+	for _, path := range []string{"/clear-cache", "/purge", "/metrics"} {
+		admin.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("admin " + path)) })
+	}
+	h := routeRequests(admin, p.forward.middleware(http.HandlerFunc(p.handleProxy)), p.forward)
+
+	for _, path := range []string{"/clear-cache", "/purge", "/metrics"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, origin.URL+path, nil))
+		if rec.Body.String() != "origin "+path {
+			t.Errorf("absolute-form %s answered %q, want the origin's", path, rec.Body.String())
+		}
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Body.String() != "admin "+path {
+			t.Errorf("origin-form %s answered %q, want the admin endpoint", path, rec.Body.String())
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://elsewhere.example/clear-cache", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("absolute-form request for a host outside the allowlist = %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const heuristicFraction = 10 // The heuristic TTL is 1/heuristicFraction of the time since Last-Modified, as RFC 7234 suggests.
+
+type contentTypeTTL struct { //A TTL for responses whose media type matches a glob.
+	pattern string        //pattern: Media type glob such as image/*, matched case-insensitively.
+	ttl     time.Duration //ttl: TTL for matching responses.
+}
+
+func parseContentTypeTTLs(list string) ([]contentTypeTTL, error) {
+	// Parses the content-type-ttl flag: comma-separated type=ttl pairs such as "image/*=24h, text/html=1m".
+	var ttls []contentTypeTTL
+	for _, item := range splitList(list) {
+		pattern, value, found := strings.Cut(item, "=")
+		ttl, err := time.ParseDuration(strings.TrimSpace(value))
+		if !found || strings.TrimSpace(pattern) == "" || err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid content-type-ttl %q, want type=ttl", item)
+		}
+		ttls = append(ttls, contentTypeTTL{pattern: strings.ToLower(strings.TrimSpace(pattern)), ttl: ttl})
+	}
+	return ttls, nil
+}
+
+func contentTypeTTLFor(h http.Header, ttls []contentTypeTTL) (time.Duration, bool) {
+	// Returns the TTL of the first pattern matching the response's media type, ignoring parameters such as charset.
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return 0, false
+	}
+	for _, t := range ttls {
+		if globMatch(t.pattern, mediaType) {
+			return t.ttl, true
+		}
+	}
+	return 0, false
+}
+
+type pathTTL struct { //A TTL for requests whose path matches a prefix or glob.
+	pattern string        //pattern: Path prefix such as /static/, or a glob when it contains * or ?.
+	ttl     time.Duration //ttl: TTL for matching responses.
+}
+
+type pathTTLs []pathTTL //The ttl-rule flag, given once per rule.
+
+func (t *pathTTLs) String() string {
+	// Formats the rules as they were given, for flag's usage output.
+	var rules []string
+	for _, rule := range *t {
+		rules = append(rules, rule.pattern+"="+rule.ttl.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (t *pathTTLs) Set(value string) error {
+	// Parses one ttl-rule flag: path=ttl such as "/static/=1h" or "/api/*/search=10s".
+	pattern, ttlValue, found := strings.Cut(value, "=")
+	ttl, err := time.ParseDuration(strings.TrimSpace(ttlValue))
+	if !found || !strings.HasPrefix(strings.TrimSpace(pattern), "/") || err != nil || ttl <= 0 {
+		return fmt.Errorf("invalid ttl-rule %q, want /path=ttl", value)
+	}
+	*t = append(*t, pathTTL{pattern: strings.TrimSpace(pattern), ttl: ttl})
+	return nil
+}
+
+func (t pathTTLs) lookup(path string) (time.Duration, bool) {
+	/* Returns the TTL of the longest pattern matching path, so /static/fonts/ beats /static/ whichever was given first.
+	A pattern with * or ? is a glob over the whole path; anything else is a prefix.*/
+	best := -1
+	for i, rule := range t {
+		var matched bool
+		if strings.ContainsAny(rule.pattern, "*?") {
+			matched = globMatch(rule.pattern, path)
+		} else {
+			matched = strings.HasPrefix(path, rule.pattern)
+		}
+		if matched && (best < 0 || len(rule.pattern) > len(t[best].pattern)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	return t[best].ttl, true
+}
+
+func forbidsCaching(h http.Header) bool {
+	/* Reports whether the upstream's Cache-Control rules out storing the response: no-store, and also no-cache and private,
+	since the proxy neither revalidates every hit nor keeps per-user copies. Directives are matched case-insensitively
+	across all Cache-Control headers; arguments such as private="Set-Cookie" still count.
+	Without any Cache-Control, a legacy Pragma: no-cache counts as no-cache (RFC 7234, section 5.4).*/
+	for _, directive := range cacheDirectives(h) {
+		switch directive {
+		case "no-store", "no-cache", "private":
+			return true
+		}
+	}
+	return false
+}
+
+func clientNoCache(h http.Header) bool {
+	/* Reports whether a request asks not to be answered from a cache without checking with the upstream:
+	Cache-Control: no-cache or max-age=0, or an HTTP/1.0 Pragma: no-cache when there is no Cache-Control.*/
+	for _, directive := range cacheDirectives(h) {
+		if directive == "no-cache" || directive == "max-age=0" {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheDirectives(h http.Header) []string {
+	/* Returns the Cache-Control directives of h lowercased, arguments of no-cache, private and the like dropped.
+	When there is no Cache-Control at all, Pragma: no-cache is read as no-cache; Cache-Control, when present, always wins.
+	This is the one place legacy caching headers are interpreted.*/
+	values := h.Values("Cache-Control")
+	if len(values) == 0 {
+		for _, value := range h.Values("Pragma") {
+			for _, directive := range strings.Split(value, ",") {
+				if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+					return []string{"no-cache"}
+				}
+			}
+		}
+		return nil
+	}
+	var directives []string
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "max-age" {
+				// Kept with its argument so callers can tell max-age=0 apart.
+				name += "=" + strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+			directives = append(directives, name)
+		}
+	}
+	return directives
+}
+
+func dropLegacyPragma(h http.Header) {
+	/* Removes Pragma from stored headers that also carry Cache-Control. The entry was stored under Cache-Control,
+	so a leftover Pragma: no-cache would only tell HTTP/1.0 clients and caches the opposite on every hit.*/
+	if len(h.Values("Cache-Control")) > 0 {
+		h.Del("Pragma")
+	}
+}
+
+func heuristicTTL(h http.Header, maxTTL time.Duration, now time.Time) (time.Duration, bool) {
+	/*
+		Computes a heuristic freshness lifetime for a response that carries no explicit one (RFC 7234, section 4.2.2):
+		10% of the time between Last-Modified and the response Date (or now), capped at maxTTL.
+		Returns false when the response has max-age, s-maxage or Expires, or no usable Last-Modified.
+	*/
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") || strings.EqualFold(name, "s-maxage") {
+			return 0, false
+		}
+	}
+	if h.Get("Expires") != "" {
+		return 0, false
+	}
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return 0, false
+	}
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = now
+	}
+	age := date.Sub(lastModified)
+	if age <= 0 {
+		return 0, false
+	}
+	ttl := age / heuristicFraction
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl, true
+}
+
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	// Parses a Retry-After header given either as delay-seconds or as an HTTP-date; false when absent, invalid or already past.
+	value := strings.TrimSpace(h.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := at.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, false
+}
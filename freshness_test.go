@@ -0,0 +1,303 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeuristicTTL(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	stamp := func(d time.Duration) string { return now.Add(-d).Format(http.TimeFormat) }
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"10% of the age", http.Header{"Last-Modified": {stamp(10 * time.Hour)}}, time.Hour, true},
+		{"measured from Date", http.Header{"Last-Modified": {stamp(10 * time.Hour)}, "Date": {stamp(5 * time.Hour)}}, 30 * time.Minute, true},
+		{"capped", http.Header{"Last-Modified": {stamp(90 * 24 * time.Hour)}}, 24 * time.Hour, true},
+		{"max-age wins", http.Header{"Last-Modified": {stamp(10 * time.Hour)}, "Cache-Control": {"public, max-age=60"}}, 0, false},
+		{"s-maxage wins", http.Header{"Last-Modified": {stamp(10 * time.Hour)}, "Cache-Control": {"S-Maxage=60"}}, 0, false},
+		{"Expires wins", http.Header{"Last-Modified": {stamp(10 * time.Hour)}, "Expires": {stamp(-time.Hour)}}, 0, false},
+		{"no Last-Modified", http.Header{}, 0, false},
+		{"unparsable Last-Modified", http.Header{"Last-Modified": {"yesterday"}}, 0, false},
+		{"Last-Modified in the future", http.Header{"Last-Modified": {stamp(-time.Hour)}}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := heuristicTTL(tt.header, 24*time.Hour, now)
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("heuristicTTL = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHeuristicCachingSetsEntryTTL(t *testing.T) {
+	lastModified := time.Now().Add(-20 * time.Hour).UTC().Format(http.TimeFormat)
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("ok"))
+	})
+	p.heuristicCaching, p.heuristicMaxTTL = true, 24*time.Hour
+	get(p, "/page")
+	p.cache.store.Range(func(key string, entry CacheEntry) bool {
+		if entry.TTL < 119*time.Minute || entry.TTL > 121*time.Minute {
+			t.Errorf("entry TTL = %v, want about 2h, 10%% of the time since Last-Modified", entry.TTL)
+		}
+		return true
+	})
+	if entryCount(p.cache) != 1 {
+		t.Fatal("response not cached")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := retryAfter(http.Header{"Retry-After": {tt.value}}, now); got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfterCachesTheUnavailableAnswer(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	})
+	p.cacheRetryAfter = true
+	clock := newFakeClock(p.cache)
+
+	for range 5 {
+		if rec := get(p, "/busy"); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want 503", rec.Code)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("origin contacted %d times within the Retry-After window, want once", n)
+	}
+	clock.advance(31 * time.Second)
+	get(p, "/busy")
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("origin contacted %d times, want again once the window passed", n)
+	}
+
+	p.cacheRetryAfter = false
+	get(p, "/other")
+	get(p, "/other")
+	if n := fetches.Load(); n != 4 {
+		t.Fatalf("with the flag off, 503s were cached (%d fetches)", n)
+	}
+}
+
+func TestForbidsCaching(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{"Cache-Control": {"no-store"}}, true},
+		{http.Header{"Cache-Control": {"public, No-Store"}}, true},
+		{http.Header{"Cache-Control": {"max-age=60", "private"}}, true},
+		{http.Header{"Cache-Control": {`private="Set-Cookie", max-age=60`}}, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, true},
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, false},
+		{http.Header{"Cache-Control": {"no-transform"}}, false},
+		{http.Header{}, false},
+	}
+	for _, tt := range tests {
+		if got := forbidsCaching(tt.header); got != tt.want {
+			t.Errorf("forbidsCaching(%q) = %v, want %v", tt.header["Cache-Control"], got, tt.want)
+		}
+	}
+}
+
+func TestOnlyCacheableResponsesAreStored(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		w.Write([]byte("ok"))
+	})
+	for _, cc := range []string{"no-store", "private,%20max-age=60", "NO-CACHE"} {
+		get(p, "/page?cc="+cc)
+		if rec := get(p, "/page?cc="+cc); rec.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("Cache-Control %s: second request was a %s, want a MISS", cc, rec.Header().Get("X-Cache"))
+		}
+	}
+	get(p, "/page?cc=max-age=60")
+	if rec := get(p, "/page?cc=max-age=60"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Error("a normal response was not cached")
+	}
+	if n := entryCount(p.cache); n != 1 {
+		t.Fatalf("cache holds %d entries, want only the normal response", n)
+	}
+}
+
+func TestContentTypeTTLs(t *testing.T) {
+	ttls, err := parseContentTypeTTLs("image/*=24h, text/html=1m, text/*=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte("ok"))
+	})
+	p.contentTypeTTLs = ttls
+	p.defaultTTL = 5 * time.Minute
+
+	want := map[string]time.Duration{
+		"image/png":                24 * time.Hour,
+		"text/html; charset=utf-8": time.Minute,
+		"text/css":                 10 * time.Minute,
+		"application/json":         5 * time.Minute,
+	}
+	for contentType := range want {
+		get(p, "/asset?type="+url.QueryEscape(contentType))
+	}
+	p.cache.store.Range(func(key string, entry CacheEntry) bool {
+		contentType := entry.Headers.Get("Content-Type")
+		if entry.TTL != want[contentType] {
+			t.Errorf("%s stored for %v, want %v", contentType, entry.TTL, want[contentType])
+		}
+		return true
+	})
+	if n := entryCount(p.cache); n != len(want) {
+		t.Fatalf("%d entries, want %d", n, len(want))
+	}
+}
+
+func TestParseContentTypeTTLsRejectsInvalidPairs(t *testing.T) {
+	for _, list := range []string{"image/*", "image/*=soon", "=1h", "image/*=-1h", "image/*=0s"} {
+		if _, err := parseContentTypeTTLs(list); err == nil {
+			t.Errorf("parseContentTypeTTLs(%q) accepted", list)
+		}
+	}
+}
+
+func TestPathTTLsLongestMatchWins(t *testing.T) {
+	var rules pathTTLs
+	for _, rule := range []string{"/static/=1h", "/static/fonts/=24h", "/api/=10s", "/api/*/search=1s"} {
+		if err := rules.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	p.pathTTLs = rules
+	p.defaultTTL = 5 * time.Minute
+
+	want := map[string]time.Duration{
+		"/static/app.js":        time.Hour,
+		"/static/fonts/a.woff2": 24 * time.Hour,
+		"/api/users":            10 * time.Second,
+		"/api/users/search":     time.Second,
+		"/index.html":           5 * time.Minute,
+	}
+	for path := range want {
+		get(p, path)
+	}
+	p.cache.store.Range(func(key string, entry CacheEntry) bool {
+		if entry.TTL != want[entry.Path] {
+			t.Errorf("%s stored for %v, want %v", entry.Path, entry.TTL, want[entry.Path])
+		}
+		return true
+	})
+	if n := entryCount(p.cache); n != len(want) {
+		t.Fatalf("%d entries, want %d", n, len(want))
+	}
+}
+
+func TestPathTTLRejectsInvalidRules(t *testing.T) {
+	var rules pathTTLs
+	for _, rule := range []string{"/static/", "static/=1h", "/static/=soon", "/static/=0s", "/static/=-1h"} {
+		if err := rules.Set(rule); err == nil {
+			t.Errorf("ttl-rule %q accepted", rule)
+		}
+	}
+	if len(rules) != 0 {
+		t.Fatalf("rejected rules were kept: %v", rules.String())
+	}
+}
+
+func TestClientNoCache(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Pragma": {"no-cache"}}, true},
+		{http.Header{"Pragma": {"x-custom, No-Cache"}}, true},
+		{http.Header{"Cache-Control": {"no-cache"}}, true},
+		{http.Header{"Cache-Control": {"max-age=0"}}, true},
+		{http.Header{"Cache-Control": {"max-age=60"}}, false},
+		// Cache-Control, when present, wins over the legacy header.
+		{http.Header{"Cache-Control": {"max-age=60"}, "Pragma": {"no-cache"}}, false},
+	}
+	for _, tt := range tests {
+		if got := clientNoCache(tt.header); got != tt.want {
+			t.Errorf("clientNoCache(%v) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestPragmaNoCacheRequestSkipsTheHit(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("body"))
+	})
+	pragma := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("Pragma", "no-cache")
+		return do(p, r)
+	}
+	get(p, "/page")
+	if rec := pragma(); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("without honor-client-no-cache: %s, want a HIT", rec.Header().Get("X-Cache"))
+	}
+	p.honorNoCache = true
+	if rec := pragma(); rec.Header().Get("X-Cache") != "MISS" || fetches.Load() != 2 {
+		t.Fatalf("Pragma: no-cache = %s after %d fetches, want a refetching MISS", rec.Header().Get("X-Cache"), fetches.Load())
+	}
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("after the reload = %s, want the refetched entry stored", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestLegacyPragmaInResponses(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/both" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Header().Set("Pragma", "no-cache")
+		w.Write([]byte("body"))
+	})
+	get(p, "/both")
+	if rec := get(p, "/both"); rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Pragma") != "" {
+		t.Fatalf("hit = %s with Pragma %q, want a HIT without the conflicting Pragma", rec.Header().Get("X-Cache"), rec.Header().Get("Pragma"))
+	}
+	get(p, "/pragma-only")
+	if rec := get(p, "/pragma-only"); rec.Header().Get("X-Cache") == "HIT" {
+		t.Fatal("a response with only Pragma: no-cache was cached")
+	}
+}
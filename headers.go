@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"} // Always redacted when headers are logged.
+
+var hopByHopHeaders = []string{ // Headers describing one connection (RFC 7230, section 6.1), never forwarded or cached.
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func redactHeaders(h http.Header, extra []string) http.Header {
+	/* Returns a copy of h safe for logging: values of sensitiveHeaders and of the extra names are replaced
+	with a placeholder. Every place that logs headers goes through here so credentials never reach the logs.*/
+	redacted := h.Clone()
+	for _, list := range [][]string{sensitiveHeaders, extra} {
+		for _, name := range list {
+			name = http.CanonicalHeaderKey(name)
+			if values, found := redacted[name]; found {
+				redacted[name] = make([]string, len(values))
+				for i := range values {
+					redacted[name][i] = "[REDACTED]"
+				}
+			}
+		}
+	}
+	return redacted
+}
+
+func sensitiveHeader(name string, extra []string) bool {
+	// Reports whether values of the header name must not be logged: it is one of sensitiveHeaders or of extra.
+	for _, list := range [][]string{sensitiveHeaders, extra} {
+		for _, sensitive := range list {
+			if strings.EqualFold(name, sensitive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func removeHopByHop(h http.Header) {
+	/* Deletes hop-by-hop headers in place: the standard set and every header the Connection header names.
+	They only apply between two neighbouring hops, so they are dropped from requests before they go upstream
+	and from upstream responses before they are cached or served.*/
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+func setForwardedHeaders(h http.Header, r *http.Request) {
+	/* Tells the upstream who asked: the client's IP is appended to any X-Forwarded-For chain the request arrived with,
+	while X-Forwarded-Proto and X-Forwarded-Host are set from this hop, replacing whatever the client claimed.*/
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		h.Set("X-Forwarded-For", ip)
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	if r.Host != "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+func sanitizeHeaders(h http.Header) bool {
+	/*
+		Cleans upstream response headers in place before they are cached or served.
+		Headers with names that aren't valid tokens are dropped, and control characters (CR, LF, NUL, ...) are
+		stripped from values, so a misbehaving origin can't split the response or smuggle extra headers to clients.
+		Reports whether anything had to be changed.
+	*/
+	changed := false
+	for name, values := range h {
+		if !validHeaderName(name) {
+			delete(h, name)
+			changed = true
+			continue
+		}
+		for i, v := range values {
+			if clean := stripControlChars(v); clean != v {
+				values[i] = clean
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func validHeaderName(name string) bool {
+	// Reports whether name is a non-empty RFC 7230 token.
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func stripControlChars(v string) string {
+	// Removes ASCII control characters other than horizontal tab from a header value.
+	if strings.IndexFunc(v, isHeaderControl) < 0 {
+		return v
+	}
+	return strings.Map(func(r rune) rune {
+		if isHeaderControl(r) {
+			return -1
+		}
+		return r
+	}, v)
+}
+
+func isHeaderControl(r rune) bool {
+	// Reports whether r is a control character that must not appear in a header value.
+	return (r < ' ' && r != '\t') || r == 0x7f
+}
+
+func applyHeaderCase(h http.Header, names []string) {
+	/* Renames headers to the exact casing given in names, e.g. "X-API-Key" instead of the canonical "X-Api-Key".
+	Go canonicalizes header names when parsing the upstream response, so the origin's casing is gone by then;
+	the server writes map keys verbatim, so re-keying just before the response is written restores it.
+	Lookups through Get and Set no longer find renamed headers, so this must be the last change to h.*/
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(name)
+		if values, found := h[canonical]; found && canonical != name {
+			delete(h, canonical)
+			h[name] = values
+		}
+	}
+}
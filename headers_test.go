@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeHeaders(t *testing.T) {
+	h := http.Header{
+		"X-Split":   {"a\r\nSet-Cookie: stolen=1"},
+		"X-Nul":     {"a\x00b"},
+		"X-Tab":     {"a\tb"},
+		"Bad Name":  {"x"},
+		"X:Colon":   {"x"},
+		"X-Fine":    {"ok"},
+		"X-Del\x7f": {"x"},
+	}
+	if !sanitizeHeaders(h) {
+		t.Fatal("sanitizeHeaders reported nothing changed")
+	}
+	want := http.Header{"X-Split": {"aSet-Cookie: stolen=1"}, "X-Nul": {"ab"}, "X-Tab": {"a\tb"}, "X-Fine": {"ok"}}
+	if len(h) != len(want) {
+		t.Fatalf("headers left: %q, want %q", h, want)
+	}
+	for name, values := range want {
+		if got := h[name]; len(got) != 1 || got[0] != values[0] {
+			t.Errorf("%s = %q, want %q", name, got, values)
+		}
+	}
+	if sanitizeHeaders(http.Header{"X-Fine": {"ok"}}) {
+		t.Error("clean headers reported as changed")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error) //An http.RoundTripper answering with a function, for responses no real server can send.
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Calls f.
+	return f(r)
+}
+
+func TestMalformedUpstreamHeadersAreNotReflected(t *testing.T) {
+	/* Go's client already refuses responses with control characters in headers, so the malformed header is
+	injected below it, as it could arrive from another transport.*/
+	p := newTestProxy(t, http.NotFound)
+	p.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Evil": {"a\r\nSet-Cookie: stolen=1"}, "Bad Name": {"x"}},
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Request:    r,
+		}, nil
+	})}
+
+	for _, cache := range []string{"MISS", "HIT"} {
+		rec := get(p, "/page")
+		if rec.Header().Get("X-Cache") != cache || rec.Body.String() != "ok" {
+			t.Fatalf("got %s %q, want a %s", rec.Header().Get("X-Cache"), rec.Body.String(), cache)
+		}
+		if got := rec.Header().Get("X-Evil"); got != "aSet-Cookie: stolen=1" {
+			t.Fatalf("%s: X-Evil = %q, want the control characters stripped", cache, got)
+		}
+		if rec.Header().Get("Set-Cookie") != "" || rec.Header()["Bad Name"] != nil {
+			t.Fatalf("%s: malformed headers reached the client: %q", cache, rec.Header())
+		}
+	}
+}
+
+func TestLoggedHeadersAreRedacted(t *testing.T) {
+	logs := captureLog(t)
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=upstream-secret")
+		w.Header().Set("X-Request-Id", "visible-id")
+		w.Write([]byte("ok"))
+	})
+	p.logHeaders = true
+	p.redactHeaders = []string{"x-api-key"}
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("Authorization", "Bearer client-secret")
+	r.Header.Set("Cookie", "session=cookie-secret")
+	r.Header.Set("X-Api-Key", "key-secret")
+	r.Header.Set("Accept", "text/html")
+	do(p, r)
+
+	out := logs.String()
+	for _, secret := range []string{"client-secret", "cookie-secret", "key-secret", "upstream-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%s was logged:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "[REDACTED]") || !strings.Contains(out, "text/html") || !strings.Contains(out, "visible-id") {
+		t.Errorf("headers not logged, or logged without the redaction placeholder:\n%s", out)
+	}
+	if r.Header.Get("Authorization") != "Bearer client-secret" {
+		t.Error("redaction modified the request headers")
+	}
+}
+
+func TestHeaderCaseIsPreserved(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-API-Key", "secret")
+		w.Header().Set("X-Other-ID", "1")
+		w.Write([]byte("body"))
+	})
+	p.headerCase = []string{"X-API-Key"}
+	srv := serveTest(t, http.HandlerFunc(p.handleProxy))
+	for _, want := range []string{"MISS", "HIT"} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "GET /page HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n")
+		raw, _ := io.ReadAll(conn)
+		conn.Close()
+		head := string(raw)
+		if !strings.Contains(head, "\r\nX-API-Key: secret\r\n") || !strings.Contains(head, "\r\nX-Cache: "+want+"\r\n") {
+			t.Fatalf("%s response lost the configured casing:\n%s", want, head)
+		}
+		if !strings.Contains(head, "\r\nX-Other-Id: 1\r\n") {
+			t.Fatalf("unlisted header not canonical:\n%s", head)
+		}
+	}
+}
+
+func TestHopByHopHeadersAreDropped(t *testing.T) {
+	var upstreamSaw http.Header
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamSaw = r.Header.Clone()
+		w.Header().Set("Connection", "X-Resp-Hop")
+		w.Header().Set("X-Resp-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Fine", "1")
+		w.Write([]byte("body"))
+	})
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("Connection", "X-Custom, keep-alive")
+	r.Header.Set("X-Custom", "secret")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Proxy-Authorization", "Basic abc")
+	r.Header.Set("Te", "trailers")
+	r.Header.Set("X-Keep", "1")
+	miss := do(p, r)
+
+	for _, name := range []string{"X-Custom", "Keep-Alive", "Proxy-Authorization", "Te"} {
+		if upstreamSaw.Get(name) != "" {
+			t.Errorf("upstream received hop-by-hop %s", name)
+		}
+	}
+	if upstreamSaw.Get("X-Keep") != "1" {
+		t.Error("an end-to-end request header was dropped")
+	}
+	hit := get(p, "/page")
+	for label, rec := range map[string]*httptest.ResponseRecorder{"miss": miss, "hit": hit} {
+		for _, name := range []string{"X-Resp-Hop", "Proxy-Authenticate", "Connection"} {
+			if rec.Header().Get(name) != "" {
+				t.Errorf("%s carries hop-by-hop %s", label, name)
+			}
+		}
+		if rec.Header().Get("X-Fine") != "1" {
+			t.Errorf("%s lost an end-to-end response header", label)
+		}
+	}
+}
+
+func TestRemoveHopByHop(t *testing.T) {
+	h := http.Header{
+		"Connection":        {"x-a, X-B", "X-C"},
+		"X-A":               {"1"},
+		"X-B":               {"1"},
+		"X-C":               {"1"},
+		"Upgrade":           {"websocket"},
+		"Transfer-Encoding": {"chunked"},
+		"X-End":             {"1"},
+	}
+	removeHopByHop(h)
+	if len(h) != 1 || h.Get("X-End") != "1" {
+		t.Fatalf("left %v, want only X-End", h)
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		var saw http.Header
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			saw = r.Header.Clone()
+			w.Header().Set("Cache-Control", "no-store")
+		})
+		p.forwardedHeaders = enabled
+		send := func(prior string) {
+			r := httptest.NewRequest(http.MethodGet, "/page", nil)
+			r.RemoteAddr = "203.0.113.7:51234"
+			r.Host = "shop.example"
+			r.Header.Set("X-Forwarded-Proto", "https") // Claimed by the client, so it must be replaced.
+			if prior != "" {
+				r.Header.Set("X-Forwarded-For", prior)
+			}
+			do(p, r)
+		}
+
+		send("")
+		if !enabled {
+			if saw.Get("X-Forwarded-For") != "" || saw.Get("X-Forwarded-Host") != "" {
+				t.Fatalf("forwarded-headers off, upstream saw %v", saw)
+			}
+			continue
+		}
+		if saw.Get("X-Forwarded-For") != "203.0.113.7" || saw.Get("X-Forwarded-Proto") != "http" || saw.Get("X-Forwarded-Host") != "shop.example" {
+			t.Fatalf("upstream saw For %q, Proto %q, Host %q", saw.Get("X-Forwarded-For"), saw.Get("X-Forwarded-Proto"), saw.Get("X-Forwarded-Host"))
+		}
+		send("198.51.100.1, 198.51.100.2")
+		if got := saw.Values("X-Forwarded-For"); len(got) != 1 || got[0] != "198.51.100.1, 198.51.100.2, 203.0.113.7" {
+			t.Fatalf("X-Forwarded-For = %q, want the existing chain extended", got)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func postKey(mode, target, body string) string {
+	// Returns the cache key of a POST of body to target with PostKey set to mode.
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	bufferRequestBody(r)
+	return generateCacheKey(r, KeyOptions{PostKey: mode})
+}
+
+func TestPostKeyModes(t *testing.T) {
+	tests := []struct {
+		mode         string
+		queryDiffers bool // Whether /graphql?op=a and /graphql?op=b get different keys for the same body.
+		bodyDiffers  bool // Whether two bodies to the same URL get different keys.
+	}{
+		{"query", true, false},
+		{"body", false, true},
+		{"both", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if differs := postKey(tt.mode, "/graphql?op=a", "{}") != postKey(tt.mode, "/graphql?op=b", "{}"); differs != tt.queryDiffers {
+				t.Errorf("keys of two queries differ = %v, want %v", differs, tt.queryDiffers)
+			}
+			if differs := postKey(tt.mode, "/graphql", `{"query":"a"}`) != postKey(tt.mode, "/graphql", `{"query":"b"}`); differs != tt.bodyDiffers {
+				t.Errorf("keys of two bodies differ = %v, want %v", differs, tt.bodyDiffers)
+			}
+			if postKey(tt.mode, "/graphql?op=a", "{}") != postKey(tt.mode, "/graphql?op=a", "{}") {
+				t.Error("the same request got two keys")
+			}
+			if postKey(tt.mode, "/graphql", "{}") == postKey(tt.mode, "/other", "{}") {
+				t.Error("two paths share a key")
+			}
+		})
+	}
+}
+
+func TestPostKeyedByBodyStillForwardsTheBody(t *testing.T) {
+	var received []string
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.Write(body)
+	})
+	p.keyOptions.PostKey = "body"
+	p.cacheableMethods = map[string]bool{http.MethodGet: true, http.MethodPost: true}
+	post := func(body string) *httptest.ResponseRecorder {
+		return do(p, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body)))
+	}
+
+	post(`{"query":"a"}`)
+	post(`{"query":"b"}`)
+	if rec := post(`{"query":"a"}`); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != `{"query":"a"}` {
+		t.Fatalf("repeated POST = %q %s, want a HIT with its own answer", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if len(received) != 2 || received[0] != `{"query":"a"}` || received[1] != `{"query":"b"}` {
+		t.Fatalf("upstream received %q, want both bodies once", received)
+	}
+}
+
+func TestCollapseSlashes(t *testing.T) {
+	for in, want := range map[string]string{"/a/b": "/a/b", "/a//b": "/a/b", "//a///b//": "/a/b/", "/": "/", "": ""} {
+		if got := collapseSlashes(in); got != want {
+			t.Errorf("collapseSlashes(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCollapseSlashesModes(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		var paths, queries []string
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			queries = append(queries, r.URL.RawQuery)
+			w.Write([]byte("ok"))
+		})
+		p.keyOptions.CollapseSlashes = true
+		p.collapseForward = forward
+
+		get(p, "/a//b?next=http://x//y")
+		if rec := get(p, "/a/b?next=http://x//y"); rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("forward %v: /a/b missed after /a//b was cached", forward)
+		}
+		if rec := get(p, "/a/b?next=http://x/y"); rec.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("forward %v: slashes in the query were collapsed in the key", forward)
+		}
+		want := "/a//b"
+		if forward {
+			want = "/a/b"
+		}
+		if paths[0] != want || queries[0] != "next=http://x//y" {
+			t.Fatalf("forward %v: upstream got %s?%s, want %s?next=http://x//y", forward, paths[0], queries[0], want)
+		}
+	}
+}
+
+func TestDeviceClass(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148":       "mobile",
+		"Mozilla/5.0 (Linux; Android 14; Pixel 8) Chrome/120.0 Mobile Safari/537.36": "mobile",
+		"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X)":                              "tablet",
+		"Mozilla/5.0 (Linux; Android 13; SM-X700) Chrome/120.0 Safari/537.36":        "tablet",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0 Safari/537.36":       "desktop",
+		"":                                  "desktop",
+		strings.Repeat("x", 600) + "iPhone": "desktop",
+	}
+	for ua, want := range tests {
+		if got := deviceClass(ua); got != want {
+			t.Errorf("deviceClass(%.50q) = %s, want %s", ua, got, want)
+		}
+	}
+}
+
+func TestDeviceClassSeparatesEntries(t *testing.T) {
+	var fetches []string
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches = append(fetches, r.UserAgent())
+		w.Write([]byte(deviceClass(r.UserAgent())))
+	})
+	p.keyOptions.DeviceClass = true
+	fetch := func(ua string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/home", nil)
+		r.Header.Set("User-Agent", ua)
+		return do(p, r)
+	}
+
+	fetch("Mozilla/5.0 (iPhone) Mobile")
+	if rec := fetch("Mozilla/5.0 (Windows NT 10.0)"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "desktop" {
+		t.Fatalf("desktop after mobile = %s %q, want its own MISS", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := fetch("Mozilla/5.0 (Linux; Android 14) Mobile"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "mobile" {
+		t.Fatalf("second mobile client = %s %q, want the mobile entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if len(fetches) != 2 {
+		t.Fatalf("upstream fetches = %d, want one per device class", len(fetches))
+	}
+}
+
+func TestAuthPartition(t *testing.T) {
+	opts := KeyOptions{AuthPartition: true, AuthHeaders: []string{"Authorization"}, AuthCookies: []string{"session"}}
+	key := func(auth, cookie string) string {
+		r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "session", Value: cookie})
+		}
+		return generateCacheKey(r, opts)
+	}
+
+	anonymous := key("", "")
+	other := httptest.NewRequest(http.MethodGet, "/feed", nil)
+	other.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	if generateCacheKey(other, opts) != anonymous {
+		t.Fatal("anonymous requests got different keys")
+	}
+	alice, bob := key("Bearer alice", ""), key("Bearer bob", "")
+	if alice == anonymous || bob == anonymous || alice == bob {
+		t.Fatal("authenticated requests share a key with each other or with anonymous ones")
+	}
+	if key("Bearer alice", "") != alice {
+		t.Fatal("the same user got two keys")
+	}
+	if s := key("", "s1"); s == anonymous || s == key("", "s2") || s != key("", "s1") {
+		t.Fatal("session cookies are not partitioned per session")
+	}
+}
+
+func TestKeyIgnoresSchemeAndHostCase(t *testing.T) {
+	key := func(target, host string, opts KeyOptions) string {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Host = host
+		return generateCacheKey(r, opts)
+	}
+	absolute := key("http://example.com/x", "example.com", KeyOptions{})
+	if key("HTTP://Example.COM/x", "example.com", KeyOptions{}) != absolute {
+		t.Error("mixed-case scheme and host got their own key")
+	}
+	if key("http://example.com/X", "example.com", KeyOptions{}) == absolute {
+		t.Error("path case was ignored")
+	}
+	withHost := KeyOptions{Host: true}
+	if key("/x", "Example.COM", withHost) != key("/x", "example.com", withHost) {
+		t.Error("mixed-case Host header got its own key")
+	}
+	if key("/x", "example.com", withHost) == key("/x", "example.org", withHost) {
+		t.Error("two hosts share a key")
+	}
+}
+
+func TestSegmentPatternTemplatesKeys(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(r.URL.Path)) })
+	p.keyOptions.SegmentPattern = regexp.MustCompile(`^[0-9]+$`)
+
+	get(p, "/users/42/profile")
+	rec := get(p, "/users/7/profile")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "/users/42/profile" {
+		t.Fatalf("/users/7/profile = %s %q, want the shared templated entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := get(p, "/users/alice/profile"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "/users/alice/profile" {
+		t.Fatalf("non-matching segment = %s %q, want its own entry forwarded verbatim", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if got := templatePath("/users/42/posts/7", p.keyOptions.SegmentPattern); got != "/users/{}/posts/{}" {
+		t.Fatalf("templatePath = %q", got)
+	}
+}
+
+func TestPreserveHostKeysByHost(t *testing.T) {
+	for _, preserve := range []bool{true, false} {
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(r.Host)) })
+		// As main configures it: the Host joins the key exactly when it is forwarded.
+		p.preserveHost, p.keyOptions.Host = preserve, preserve
+		fetch := func(host string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = host
+			return do(p, r)
+		}
+
+		first := fetch("a.example")
+		second := fetch("b.example")
+		if preserve {
+			if first.Body.String() != "a.example" || second.Body.String() != "b.example" || second.Header().Get("X-Cache") != "MISS" {
+				t.Fatalf("preserve-host: got %q then %s %q, want each host's own response", first.Body.String(), second.Header().Get("X-Cache"), second.Body.String())
+			}
+		} else if second.Header().Get("X-Cache") != "HIT" || second.Body.String() != first.Body.String() {
+			t.Fatalf("without preserve-host: second host got %s %q, want the shared entry", second.Header().Get("X-Cache"), second.Body.String())
+		}
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data of " + r.Header.Get("X-Tenant-Id")))
+	})
+	p.keyOptions.TenantHeader = "X-Tenant-Id"
+	fetch := func(tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/reports", nil)
+		r.Header.Set("X-Tenant-Id", tenant)
+		return do(p, r)
+	}
+	fetch("acme")
+	if rec := fetch("globex"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "data of globex" {
+		t.Fatalf("second tenant got %s %q, want its own entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := fetch("acme"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "data of acme" {
+		t.Fatalf("first tenant again got %s %q, want its cached entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestTenantFromPathSegment(t *testing.T) {
+	opts := KeyOptions{TenantSegment: 1, SegmentPattern: regexp.MustCompile(`^[a-z]+$`)}
+	key := func(target string) string {
+		return generateCacheKey(httptest.NewRequest(http.MethodGet, target, nil), opts)
+	}
+	// Templating would turn both paths into /{}/reports; the tenant still keeps them apart.
+	if key("/acme/reports") == key("/globex/reports") {
+		t.Fatal("two tenants share a key")
+	}
+	if got := tenantID(httptest.NewRequest(http.MethodGet, "/acme", nil), KeyOptions{TenantSegment: 3}); got != "" {
+		t.Fatalf("tenant of a too short path = %q", got)
+	}
+}
+
+func TestParseTenantKey(t *testing.T) {
+	tests := []struct {
+		value   string
+		header  string
+		segment int
+		ok      bool
+	}{
+		{"", "", 0, true},
+		{"header:x-tenant-id", "X-Tenant-Id", 0, true},
+		{"path:2", "", 2, true},
+		{"path:0", "", 0, false},
+		{"path:x", "", 0, false},
+		{"header:", "", 0, false},
+		{"cookie:tenant", "", 0, false},
+	}
+	for _, tt := range tests {
+		header, segment, err := parseTenantKey(tt.value)
+		if (err == nil) != tt.ok || header != tt.header || segment != tt.segment {
+			t.Errorf("parseTenantKey(%q) = %q, %d, %v", tt.value, header, segment, err)
+		}
+	}
+}
+
+func TestOmitMethodKeepsGetAndHeadBehaviour(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("full body"))
+	})
+	p.keyOptions.OmitMethod = true
+	head := func() *httptest.ResponseRecorder { return do(p, httptest.NewRequest(http.MethodHead, "/page", nil)) }
+
+	// A HEAD first must not leave an empty entry behind for the GET.
+	if rec := head(); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("HEAD = %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "full body" {
+		t.Fatalf("GET after HEAD = %s %q, want a full MISS", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "full body" {
+		t.Fatalf("second GET = %s %q, want a HIT", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := head(); rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Content-Length") != "9" {
+		t.Fatalf("HEAD after GET = %s, Content-Length %q, want a HIT from the GET entry", rec.Header().Get("X-Cache"), rec.Header().Get("Content-Length"))
+	}
+}
+
+func TestOnlySafeMethods(t *testing.T) {
+	if !onlySafeMethods(parseMethods("GET, head")) {
+		t.Fatal("GET and HEAD reported as unsafe")
+	}
+	if onlySafeMethods(parseMethods("GET,HEAD,POST")) {
+		t.Fatal("POST reported as safe")
+	}
+}
+
+func TestKeyHeaders(t *testing.T) {
+	names, err := parseKeyHeaders("accept-language, Authorization,Accept-Language")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "Accept-Language,Authorization" {
+		t.Fatalf("parsed names = %v, want them canonical, sorted and deduplicated", names)
+	}
+	opts := KeyOptions{Headers: names}
+	key := func(headers map[string]string) string {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		return generateCacheKey(r, opts)
+	}
+
+	if key(map[string]string{"Accept-Language": "en"}) == key(map[string]string{"Accept-Language": "de"}) {
+		t.Error("requests differing in a key header share a key")
+	}
+	if key(map[string]string{"Authorization": "Bearer a"}) == key(map[string]string{"Authorization": "Bearer b"}) {
+		t.Error("requests differing in Authorization share a key")
+	}
+	if key(map[string]string{"User-Agent": "a"}) != key(map[string]string{"User-Agent": "b"}) {
+		t.Error("requests differing only in an unlisted header got different keys")
+	}
+	if key(nil) != key(nil) || key(nil) == key(map[string]string{"Accept-Language": "en"}) {
+		t.Error("an absent key header is not keyed consistently as empty")
+	}
+	if _, err := parseKeyHeaders("Accept-Language, Bad Name"); err == nil {
+		t.Error("an invalid header name was accepted")
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := map[string]string{
+		"b=2&a=1":       "a=1&b=2",
+		"a=2&b=1&a=1":   "a=1&a=2&b=1",
+		"a&b=&&c=3":     "a=&b=&c=3",
+		"":              "",
+		"x=%20&x=%2F&y": "x=%20&x=%2F&y=",
+	}
+	for query, want := range tests {
+		if got := normalizeQuery(query); got != want {
+			t.Errorf("normalizeQuery(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestNormalizedQueriesShareAnEntry(t *testing.T) {
+	for _, normalize := range []bool{true, false} {
+		var seen []string
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			seen = append(seen, r.URL.RawQuery)
+			w.Write([]byte("body"))
+		})
+		p.keyOptions.NormalizeQuery = normalize
+		get(p, "/search?a=1&b=2")
+		rec := get(p, "/search?b=2&a=1")
+		want := "MISS"
+		if normalize {
+			want = "HIT"
+		}
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Fatalf("normalize-query=%v: reordered query = %s, want %s", normalize, got, want)
+		}
+		if seen[0] != "a=1&b=2" || (!normalize && seen[1] != "b=2&a=1") {
+			t.Fatalf("normalize-query=%v: upstream saw %q, want the queries as sent", normalize, seen)
+		}
+	}
+}
+
+func TestDebugKeysLogsRedactedInput(t *testing.T) {
+	logs := captureLog(t)
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	})
+	p.debugKeys = true
+	p.redactHeaders = []string{"X-Tenant-Token"}
+	p.keyOptions = KeyOptions{NormalizeQuery: true, Headers: []string{"Accept-Language", "Authorization", "X-Tenant-Token"}}
+	r := httptest.NewRequest(http.MethodGet, "/search?b=2&a=1", nil)
+	r.Header.Set("Accept-Language", "en")
+	r.Header.Set("Authorization", "Bearer secret-token")
+	r.Header.Set("X-Tenant-Token", "tenant-secret")
+	do(p, r)
+
+	out := logs.String()
+	key := generateCacheKey(r, p.keyOptions)
+	if !strings.Contains(out, "Cache key "+key+" for GET /search") {
+		t.Fatalf("log lacks the key %s:\n%s", key, out)
+	}
+	for _, want := range []string{"/search?a=1&b=2", "header:Accept-Language=en", "header:Authorization=[REDACTED]", "header:X-Tenant-Token=[REDACTED]"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("logged input lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "secret") {
+		t.Fatalf("a credential was logged:\n%s", out)
+	}
+
+	// The description follows the keying options: without normalization the query keeps its order.
+	if input := describeKeyInput(r, KeyOptions{OmitMethod: true}, nil); input != "/search?b=2&a=1" {
+		t.Fatalf("described input = %q, want the URL alone", input)
+	}
+}
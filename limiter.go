@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type upstreamLimiter struct { //Bounds concurrent upstream fetches, more tightly during the warmup period after startup.
+	slots       chan struct{} //slots: Normal concurrency limit, nil for unlimited.
+	warmupSlots chan struct{} //warmupSlots: Tighter limit applied until warmupUntil, nil when there is no warmup.
+	warmupUntil time.Time     //warmupUntil: End of the warmup period.
+}
+
+func newUpstreamLimiter(limit, warmupLimit int, warmupPeriod time.Duration) *upstreamLimiter {
+	/* Creates a limiter allowing limit concurrent fetches (0 for unlimited),
+	and at most warmupLimit of them during the first warmupPeriod after startup.*/
+	l := &upstreamLimiter{}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	if warmupLimit > 0 && warmupPeriod > 0 {
+		l.warmupSlots = make(chan struct{}, warmupLimit)
+		l.warmupUntil = time.Now().Add(warmupPeriod)
+	}
+	return l
+}
+
+func (l *upstreamLimiter) acquire(ctx context.Context) (func(), error) {
+	/* Waits for a free upstream slot and returns a function releasing it.
+	While warming up a fetch needs a warmup slot as well as a normal one, so the tighter of the two limits applies.
+	Gives up with the context's error if the request is cancelled while waiting.*/
+	var held []chan struct{}
+	release := func() {
+		for _, slots := range held {
+			<-slots
+		}
+	}
+	if l.warmupSlots != nil && time.Now().Before(l.warmupUntil) {
+		select {
+		case l.warmupSlots <- struct{}{}:
+			held = append(held, l.warmupSlots)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			held = append(held, l.slots)
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func peakConcurrency(l *upstreamLimiter, fetches int) int32 {
+	// Runs fetches concurrent acquire/release pairs through l, each holding its slot briefly, and returns how many overlapped at most.
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for range fetches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.acquire(context.Background())
+			if err != nil {
+				return
+			}
+			n := running.Add(1)
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			running.Add(-1)
+			release()
+		}()
+	}
+	wg.Wait()
+	return peak.Load()
+}
+
+func TestLimiterIsTighterDuringWarmup(t *testing.T) {
+	l := newUpstreamLimiter(6, 2, time.Hour)
+	if peak := peakConcurrency(l, 20); peak != 2 {
+		t.Fatalf("peak concurrency during warmup = %d, want 2", peak)
+	}
+	l.warmupUntil = time.Now()
+	if peak := peakConcurrency(l, 20); peak <= 2 || peak > 6 {
+		t.Fatalf("peak concurrency after warmup = %d, want above the warmup limit and at most 6", peak)
+	}
+}
+
+func TestLimiterWarmupWithoutNormalLimit(t *testing.T) {
+	l := newUpstreamLimiter(0, 3, time.Hour)
+	if peak := peakConcurrency(l, 20); peak != 3 {
+		t.Fatalf("peak concurrency during warmup = %d, want 3", peak)
+	}
+	l.warmupUntil = time.Now()
+	if peak := peakConcurrency(l, 20); peak <= 3 {
+		t.Fatalf("peak concurrency after warmup = %d, want no limit", peak)
+	}
+}
+
+func TestLimiterGivesUpWhenCancelled(t *testing.T) {
+	l := newUpstreamLimiter(1, 0, 0)
+	release, err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("acquire on a full limiter = %v, want the context's error", err)
+	}
+	release()
+	if release, err := l.acquire(context.Background()); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	} else {
+		release()
+	}
+}
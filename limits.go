@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+var (
+	errResponseTooLarge  = errors.New("response body over limit, replaced with 502")  // Returned by responseLimiter writes after the 502.
+	errResponseTruncated = errors.New("response body over limit, cut off mid-stream") // Returned once a body with headers already sent passes the limit.
+)
+
+type Limits struct { //Size limits enforced on every proxied request; zero fields mean no limit.
+	MaxURLLength    int   //MaxURLLength: Longer request URLs are rejected with 414.
+	MaxHeaderBytes  int   //MaxHeaderBytes: Requests whose headers add up to more are rejected with 431.
+	MaxRequestBody  int64 //MaxRequestBody: Larger request bodies are rejected with 413 before anything is forwarded.
+	MaxChunkedBody  int64 //MaxChunkedBody: Without MaxRequestBody, chunked request bodies up to this size are buffered and forwarded with a Content-Length; 0 forwards them chunked.
+	MaxResponseBody int64 //MaxResponseBody: Larger upstream responses are replaced with 502.
+}
+
+func (l Limits) middleware(next http.Handler) http.Handler {
+	/*
+		Wraps next so every size limit is enforced in one place, before the proxy sees the request:
+		URL length (414), header size (431) and request body (413), and on the way out, response body size (502).
+		Request bodies without a Content-Length are buffered here (up to the body limit, or MaxChunkedBody)
+		so they can be forwarded with one.
+	*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.MaxURLLength > 0 && len(r.URL.String()) > l.MaxURLLength {
+			log.Printf("Rejecting URL of %d bytes, limit is %d", len(r.URL.String()), l.MaxURLLength)
+			http.Error(w, "URI too long", http.StatusRequestURITooLong)
+			return
+		}
+		if size := headerSize(r.Header); l.MaxHeaderBytes > 0 && size > l.MaxHeaderBytes {
+			log.Printf("Rejecting %d bytes of request headers for %s, limit is %d", size, r.URL.Path, l.MaxHeaderBytes)
+			http.Error(w, "Request header fields too large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		if !l.checkRequestBody(w, r) {
+			return
+		}
+		if l.MaxResponseBody > 0 {
+			w = &responseLimiter{ResponseWriter: w, limit: l.MaxResponseBody, path: r.URL.Path}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func headerSize(h http.Header) int {
+	// Approximates the wire size of a header set: names, values and separators.
+	size := 0
+	for name, values := range h {
+		for _, v := range values {
+			size += len(name) + len(v) + 4
+		}
+	}
+	return size
+}
+
+func (l Limits) checkRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	/*
+		Logs the request body size and enforces MaxRequestBody.
+		With a limit set the body is read into memory (at most one byte past the limit) before anything is forwarded,
+		so an oversize body, even one sent chunked without a Content-Length, is answered with 413 and never reaches the upstream.
+		Without a limit, chunked bodies are buffered up to MaxChunkedBody so the upstream gets a Content-Length, and larger ones
+		are rejected the same way; with MaxChunkedBody 0 too they are forwarded chunked, as they came.
+		Returns false when the request has been rejected.
+	*/
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	limit := l.MaxRequestBody
+	if limit <= 0 {
+		if r.ContentLength > 0 {
+			log.Printf("Request body for %s: %d bytes", r.URL.Path, r.ContentLength)
+		}
+		if r.ContentLength >= 0 || l.MaxChunkedBody <= 0 {
+			return true
+		}
+		limit = l.MaxChunkedBody
+	}
+	if r.ContentLength > limit {
+		log.Printf("Rejecting request body for %s: %d bytes exceeds limit of %d", r.URL.Path, r.ContentLength, limit)
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, "Error while reading request body", http.StatusBadRequest)
+		return false
+	}
+	if int64(len(body)) > limit {
+		log.Printf("Rejecting request body for %s: exceeds limit of %d bytes", r.URL.Path, limit)
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	log.Printf("Request body for %s: %d bytes", r.URL.Path, len(body))
+	setBufferedBody(r, body)
+	return true
+}
+
+type responseLimiter struct { //A ResponseWriter replacing responses over a size limit with 502.
+	http.ResponseWriter
+	limit   int64  //limit: Largest allowed response body in bytes.
+	path    string //path: Request path, for logging.
+	written int64  //written: Body bytes passed through so far.
+	blocked bool   //blocked: The response was replaced with a 502 and further writes fail.
+	cut     bool   //cut: The body passed the limit after the headers went out and further writes fail.
+	started bool   //started: Headers have been sent.
+}
+
+func (rl *responseLimiter) WriteHeader(code int) {
+	/* Sends the headers, unless the declared Content-Length is already over the limit, in which case a 502 goes out instead.
+	Buffered responses always carry a Content-Length, so this catches them before any byte is sent; only responses streamed
+	without one (see streams) can pass the limit later, in Write.*/
+	if rl.started {
+		return
+	}
+	rl.started = true
+	if n, err := strconv.ParseInt(rl.Header().Get("Content-Length"), 10, 64); err == nil && n > rl.limit {
+		log.Printf("Upstream response for %s is %d bytes, limit is %d", rl.path, n, rl.limit)
+		rl.blocked = true
+		rl.Header().Del("Content-Length")
+		http.Error(rl.ResponseWriter, "Upstream response too large", http.StatusBadGateway)
+		return
+	}
+	rl.ResponseWriter.WriteHeader(code)
+}
+
+func (rl *responseLimiter) Write(b []byte) (int, error) {
+	/* Passes body bytes through until the limit. Past it every write fails: with errResponseTooLarge once the 502 replaced
+	the response, with errResponseTruncated when the headers had already gone out, so a streaming caller neither mistakes
+	the cut-off body for a complete one nor caches it, and can abort the response instead of ending it cleanly.*/
+	if !rl.started {
+		rl.WriteHeader(http.StatusOK)
+	}
+	if rl.blocked {
+		return 0, errResponseTooLarge
+	}
+	if rl.cut {
+		return 0, errResponseTruncated
+	}
+	if rl.written+int64(len(b)) > rl.limit {
+		log.Printf("Truncating upstream response for %s at limit of %d bytes", rl.path, rl.limit)
+		rl.cut = true
+		return 0, errResponseTruncated
+	}
+	rl.written += int64(len(b))
+	return rl.ResponseWriter.Write(b)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOversizeRequestBodyIsNotForwarded(t *testing.T) {
+	var forwarded atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	h := Limits{MaxRequestBody: 10}.middleware(http.HandlerFunc(p.handleProxy))
+
+	tests := []struct {
+		name   string
+		body   string
+		length int64
+		want   int
+	}{
+		{"with length", strings.Repeat("z", 11), 11, http.StatusRequestEntityTooLarge},
+		{"chunked", strings.Repeat("z", 11), -1, http.StatusRequestEntityTooLarge},
+		{"at the limit", strings.Repeat("z", 10), 10, http.StatusOK},
+		{"chunked under the limit", "small", -1, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := forwarded.Load()
+			r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tt.body))
+			r.ContentLength = tt.length
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			sent := forwarded.Load() - before
+			if tt.want == http.StatusOK && (sent != 1 || rec.Body.String() != tt.body) {
+				t.Fatalf("forwarded %d times, echoed %q; want the whole body forwarded once", sent, rec.Body.String())
+			}
+			if tt.want != http.StatusOK && sent != 0 {
+				t.Fatal("oversize body was forwarded upstream")
+			}
+		})
+	}
+}
+
+func TestChunkedRequestBodyIsForwardedWithLength(t *testing.T) {
+	type received struct {
+		length   int64
+		encoding []string
+		body     string
+	}
+	got := make(chan received, 1)
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{r.ContentLength, r.TransferEncoding, string(body)}
+	})
+	srv := serveTest(t, Limits{MaxChunkedBody: 10 << 20}.middleware(http.HandlerFunc(p.handleProxy)))
+
+	// An io.Reader of unknown length makes the client send the body chunked.
+	body := strings.Repeat("chunk ", 1000)
+	resp, err := http.Post(srv.URL+"/upload", "text/plain", io.MultiReader(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	upstream := <-got
+	if upstream.body != body || upstream.length != int64(len(body)) || len(upstream.encoding) != 0 {
+		t.Fatalf("upstream got %d bytes with Content-Length %d and Transfer-Encoding %v, want %d bytes with a Content-Length",
+			len(upstream.body), upstream.length, upstream.encoding, len(body))
+	}
+}
+
+func TestChunkedRequestBodyCapIsConfigurable(t *testing.T) {
+	var forwarded []int64
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		forwarded = append(forwarded, r.ContentLength)
+		w.Write(body)
+	})
+	p.keyOptions.PostKey = "query" // Keeps the body out of the key, so handleProxy doesn't buffer it either.
+	body := strings.Repeat("chunk ", 1000)
+	for _, tt := range []struct {
+		limits     Limits
+		wantStatus int
+		wantLength int64
+	}{
+		{Limits{}, http.StatusOK, -1},
+		{Limits{MaxChunkedBody: 1000}, http.StatusRequestEntityTooLarge, 0},
+		{Limits{MaxChunkedBody: 1000, MaxRequestBody: 10000}, http.StatusOK, int64(len(body))},
+	} {
+		forwarded = nil
+		srv := serveTest(t, tt.limits.middleware(http.HandlerFunc(p.handleProxy)))
+		resp, err := http.Post(srv.URL+"/upload", "text/plain", io.MultiReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := readBody(t, resp)
+		if resp.StatusCode != tt.wantStatus {
+			t.Fatalf("%+v: status %d, want %d", tt.limits, resp.StatusCode, tt.wantStatus)
+		}
+		if tt.wantStatus != http.StatusOK {
+			if len(forwarded) != 0 {
+				t.Fatalf("%+v: an oversize chunked body was forwarded", tt.limits)
+			}
+			continue
+		}
+		if got != body || len(forwarded) != 1 || forwarded[0] != tt.wantLength {
+			t.Fatalf("%+v: upstream got Content-Length %v and echoed %d bytes, want %d and the whole body", tt.limits, forwarded, len(got), tt.wantLength)
+		}
+	}
+}
+
+func TestOverlongURLIsRejected(t *testing.T) {
+	var forwarded atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { forwarded.Add(1) })
+	h := Limits{MaxURLLength: 64}.middleware(http.HandlerFunc(p.handleProxy))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/search?q="+strings.Repeat("a", 64), nil))
+	if rec.Code != http.StatusRequestURITooLong || forwarded.Load() != 0 {
+		t.Fatalf("overlong URL = %d after %d upstream calls, want 414 without one", rec.Code, forwarded.Load())
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/search?q=short", nil))
+	if rec.Code != http.StatusOK || forwarded.Load() != 1 {
+		t.Fatalf("short URL = %d after %d upstream calls, want it forwarded", rec.Code, forwarded.Load())
+	}
+}
+
+func TestLimitsMiddleware(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 500)))
+	})
+	withHeader := func(name, value string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set(name, value)
+		return r
+	}
+	tests := []struct {
+		name   string
+		limits Limits
+		req    *http.Request
+		want   int
+	}{
+		{"URL over limit", Limits{MaxURLLength: 10}, httptest.NewRequest(http.MethodGet, "/"+strings.Repeat("a", 20), nil), http.StatusRequestURITooLong},
+		{"URL at limit", Limits{MaxURLLength: 10}, httptest.NewRequest(http.MethodGet, "/"+strings.Repeat("a", 9), nil), http.StatusOK},
+		{"headers over limit", Limits{MaxHeaderBytes: 100}, withHeader("X-Big", strings.Repeat("y", 200)), http.StatusRequestHeaderFieldsTooLarge},
+		{"headers under limit", Limits{MaxHeaderBytes: 100}, withHeader("X-Small", "y"), http.StatusOK},
+		{"request body over limit", Limits{MaxRequestBody: 10}, httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(strings.Repeat("z", 20))), http.StatusRequestEntityTooLarge},
+		{"response body over limit", Limits{MaxResponseBody: 100}, httptest.NewRequest(http.MethodGet, "/large", nil), http.StatusBadGateway},
+		{"response body under limit", Limits{MaxResponseBody: 1000}, httptest.NewRequest(http.MethodGet, "/small", nil), http.StatusOK},
+		{"no limits", Limits{}, withHeader("X-Big", strings.Repeat("y", 200)), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.limits.middleware(http.HandlerFunc(p.handleProxy)).ServeHTTP(rec, tt.req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusBadGateway && strings.Contains(rec.Body.String(), "xxx") {
+				t.Fatal("the oversize body was passed on with the 502")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const fetchLockPoll = 50 * time.Millisecond // How often an instance waiting on the fetch lock checks the shared cache.
+
+type FetchLock interface { //Grants the right to fetch a key to one holder at a time across every instance sharing it.
+	TryLock(key string, lease time.Duration) (token string, ok bool) //TryLock: Takes the lock unless it is held; it frees itself after lease.
+	Unlock(key, token string)                                        //Unlock: Frees the lock if token still holds it.
+}
+
+const redisLockPrefix = "cache-proxy-lock:" // Prefix of fetch lock keys, outside redisKeyPrefix so Range and Clear skip them.
+
+var redisUnlock = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`) // Deletes a lock only if it still holds the caller's token.
+
+type RedisLock struct { //A FetchLock kept in the Redis server that also holds the shared cache.
+	client  *redis.Client   //client: Connection pool to the Redis server.
+	timeout time.Duration   //timeout: Limit on each Redis call, 0 for none.
+	breaker *circuitBreaker //breaker: The store's breaker; while it is open every caller fetches on its own.
+}
+
+func NewRedisLock(store *RedisStore) *RedisLock {
+	// Returns a lock sharing the store's Redis connection, timeout and circuit breaker.
+	return &RedisLock{client: store.client, timeout: store.timeout, breaker: store.breaker}
+}
+
+func (l *RedisLock) TryLock(key string, lease time.Duration) (string, bool) {
+	/* Sets the lock key with NX, so only the first caller succeeds, and with a lease so a crashed holder
+	can't block the key forever. Redis errors are logged and reported as held by no one, i.e. the caller fetches.*/
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", true
+	}
+	token := hex.EncodeToString(random[:])
+	if !l.breaker.allow() {
+		return "", true
+	}
+	ctx, cancel := redisContext(l.timeout)
+	defer cancel()
+	ok, err := l.client.SetNX(ctx, redisLockPrefix+key, token, lease).Result()
+	l.breaker.record(err)
+	if err != nil {
+		log.Printf("Redis fetch lock %s: %v", key, err)
+		return "", true
+	}
+	return token, ok
+}
+
+func (l *RedisLock) Unlock(key, token string) {
+	// Frees the lock unless its lease ran out and someone else took it since. A lock taken while Redis was skipped has no token.
+	if token == "" || !l.breaker.allow() {
+		return
+	}
+	ctx, cancel := redisContext(l.timeout)
+	defer cancel()
+	err := redisUnlock.Run(ctx, l.client, []string{redisLockPrefix + key}, token).Err()
+	l.breaker.record(err)
+	if err != nil {
+		log.Printf("Redis fetch unlock %s: %v", key, err)
+	}
+}
+
+func (p *ProxyServer) awaitFetch(w http.ResponseWriter, r *http.Request, baseKey, key string) (served bool, release func()) {
+	/*
+		Coordinates a miss with the rest of the fleet. The instance that gets the fetch lock fetches and must call release
+		once the response is stored. The others serve a stale copy if there is one, or else wait for the holder's entry
+		to show up in the shared cache and serve it as a hit. If none shows up within fetchLockWait, e.g. because the
+		response wasn't cacheable, the waiter fetches on its own rather than fail the request.
+	*/
+	token, ok := p.fetchLock.TryLock(key, p.fetchLockWait)
+	if ok {
+		return false, func() { p.fetchLock.Unlock(key, token) }
+	}
+	if p.serveStale(w, r, key, warnResponseStale) {
+		return true, nil
+	}
+	deadline := time.NewTimer(p.fetchLockWait)
+	defer deadline.Stop()
+	poll := time.NewTicker(fetchLockPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return true, nil
+		case <-deadline.C:
+			log.Printf("Fetch lock for %s not released in %s, fetching anyway", r.URL.Path, p.fetchLockWait)
+			return false, func() {}
+		case <-poll.C:
+			if entry, found := p.lookup(r, key); found && p.serveHit(w, r, baseKey, entry) {
+				return true, nil
+			}
+		}
+	}
+}
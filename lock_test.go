@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeLock struct { //An in-process FetchLock standing in for the Redis one, shared by several proxies in a test.
+	mu    sync.Mutex        //mu: Guards held.
+	held  map[string]string //held: Token of each held key.
+	next  int               //next: Counter making tokens unique.
+	taken int               //taken: How many times TryLock succeeded.
+}
+
+func newFakeLock() *fakeLock {
+	// Returns a lock with no keys held.
+	return &fakeLock{held: map[string]string{}}
+}
+
+func (l *fakeLock) TryLock(key string, lease time.Duration) (string, bool) {
+	// Takes key unless it is held. Leases never run out; tests hold keys only as long as they need to.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, busy := l.held[key]; busy {
+		return "", false
+	}
+	l.next++
+	l.taken++
+	token := strconv.Itoa(l.next)
+	l.held[key] = token
+	return token, true
+}
+
+func (l *fakeLock) Unlock(key, token string) {
+	// Frees key if token holds it.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[key] == token {
+		delete(l.held, key)
+	}
+}
+
+func TestFetchLockLetsOneInstanceFetch(t *testing.T) {
+	store, lock := newGobStore(), newFakeLock()
+	var fetches atomic.Int32
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond) // Long enough for every instance to miss before the entry is stored.
+		w.Write([]byte("body"))
+	}
+	instances := make([]*ProxyServer, 5)
+	for i := range instances {
+		p := newTestProxy(t, upstream)
+		p.cache = &Cache{store: store}
+		p.fetchLock, p.fetchLockWait = lock, 5*time.Second
+		instances[i] = p
+	}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, len(instances))
+	for i, p := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bodies[i] = get(p, "/page").Body.String()
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("upstream fetches across %d instances = %d, want 1", len(instances), n)
+	}
+	for i, body := range bodies {
+		if body != "body" {
+			t.Errorf("instance %d got %q", i, body)
+		}
+	}
+	if lock.taken != 1 || len(lock.held) != 0 {
+		t.Fatalf("lock taken %d times, %d keys still held; want 1 and 0", lock.taken, len(lock.held))
+	}
+}
+
+func TestFetchLockWaitersFetchWhenNothingIsStored(t *testing.T) {
+	store, lock := newGobStore(), newFakeLock()
+	var fetches atomic.Int32
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("private"))
+	}
+	holder, waiter := newTestProxy(t, upstream), newTestProxy(t, upstream)
+	for _, p := range []*ProxyServer{holder, waiter} {
+		p.cache = &Cache{store: store}
+		p.fetchLock, p.fetchLockWait = lock, 100*time.Millisecond
+	}
+	key := generateCacheKey(httptest.NewRequest(http.MethodGet, "/page", nil), waiter.keyOptions)
+	token, _ := lock.TryLock(key, time.Minute)
+	defer lock.Unlock(key, token)
+
+	start := time.Now()
+	if rec := get(waiter, "/page"); rec.Body.String() != "private" {
+		t.Fatalf("waiter got %q", rec.Body.String())
+	}
+	if waited := time.Since(start); waited < waiter.fetchLockWait {
+		t.Fatalf("waiter fetched after %s, before the %s wait ran out", waited, waiter.fetchLockWait)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("upstream fetches = %d, want the waiter's own", n)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import "container/list"
+
+func (c *Cache) bounded() bool {
+	// Reports whether the cache evicts to stay within maxEntries or maxBytes, and so keeps the recency list.
+	return c.maxEntries > 0 || c.maxBytes > 0
+}
+
+func (c *Cache) touch(key string) {
+	/* Moves key to the front of the recency list after a hit. Only tracked while the cache is bounded.
+	The list has its own mutex so Get can record a hit while holding just the read lock; a key removed meanwhile is not re-added.*/
+	if !c.bounded() {
+		return
+	}
+	c.recencyMu.Lock()
+	defer c.recencyMu.Unlock()
+	if elem, found := c.elements[key]; found {
+		c.recency.MoveToFront(elem)
+	}
+}
+
+func (c *Cache) track(key string) {
+	// Puts a newly stored, unpinned key at the front of the recency list. Must be called with the write lock held.
+	if !c.bounded() {
+		return
+	}
+	c.recencyMu.Lock()
+	defer c.recencyMu.Unlock()
+	if c.recency == nil {
+		c.recency = list.New()
+		c.elements = map[string]*list.Element{}
+	}
+	if elem, found := c.elements[key]; found {
+		c.recency.MoveToFront(elem)
+		return
+	}
+	c.elements[key] = c.recency.PushFront(key)
+}
+
+func (c *Cache) untrack(key string) {
+	// Drops key from the recency list. Removing an element twice is harmless.
+	c.recencyMu.Lock()
+	defer c.recencyMu.Unlock()
+	if elem, found := c.elements[key]; found {
+		c.recency.Remove(elem)
+		delete(c.elements, key)
+	}
+}
+
+func (c *Cache) evictOverflow() []evictedEntry {
+	/* Evicts least recently used entries until at most maxEntries unpinned ones remain and the bodies fit in maxBytes,
+	the same policy as the optimal variant's lru, and returns them for notifyEvicted. Pinned entries are never in
+	the recency list, so they are never picked. Must be called holding storeLocker.*/
+	var evicted []evictedEntry
+	for {
+		c.recencyMu.Lock()
+		over := (c.maxEntries > 0 && len(c.elements) > c.maxEntries) || (c.maxBytes > 0 && c.usedBytes > c.maxBytes)
+		if !over || len(c.elements) == 0 {
+			c.recencyMu.Unlock()
+			return evicted
+		}
+		victim := c.recency.Back().Value.(string)
+		c.recencyMu.Unlock()
+		entry, found := c.store.Get(victim)
+		if !found {
+			c.untrack(victim)
+			continue
+		}
+		c.remove(victim, entry)
+		evicted = append(evicted, evictedEntry{victim, entry})
+	}
+}
+
+func (p *ProxyServer) pinned(path string) bool {
+	// Reports whether entries stored for path are pinned, i.e. path matches one of the pinPaths globs.
+	for _, pattern := range p.pinPaths {
+		if globMatch(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
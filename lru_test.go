@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setFresh(c *Cache, key string) {
+	// Stores an entry for key that stays fresh for the whole test.
+	c.Set(key, CacheEntry{Response: []byte(key), TTL: time.Hour, Created: c.clock()})
+}
+
+func TestMaxEntriesIsEnforced(t *testing.T) {
+	c := &Cache{store: MemoryStore{}, maxEntries: 3}
+	for i := range 10 {
+		setFresh(c, fmt.Sprint(i))
+		if n := entryCount(c); n > 3 {
+			t.Fatalf("after %d sets the cache holds %d entries, want at most 3", i+1, n)
+		}
+	}
+	if got := c.evictions.Load(); got != 7 {
+		t.Fatalf("evictions = %d, want 7", got)
+	}
+	for _, key := range []string{"7", "8", "9"} {
+		if _, found := c.Get(key); !found {
+			t.Errorf("newest entry %s was evicted", key)
+		}
+	}
+}
+
+func TestMaxEntriesEvictsLeastRecentlyUsed(t *testing.T) {
+	c := &Cache{store: MemoryStore{}, maxEntries: 3}
+	setFresh(c, "a")
+	setFresh(c, "b")
+	setFresh(c, "c")
+	c.Get("a")
+	setFresh(c, "d")
+	if _, found := c.Get("b"); found {
+		t.Error("b, the least recently used entry, survived")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, found := c.Get(key); !found {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestMaxEntriesReplacingAKeyEvictsNothing(t *testing.T) {
+	c := &Cache{store: MemoryStore{}, maxEntries: 2}
+	setFresh(c, "a")
+	setFresh(c, "b")
+	setFresh(c, "a")
+	if n, evicted := entryCount(c), c.evictions.Load(); n != 2 || evicted != 0 {
+		t.Fatalf("entries = %d, evictions = %d, want 2 and 0", n, evicted)
+	}
+	c.ClearCache()
+	for i := range 5 {
+		setFresh(c, fmt.Sprint(i))
+	}
+	if n := entryCount(c); n != 2 {
+		t.Fatalf("after ClearCache the cache holds %d entries, want the limit of 2 to still apply", n)
+	}
+}
+
+func TestMaxEntriesUnderConcurrency(t *testing.T) {
+	// Gets touch the recency list under the read lock only; run with -race.
+	c := &Cache{store: MemoryStore{}, maxEntries: 50}
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				key := fmt.Sprint((g*31 + i) % 200)
+				if i%3 == 0 {
+					setFresh(c, key)
+				} else {
+					c.Get(key)
+				}
+				if i%100 == 0 {
+					c.Purge(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := entryCount(c); n > 50 {
+		t.Fatalf("cache holds %d entries, want at most 50", n)
+	}
+	c.recencyMu.Lock()
+	tracked := len(c.elements)
+	c.recencyMu.Unlock()
+	if tracked != entryCount(c) {
+		t.Fatalf("recency list tracks %d keys for %d entries", tracked, entryCount(c))
+	}
+}
+
+func TestMaxBytesIsEnforced(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		c := &Cache{store: MemoryStore{}, maxBytes: 2500}
+		if dedup {
+			c.bodies = map[string]*sharedBody{}
+		}
+		for i := range 10 {
+			body := []byte(fmt.Sprintf("%04d", i) + strings.Repeat("x", 996))
+			c.Set(fmt.Sprint(i), CacheEntry{Response: body, TTL: time.Hour, Created: c.clock()})
+			if summary := c.Summary(); summary.Bytes > 2500 || summary.Bytes != c.usedBytes {
+				t.Fatalf("dedup %v: after %d sets the cache holds %d bytes (tracked %d), want at most 2500", dedup, i+1, summary.Bytes, c.usedBytes)
+			}
+		}
+		if n := entryCount(c); n != 2 {
+			t.Fatalf("dedup %v: %d entries of 1000 bytes left, want 2", dedup, n)
+		}
+		c.Set("huge", CacheEntry{Response: make([]byte, 3000), TTL: time.Hour, Created: c.clock()})
+		if _, found := c.Get("huge"); found || entryCount(c) != 2 {
+			t.Fatalf("dedup %v: a body larger than max-bytes was stored or evicted the others", dedup)
+		}
+	}
+}
+
+func TestPinnedEntriesSurviveEviction(t *testing.T) {
+	c := &Cache{store: MemoryStore{}, maxEntries: 2, maxBytes: 1000, maxPinned: 1}
+	c.Set("home", CacheEntry{Response: make([]byte, 400), TTL: time.Hour, Created: c.clock(), Pinned: true})
+	c.Set("bundle", CacheEntry{Response: make([]byte, 100), TTL: time.Hour, Created: c.clock(), Pinned: true})
+	for i := range 5 {
+		c.Set(fmt.Sprint(i), CacheEntry{Response: make([]byte, 200), TTL: time.Hour, Created: c.clock()})
+	}
+	if _, found := c.Get("home"); !found {
+		t.Fatal("the pinned entry was evicted")
+	}
+	if _, found := c.Get("bundle"); found {
+		t.Fatal("an entry beyond the pinned budget was kept as pinned")
+	}
+	if n := entryCount(c); n != 3 {
+		t.Fatalf("%d entries, want the pinned one and 2 others", n)
+	}
+	c.Set("more", CacheEntry{Response: make([]byte, 700), TTL: time.Hour, Created: c.clock()})
+	if _, found := c.Get("more"); found {
+		t.Fatal("stored a body that only fits by evicting the pinned entry")
+	}
+	if _, found := c.Get("home"); !found {
+		t.Fatal("the pinned entry was evicted to make room")
+	}
+}
+
+func TestPinPathsPinEntries(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	p.cache.maxEntries, p.cache.maxPinned = 1, 1
+	p.pinPaths = []string{"/", "/static/app-*.js"}
+	get(p, "/")
+	for i := range 3 {
+		get(p, "/page/"+fmt.Sprint(i))
+	}
+	if rec := get(p, "/"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("pinned homepage = %s after churn, want a HIT", rec.Header().Get("X-Cache"))
+	}
+	if rec := get(p, "/page/0"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("unpinned page = %s after churn, want it evicted", rec.Header().Get("X-Cache"))
+	}
+}
@@ -1,172 +1,2150 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"maps"
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var defaultCacheableStatus = map[int]bool{200: true, 203: true, 300: true, 301: true, 404: true, 410: true} // Cacheable by default per RFC 7231, section 6.1.
+
+const warnRevalidationFailed = `111 - "Revalidation Failed"` // Warning for stale content served because the upstream failed.
+const warnResponseStale = `110 - "Response is Stale"`        // Warning for stale content served while another instance refetches it.
+
 type ProxyServer struct { //Represents the proxy server.
 	targetHost string        //targetHost: The upstream server where requests are forwarded.
 	cache      *Cache        //A Cache instance for storing responses.
 	defaultTTL time.Duration //The default time-to-live (TTL) for cached data.
+	client     *http.Client  //client: The HTTP client used for upstream requests.
+
+	cacheableMethods  map[string]bool //cacheableMethods: Methods whose responses are cached and served from cache; nil means GET and HEAD.
+	cacheableStatuses map[int]bool    //cacheableStatuses: Upstream statuses cached unless a rule says otherwise; nil means defaultCacheableStatus.
+
+	http10KeepAlive bool             //http10KeepAlive: Whether HTTP/1.0 clients asking for keep-alive may keep their connection open.
+	preserveHost    bool             //preserveHost: Forward the client's Host header instead of the target's.
+	rules           *RuleSet         //rules: Optional cache rules deciding per response whether and how long to cache.
+	keyOptions      KeyOptions       //keyOptions: Controls which parts of a request feed into its cache key.
+	serverTiming    bool             //serverTiming: Whether to report cache status and upstream duration in a Server-Timing header.
+	limiter         *upstreamLimiter //limiter: Optional bound on concurrent upstream fetches.
+	gzipMismatch    string           //gzipMismatch: What to do when a gzip-cached entry hits for a client not accepting gzip: "decompress" or "refetch".
+	metadataAbove   int              //metadataAbove: Bodies larger than this many bytes are cached as metadata only, 0 to always cache bodies.
+	collapseForward bool             //collapseForward: Also collapse repeated slashes in the path forwarded upstream, not just in the cache key.
+	readTimeout     time.Duration    //readTimeout: Longest an upstream body may go without sending a byte once headers have arrived, 0 for none.
+
+	statusHeader string            //statusHeader: Name of the response header reporting the cache status, X-Cache by default.
+	statusValues map[string]string //statusValues: Replacements for the built-in status values such as HIT and MISS.
+
+	stats ProxyStats //stats: Traffic counters exposed on /stats and /metrics.
+
+	logHeaders    bool     //logHeaders: Whether to log request and upstream response headers for debugging.
+	redactHeaders []string //redactHeaders: Extra header names, besides the usual credentials, whose values are redacted in logs.
+	debugKeys     bool     //debugKeys: Whether to log each request's cache key and the redacted input it was hashed from.
+
+	heuristicCaching bool          //heuristicCaching: Derive the TTL from Last-Modified when the upstream gives no explicit lifetime.
+	heuristicMaxTTL  time.Duration //heuristicMaxTTL: Upper bound for heuristic TTLs.
+	cacheRetryAfter  bool          //cacheRetryAfter: Cache 503 responses carrying Retry-After for that long, so clients back off without hitting the upstream.
+
+	contentTypeTTLs []contentTypeTTL //contentTypeTTLs: TTLs by media type, used in place of defaultTTL when one matches.
+	pathTTLs        pathTTLs         //pathTTLs: TTLs by request path, taking precedence over contentTypeTTLs.
+
+	refreshSlots  chan struct{} //refreshSlots: Bounds background refreshes in flight, nil for unlimited.
+	refreshWindow time.Duration //refreshWindow: Entries answering a 304 within this long of expiry are refreshed in the background, 0 to disable.
+	refreshing    sync.Map      //refreshing: Keys with a background refresh in flight.
+	staleWarnings bool          //staleWarnings: Whether stale responses carry an RFC 7234 Warning header.
+
+	revalidatePost bool //revalidatePost: Expired POST entries are revalidated with a conditional POST, like GETs.
+
+	upstreamEncoding string       //upstreamEncoding: Accept-Encoding sent upstream in place of the client's, "" to leave it alone.
+	memoryGuard      *memoryGuard //memoryGuard: Optional guard skipping cache writes while system memory is low.
+
+	metaHeaders map[string]string //metaHeaders: Metadata names and the upstream headers their values are taken from.
+	pinPaths    []string          //pinPaths: Path globs whose entries are pinned, see CacheEntry.Pinned.
+	limits      Limits            //limits: Size limits enforced by the limits middleware in front of handleProxy.
+	access      PathAccess        //access: Allowed and denied path globs enforced in front of handleProxy.
+
+	cookieRewrite CookieRewrite //cookieRewrite: Domain and path rewriting applied to Set-Cookie headers sent to clients.
+	shuttingDown  atomic.Bool   //shuttingDown: Set once graceful shutdown begins; new requests are then answered with 503.
+
+	logRevalidations bool //logRevalidations: Log whether each refetch of an expired entry changed its body.
+
+	headerCase []string //headerCase: Response header names to send in exactly this casing instead of Go's canonical form.
+
+	forwardedHeaders bool //forwardedHeaders: Tell the upstream the client's address, scheme and host in X-Forwarded-For, -Proto and -Host.
+
+	bypass       BypassHeader //bypass: Request header that skips the cache lookup, for debugging.
+	honorNoCache bool         //honorNoCache: Requests with Cache-Control or Pragma no-cache skip the lookup and refetch.
+
+	fetches flightGroup //fetches: Upstream fetches for cacheable requests in progress, one per key.
+
+	forward ForwardProxy //forward: Hosts clients may reach through absolute-form request URIs.
+
+	compressBodies bool      //compressBodies: Store compressible bodies gzipped, trading CPU on hits for memory.
+	gzipWriters    *gzipPool //gzipWriters: Pooled writers compressBodies gzips with at compress-level, nil for the default level without pooling.
+
+	streamThreshold int64 //streamThreshold: Responses larger than this, or of unknown length, are streamed to the client, 0 to always buffer.
+	streamCacheMax  int64 //streamCacheMax: Streamed responses up to this size are still cached.
+
+	errorPage *errorPage //errorPage: Optional template for 502 and 504 responses, nil for plain text.
+
+	bodyBuffers *bufferPool //bodyBuffers: Pool of buffers upstream bodies are read into on a miss, nil to allocate each time.
+
+	fetchLock     FetchLock     //fetchLock: Lets one instance of the fleet at a time fetch a missing key, nil to fetch independently.
+	fetchLockWait time.Duration //fetchLockWait: Lease of the fetch lock, and how long other instances wait for the holder's entry.
+
+	cacheRoutes []cacheRoute //cacheRoutes: Path globs cached in another backend than cache's, see cacheFor.
+}
+
+type Cache struct { //Stores cached data and handles cache operations.
+	store  CacheStore             //store: Cached entries by key (unique identifier), a MemoryStore unless another backend is chosen.
+	bodies map[string]*sharedBody //bodies: Content-addressed response bodies shared between entries, nil when deduplication is off.
+	mu     sync.RWMutex           //A mutex to ensure thread-safe access to the cache; a shared store does its own locking and is called without it, see storeLocker.
+
+	maxStale  time.Duration                  //maxStale: How long past expiry an entry is kept around for stale serving, 0 to drop it on expiry.
+	metaIndex map[string]map[string]struct{} //metaIndex: Cache keys by "name:value" metadata pair, for purging by metadata; kept for a MemoryStore only.
+	varies    map[string]varyRecord          //varies: Request headers named by Vary, by the key computed before Vary is applied; per process, see recordVary.
+	variesMu  sync.RWMutex                   //variesMu: Guards varies, which every request reads, without waiting on the store.
+	variants  map[string]int                 //variants: Number of stored entries by BaseKey, so varies forgets a key with its last entry; kept for a MemoryStore only.
+
+	evictions atomic.Int64                       //evictions: Entries dropped because they expired or the cache was full, as opposed to purged or replaced.
+	OnEvict   func(key string, entry CacheEntry) //OnEvict: Optional, called for every entry counted in evictions, after the cache lock is released.
+
+	maxEntries int                      //maxEntries: Upper bound on the number of unpinned entries, least recently used ones evicted first; 0 for unbounded.
+	maxBytes   int64                    //maxBytes: Upper bound on the summed size of cached bodies, evicting the same way; 0 for unbounded.
+	usedBytes  int64                    //usedBytes: Summed size of the cached bodies, a shared body counted once; kept for a MemoryStore only.
+	recency    *list.List               //recency: Unpinned keys by last use, most recent at the front, while the cache is bounded.
+	elements   map[string]*list.Element //elements: Each key's element in recency, for O(1) moves and removals.
+	recencyMu  sync.Mutex               //recencyMu: Guards recency and elements, which Get updates under the read lock.
+
+	maxPinned   int //maxPinned: How many pinned entries are kept out of eviction; pinned entries beyond it are stored as regular ones.
+	pinnedCount int //pinnedCount: Number of pinned entries held.
+
+	now func() time.Time //now: Clock for entry timestamps and expiry, time.Now when nil; tests swap in a fake one.
+
+	summaryMu  sync.Mutex   //summaryMu: Guards summary and summarized.
+	summary    CacheSummary //summary: The last Summary of a shared store, reused for sharedSummaryInterval.
+	summarized time.Time    //summarized: When summary was taken, zero before the first one.
+}
+
+type sharedBody struct { //A response body referenced by one or more cache entries.
+	data []byte //data: The body bytes.
+	refs int    //refs: Number of cache entries referencing the body.
+}
+
+type CacheEntry struct { //Represents a single cache entry.
+
+	Response []byte        //Response: The response body.
+	Headers  http.Header   //Headers: HTTP headers for the response.
+	TTL      time.Duration //TTL: Duration for which the entry is valid.
+	Created  time.Time     //Created: Timestamp when the entry was cached.
+	BodyHash string        //BodyHash: Content hash of Response when the body is held in the shared body table.
+	Status   int           //Status: The upstream status code, 0 meaning 200.
+
+	MetadataOnly bool //MetadataOnly: The body was too large to cache; only headers are kept for HEAD and conditional requests.
+	Size         int  //Size: Length of the upstream body, also known when it wasn't stored.
+
+	Metadata map[string]string //Metadata: Operator-defined values taken from upstream headers, usable for purging.
+	Path     string            //Path: Request path the entry was stored for, matched by scheduled purges.
+
+	Compressed bool //Compressed: Response holds the body gzipped by the proxy (compress-bodies), not as the upstream sent it.
+	Pinned     bool //Pinned: Stored for a pin-paths path; never evicted to make room, only dropped on expiry, purge or clear.
+
+	BaseKey string   //BaseKey: The cache key before Vary was applied, shared by every variant of a URL.
+	URLKey  string   //URLKey: The key of the URL and method alone, see KeyOptions.urlOnly; set only when keys also depend on the client.
+	Vary    []string //Vary: Request headers named by the response's Vary, which selected this variant.
+
+	hits *atomic.Int64 //hits: Times the entry was served; a pointer so every copy of the entry shares one counter.
+}
+
+type KeyOptions struct { //Controls which parts of a request feed into its cache key.
+	PostKey         string //PostKey: What identifies a POST: "query" (URL including query), "body" (path and body) or "both".
+	CollapseSlashes bool   //CollapseSlashes: Treat runs of slashes in the path as one, so /a//b and /a/b share an entry.
+	NormalizeQuery  bool   //NormalizeQuery: Sort query parameters, so ?a=1&b=2 and ?b=2&a=1 share an entry.
+	DeviceClass     bool   //DeviceClass: Cache mobile, tablet and desktop clients separately, classified from User-Agent.
+
+	SegmentPattern *regexp.Regexp //SegmentPattern: Path segments matching this are replaced with a placeholder in the key, e.g. numeric ids.
+
+	AuthPartition bool     //AuthPartition: Share entries between anonymous requests but isolate authenticated ones per user.
+	AuthHeaders   []string //AuthHeaders: Request headers whose presence marks a request as authenticated.
+	AuthCookies   []string //AuthCookies: Cookie names whose presence marks a request as authenticated.
+
+	Host bool //Host: Include the request's Host header, set whenever the Host is forwarded upstream (preserve-host).
+
+	OmitMethod bool //OmitMethod: Leave the method out of the key; only sound while GET and HEAD are the only cacheable methods.
+
+	TenantHeader  string //TenantHeader: Request header carrying the tenant ID, "" when not keyed by header.
+	TenantSegment int    //TenantSegment: 1-based path segment carrying the tenant ID, 0 when not keyed by path.
+
+	Headers []string //Headers: Canonical request header names whose values are part of every key, sorted so the order is stable.
+}
+
+func (opts KeyOptions) perClient() bool {
+	// Reports whether keys depend on who asks, not just on the URL: by device class, tenant header, key headers or auth identity.
+	return opts.DeviceClass || opts.TenantHeader != "" || len(opts.Headers) > 0 || opts.AuthPartition
+}
+
+func (opts KeyOptions) urlOnly() KeyOptions {
+	/* Returns opts without the parts perClient reports, so every client's entry for a URL gets the same key.
+	A purge goes by that key, since the purger's own headers would pick out just one of them.*/
+	opts.DeviceClass = false
+	opts.TenantHeader = ""
+	opts.Headers = nil
+	opts.AuthPartition = false
+	return opts
+}
+
+func generateCacheKey(r *http.Request, opts KeyOptions) string {
+	/* Generates a unique cache key for each HTTP request.
+	Combines the request URL (with scheme and host lowercased) and method (unless opts.OmitMethod), hashed using MD5.
+	The values of opts.Headers are added in their sorted order, so configuring them in another order keeps the keys.
+	For POST requests opts.PostKey decides whether the query string, the body or both identify the request;
+	the body is read through r.GetBody, so it must have been buffered with bufferRequestBody first.*/
+	input := keyInput{hash: md5.New()}
+	input.build(r, opts)
+	return hex.EncodeToString(input.hash.Sum(nil))
+}
+
+func describeKeyInput(r *http.Request, opts KeyOptions, redact []string) string {
+	/* Returns the exact input generateCacheKey hashes for r, for debug-keys, with credentials replaced by [REDACTED]:
+	the auth-partition identity and the values of sensitive or redacted key headers. A POST body is shown by its length only.*/
+	input := keyInput{hash: md5.New(), text: &strings.Builder{}, redact: redact}
+	input.build(r, opts)
+	return input.text.String()
+}
+
+func (p *ProxyServer) logKeyInput(r *http.Request, baseKey, key string) {
+	// Logs which key r got and the input it was hashed from, plus the Vary headers that picked the variant, if any.
+	input := describeKeyInput(r, p.keyOptions, p.redactHeaders)
+	if key == baseKey {
+		log.Printf("Cache key %s for %s %s from %q", key, r.Method, r.URL.Path, input)
+		return
+	}
+	variant := describeVariant(p.variantHeaders(r), p.cacheFor(r.URL.Path).varyNames(baseKey), p.redactHeaders)
+	log.Printf("Cache key %s for %s %s from %q, variant of %s by %q", key, r.Method, r.URL.Path, input, baseKey, variant)
+}
+
+type keyInput struct { //Receives the pieces of a cache key's input: hashed into the key, and spelled out for debug-keys when text is set.
+	hash   hash.Hash        //hash: The MD5 the key is taken from.
+	text   *strings.Builder //text: Readable copy of the input with secrets redacted, nil unless describing the key.
+	redact []string         //redact: Header names whose values are redacted in text, besides sensitiveHeaders.
+}
+
+func (k *keyInput) write(s string) {
+	// Adds s to the key input as is.
+	k.writeShown(s, s)
+}
+
+func (k *keyInput) writeShown(s, shown string) {
+	// Adds s to the key input, showing it as shown in the description.
+	io.WriteString(k.hash, s)
+	if k.text != nil {
+		k.text.WriteString(shown)
+	}
+}
+
+func (k *keyInput) build(r *http.Request, opts KeyOptions) {
+	// Feeds every part of r that opts puts into the key, in a fixed order.
+	u := *r.URL
+	// Scheme and host are case-insensitive, the path is not.
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if r.Method == http.MethodPost && opts.PostKey == "body" {
+		u.RawQuery = ""
+	}
+	if opts.CollapseSlashes {
+		u.Path = collapseSlashes(u.Path)
+		u.RawPath = ""
+	}
+	if opts.SegmentPattern != nil {
+		u.Path = templatePath(u.Path, opts.SegmentPattern)
+		u.RawPath = ""
+	}
+	if opts.NormalizeQuery {
+		u.RawQuery = normalizeQuery(u.RawQuery)
+	}
+	k.write(u.String())
+	if !opts.OmitMethod {
+		k.write(r.Method)
+	}
+	if opts.Host {
+		// With preserve-host the upstream may serve different virtual hosts, so each Host gets its own entries.
+		k.write("host=" + strings.ToLower(r.Host))
+	}
+	if opts.DeviceClass {
+		k.write("device=" + deviceClass(r.UserAgent()))
+	}
+	if opts.AuthPartition {
+		identity, shown := authIdentity(r, opts), ""
+		if identity != "" {
+			shown = "[REDACTED]"
+		}
+		k.writeShown("user="+identity, "user="+shown)
+	}
+	if opts.TenantHeader != "" || opts.TenantSegment > 0 {
+		k.write("tenant=" + tenantID(r, opts))
+	}
+	for _, name := range opts.Headers {
+		// An absent header writes an empty value, so leaving it out is keyed the same every time.
+		value := strings.Join(r.Header.Values(name), ",")
+		shown := value
+		if value != "" && sensitiveHeader(name, k.redact) {
+			shown = "[REDACTED]"
+		}
+		k.writeShown("header:"+name+"="+value+"\x00", "header:"+name+"="+shown+"\x00")
+	}
+	if r.Method == http.MethodPost && (opts.PostKey == "body" || opts.PostKey == "both") && r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			n, _ := io.Copy(k.hash, body)
+			body.Close()
+			if k.text != nil {
+				fmt.Fprintf(k.text, "[%d byte body]", n)
+			}
+		}
+	}
+}
+
+func authIdentity(r *http.Request, opts KeyOptions) string {
+	/* Returns the values of the configured authentication headers and cookies, or "" for an anonymous request.
+	Anonymous requests therefore all share one partition, while each distinct credential gets its own.*/
+	var identity strings.Builder
+	for _, name := range opts.AuthHeaders {
+		if v := r.Header.Get(name); v != "" {
+			identity.WriteString(name + ":" + v + "\x00")
+		}
+	}
+	for _, name := range opts.AuthCookies {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			identity.WriteString("cookie:" + name + "=" + c.Value + "\x00")
+		}
+	}
+	return identity.String()
+}
+
+func tenantID(r *http.Request, opts KeyOptions) string {
+	/* Returns the tenant a request belongs to, taken from opts.TenantHeader or path segment opts.TenantSegment.
+	It is folded into the key even when the path already holds it, so key templating can't merge tenants.*/
+	if opts.TenantHeader != "" {
+		return r.Header.Get(opts.TenantHeader)
+	}
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if opts.TenantSegment > len(segments) {
+		return ""
+	}
+	return segments[opts.TenantSegment-1]
+}
+
+func parseTenantKey(value string) (header string, segment int, err error) {
+	// Parses the tenant-key flag: "header:Name", "path:N" or "" for no tenant keying.
+	if value == "" {
+		return "", 0, nil
+	}
+	kind, arg, _ := strings.Cut(value, ":")
+	switch {
+	case kind == "header" && arg != "":
+		return http.CanonicalHeaderKey(arg), 0, nil
+	case kind == "path":
+		if segment, err = strconv.Atoi(arg); err == nil && segment > 0 {
+			return "", segment, nil
+		}
+	}
+	return "", 0, fmt.Errorf("invalid tenant-key %q, want header:Name or path:N", value)
+}
+
+func parseKeyHeaders(list string) ([]string, error) {
+	// Parses the key-headers flag into sorted, deduplicated canonical header names.
+	var names []string
+	for _, name := range splitList(list) {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid key-headers: %q is not a header name", name)
+		}
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+func deviceClass(userAgent string) string {
+	/* Classifies a User-Agent as "mobile", "tablet" or "desktop" using a few well-known substrings.
+	Only the first 512 bytes are inspected, so the cost per request stays bounded.*/
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"), strings.Contains(ua, "kindle"),
+		strings.Contains(ua, "silk/"), strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return "tablet"
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "ipod"),
+		strings.Contains(ua, "android"), strings.Contains(ua, "windows phone"), strings.Contains(ua, "blackberry"),
+		strings.Contains(ua, "opera mini"):
+		return "mobile"
+	}
+	return "desktop"
+}
+
+func templatePath(path string, pattern *regexp.Regexp) string {
+	/* Replaces each path segment matching pattern with "{}", so /users/42/profile and /users/7/profile
+	share a key. Only the key is affected; the upstream still receives the literal path.*/
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment != "" && pattern.MatchString(segment) {
+			segments[i] = "{}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func collapseSlashes(path string) string {
+	// Replaces every run of slashes in a URL path with a single slash. Only the path is touched, never the query.
+	if !strings.Contains(path, "//") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func normalizeQuery(query string) string {
+	/* Puts the parameters of a raw query in a canonical order: sorted by name, repeated names by value.
+	Parameters are compared as sent, without decoding. Empty pairs from && are dropped, and a bare "a" counts as "a=".
+	Only the key is affected; the upstream still receives the query in its original order.*/
+	var params []string
+	for _, param := range strings.Split(query, "&") {
+		if param == "" {
+			continue
+		}
+		if !strings.Contains(param, "=") {
+			param += "="
+		}
+		params = append(params, param)
+	}
+	slices.SortFunc(params, func(a, b string) int {
+		nameA, valueA, _ := strings.Cut(a, "=")
+		nameB, valueB, _ := strings.Cut(b, "=")
+		if c := strings.Compare(nameA, nameB); c != 0 {
+			return c
+		}
+		return strings.Compare(valueA, valueB)
+	})
+	return strings.Join(params, "&")
+}
+
+func bufferRequestBody(r *http.Request) error {
+	// Reads the request body into memory so it can be hashed for the key and still be forwarded upstream.
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	setBufferedBody(r, body)
+	return nil
+}
+
+func setBufferedBody(r *http.Request, body []byte) {
+	/* Replaces the request body with an in-memory copy that can be re-read through GetBody.
+	The request now has a known length, so it is forwarded with Content-Length instead of chunked.*/
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Transfer-Encoding")
+}
+
+func (c *Cache) clock() time.Time {
+	// Returns the current time as the cache sees it. Everything that stamps or ages an entry goes through here.
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+func (c *Cache) Get(cacheKey string) (CacheEntry, bool) {
+	/* Fetches a cache entry if it exists and hasn’t expired. An expired entry is left in place for the revalidation
+	to replace in one Set, so concurrent readers never see it half gone, see DropExpired.*/
+	l := c.storeRLocker()
+	l.Lock()
+	entry, found := c.store.Get(cacheKey)
+	l.Unlock()
+	if !found || c.clock().Sub(entry.Created) > entry.TTL {
+		return CacheEntry{}, false
+	}
+	if entry.hits != nil {
+		// Counting atomically keeps Get on the read lock instead of serializing readers behind a write lock.
+		entry.hits.Add(1)
+	}
+	c.touch(cacheKey)
+	return entry, true
+}
+
+func (c *Cache) local() bool {
+	// Reports whether entries live in this process, as opposed to a store shared with other instances.
+	_, local := c.store.(MemoryStore)
+	return local
+}
+
+type noLock struct{} //A sync.Locker that doesn't lock, for stores that guard themselves.
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
+
+func (c *Cache) storeLocker() sync.Locker {
+	/* Returns the lock to hold while changing the store: the write lock for a MemoryStore, nothing for a shared one,
+	which does its own locking. Holding mu across a network round trip would stall every request of this instance
+	whenever Redis is slow.*/
+	if c.local() {
+		return &c.mu
+	}
+	return noLock{}
+}
+
+func (c *Cache) storeRLocker() sync.Locker {
+	// Returns the lock to hold while reading the store, the read lock for a MemoryStore, see storeLocker.
+	if c.local() {
+		return c.mu.RLocker()
+	}
+	return noLock{}
+}
+
+func (c *Cache) DropExpired(cacheKey string) {
+	// Deletes the entry under cacheKey if it has expired and is past the max-stale window, i.e. no longer of any use.
+	l := c.storeLocker()
+	l.Lock()
+	var evicted []evictedEntry
+	if entry, ok := c.store.Get(cacheKey); ok && c.clock().Sub(entry.Created) > entry.TTL+c.maxStale {
+		c.remove(cacheKey, entry)
+		evicted = append(evicted, evictedEntry{cacheKey, entry})
+	}
+	l.Unlock()
+	c.notifyEvicted(evicted)
+}
+
+func (c *Cache) Sweep() int {
+	/* Deletes every entry that has expired and is past the max-stale window, and returns how many were deleted.
+	Lazy removal only reaches keys that are requested again; this catches the ones that never are.
+	A shared store is left alone: walking the whole fleet's cache under the lock would stall this instance,
+	and Redis already drops entries at the same moment through their TTL, see RedisStore.Set.
+	Only the Vary names recorded for keys whose variants Redis has dropped by now are forgotten.*/
+	if !c.local() {
+		c.forgetExpiredVaries()
+		return 0
+	}
+	c.mu.Lock()
+	var evicted []evictedEntry
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		if c.clock().Sub(entry.Created) > entry.TTL+c.maxStale {
+			evicted = append(evicted, evictedEntry{key, entry})
+		}
+		return true
+	})
+	for _, e := range evicted {
+		c.remove(e.key, e.entry)
+	}
+	c.mu.Unlock()
+	c.notifyEvicted(evicted)
+	return len(evicted)
+}
+
+type evictedEntry struct { //An entry removed because it expired or the cache was full, waiting to be reported to OnEvict.
+	key   string     //key: The key the entry was stored under.
+	entry CacheEntry //entry: The removed entry.
+}
+
+func (c *Cache) notifyEvicted(evicted []evictedEntry) {
+	/* Counts evicted entries and passes each to OnEvict. Must be called without the lock held,
+	so the callback may use the cache itself, even Set, without deadlocking.*/
+	c.evictions.Add(int64(len(evicted)))
+	if c.OnEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		c.OnEvict(e.key, e.entry)
+	}
+}
+
+func (c *Cache) runSweeper(ctx context.Context, interval time.Duration) {
+	// Sweeps the cache every interval until ctx is cancelled.
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := c.Sweep(); removed > 0 {
+				log.Printf("Sweep removed %d expired entries", removed)
+			}
+		}
+	}
+}
+
+type EntryHits struct { //How often one entry has been served, as listed by TopHits.
+	Key  string //Key: The entry's cache key.
+	Path string //Path: Request path the entry was stored for.
+	Hits int64  //Hits: Times Get served the entry since it was stored.
+}
+
+func (c *Cache) TopHits(n int) []EntryHits {
+	/* Returns the n most served entries, most hits first. Hits are counted per process,
+	so a shared store, whose entries are decoded afresh on every Get, has none to report.*/
+	if !c.local() || n <= 0 {
+		return nil
+	}
+	var top []EntryHits
+	c.mu.RLock()
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		if entry.hits != nil {
+			top = append(top, EntryHits{Key: key, Path: entry.Path, Hits: entry.hits.Load()})
+		}
+		return true
+	})
+	c.mu.RUnlock()
+	slices.SortFunc(top, func(a, b EntryHits) int { return cmp.Compare(b.Hits, a.Hits) })
+	return top[:min(n, len(top))]
+}
+
+type CacheSummary struct { //A snapshot of what the cache holds.
+	Entries int       //Entries: Number of entries.
+	Bytes   int64     //Bytes: Size of the cached bodies, a body shared between entries counted once.
+	Oldest  time.Time //Oldest: When the longest-held entry was stored, zero when the cache is empty.
+	Newest  time.Time //Newest: When the most recent entry was stored, zero when the cache is empty.
+}
+
+const sharedSummaryInterval = 30 * time.Second // How long a Summary of a shared store is reused before the store is walked again.
+
+func (c *Cache) Summary() CacheSummary {
+	/* Describes the cache's current contents. With a shared backend this walks every entry of the fleet,
+	so the result is reused for sharedSummaryInterval rather than taken again on every scrape.*/
+	if c.local() {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return c.summarize()
+	}
+	c.summaryMu.Lock()
+	defer c.summaryMu.Unlock()
+	if c.summarized.IsZero() || c.clock().Sub(c.summarized) >= sharedSummaryInterval {
+		c.summary, c.summarized = c.summarize(), c.clock()
+	}
+	return c.summary
+}
+
+func (c *Cache) summarize() CacheSummary {
+	// Walks the store for Summary. Must be called with the read lock held for a MemoryStore.
+	var summary CacheSummary
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		summary.Entries++
+		if c.bodies == nil {
+			summary.Bytes += int64(len(entry.Response))
+		}
+		if summary.Oldest.IsZero() || entry.Created.Before(summary.Oldest) {
+			summary.Oldest = entry.Created
+		}
+		if entry.Created.After(summary.Newest) {
+			summary.Newest = entry.Created
+		}
+		return true
+	})
+	for _, shared := range c.bodies {
+		summary.Bytes += int64(len(shared.data))
+	}
+	return summary
+}
+
+func (c *Cache) GetStale(cacheKey string) (CacheEntry, bool) {
+	/* Fetches an entry that has expired by no more than maxStale, for serving when the upstream is failing.
+	Entries past that cap are never returned, bounding how old stale content can get.*/
+	l := c.storeRLocker()
+	l.Lock()
+	defer l.Unlock()
+	entry, found := c.store.Get(cacheKey)
+	if !found || c.maxStale <= 0 || c.clock().Sub(entry.Created) > entry.TTL+c.maxStale {
+		return CacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *Cache) GetExpired(cacheKey string) (CacheEntry, bool) {
+	// Fetches an entry only if it exists but has expired, i.e. the next fetch for its key is a revalidation.
+	l := c.storeRLocker()
+	l.Lock()
+	defer l.Unlock()
+	entry, found := c.store.Get(cacheKey)
+	if !found || c.clock().Sub(entry.Created) <= entry.TTL {
+		return CacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *Cache) Set(key string, cacheData CacheEntry) {
+	/* Stores a new cache entry, evicting the least recently used unpinned ones when that takes the cache past maxEntries
+	or maxBytes. A body that can't fit in maxBytes on its own isn't stored, and neither is one that would only fit
+	by evicting pinned entries.*/
+	cacheData.hits = new(atomic.Int64)
+	if !c.local() {
+		// Nothing in this process indexes a shared store's entries, so the old one needs no unlinking first.
+		c.store.Set(key, cacheData)
+		c.recordVary(cacheData)
+		return
+	}
+	c.mu.Lock()
+	if c.maxBytes > 0 && int64(len(cacheData.Response)) > c.maxBytes {
+		// The old entry goes all the same: it is outdated by the response that replaced it.
+		if old, found := c.store.Get(key); found {
+			c.remove(key, old)
+		}
+		c.mu.Unlock()
+		return
+	}
+	if cacheData.BaseKey != "" {
+		// Counted before the old entry goes, so replacing a URL's only variant doesn't forget its Vary in between.
+		if c.variants == nil {
+			c.variants = map[string]int{}
+		}
+		c.variants[cacheData.BaseKey]++
+	}
+	if old, found := c.store.Get(key); found {
+		c.remove(key, old)
+	}
+	if c.bodies != nil {
+		cacheData.BodyHash, cacheData.Response = c.shareBody(cacheData.Response)
+	} else {
+		c.usedBytes += int64(len(cacheData.Response))
+	}
+	if cacheData.Pinned && c.pinnedCount >= c.maxPinned {
+		cacheData.Pinned = false
+	}
+	c.store.Set(key, cacheData)
+	if cacheData.Pinned {
+		c.pinnedCount++
+	} else {
+		c.track(key)
+	}
+	for name, value := range cacheData.Metadata {
+		if c.metaIndex == nil {
+			c.metaIndex = map[string]map[string]struct{}{}
+		}
+		indexKey := metaIndexKey(name, value)
+		if c.metaIndex[indexKey] == nil {
+			c.metaIndex[indexKey] = map[string]struct{}{}
+		}
+		c.metaIndex[indexKey][key] = struct{}{}
+	}
+	c.recordVary(cacheData)
+	evicted := c.evictOverflow()
+	if c.maxBytes > 0 && c.usedBytes > c.maxBytes {
+		// Only pinned entries are left, and they leave no room for this one.
+		if entry, found := c.store.Get(key); found {
+			c.remove(key, entry)
+		}
+	}
+	c.mu.Unlock()
+	c.notifyEvicted(evicted)
+}
+
+func (c *Cache) shareBody(body []byte) (string, []byte) {
+	/* Looks the body up by its SHA-256 hash and returns the stored copy, adding it when unseen.
+	Identical bodies cached under different keys end up backed by the same slice.
+	Must be called with the write lock held.*/
+	hash := bodyHash(body)
+	shared, found := c.bodies[hash]
+	if !found {
+		shared = &sharedBody{data: body}
+		c.bodies[hash] = shared
+		c.usedBytes += int64(len(body))
+	}
+	shared.refs++
+	return hash, shared.data
+}
+
+func bodyHash(body []byte) string {
+	// Returns the hex SHA-256 of a response body, identifying bodies by content.
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) remove(key string, entry CacheEntry) {
+	/* Deletes an entry and drops its reference to a shared body, freeing the body once unreferenced.
+	Must be called holding storeLocker.*/
+	c.store.Delete(key)
+	c.untrack(key)
+	for name, value := range entry.Metadata {
+		if keys := c.metaIndex[metaIndexKey(name, value)]; keys != nil {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(c.metaIndex, metaIndexKey(name, value))
+			}
+		}
+	}
+	if !c.local() {
+		return
+	}
+	if entry.Pinned {
+		c.pinnedCount--
+	}
+	if c.bodies == nil {
+		c.usedBytes -= int64(len(entry.Response))
+	}
+	if entry.BaseKey != "" {
+		c.variants[entry.BaseKey]--
+		if c.variants[entry.BaseKey] <= 0 {
+			delete(c.variants, entry.BaseKey)
+			c.variesMu.Lock()
+			delete(c.varies, entry.BaseKey)
+			c.variesMu.Unlock()
+		}
+	}
+	if entry.BodyHash == "" || c.bodies == nil {
+		return
+	}
+	if shared, found := c.bodies[entry.BodyHash]; found {
+		shared.refs--
+		if shared.refs <= 0 {
+			delete(c.bodies, entry.BodyHash)
+			c.usedBytes -= int64(len(shared.data))
+		}
+	}
+}
+
+func metaIndexKey(name, value string) string {
+	// Builds the metadata index key for a name/value pair.
+	return name + ":" + value
+}
+
+func (c *Cache) InvalidateByMeta(name, value string) int {
+	// Removes every entry whose metadata has name set to value, using the metadata index. Returns how many were removed.
+	l := c.storeLocker()
+	l.Lock()
+	defer l.Unlock()
+	if !c.local() {
+		// A shared store also holds entries other instances wrote, which this instance's index has never seen.
+		return c.removeMatching(func(entry CacheEntry) bool { return entry.Metadata[name] == value })
+	}
+	keys := c.metaIndex[metaIndexKey(name, value)]
+	removed := 0
+	for key := range keys {
+		if entry, found := c.store.Get(key); found {
+			c.remove(key, entry)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *Cache) InvalidateByPath(pattern string) int {
+	// Removes every entry stored for a path matching the glob pattern. Returns how many were removed.
+	l := c.storeLocker()
+	l.Lock()
+	defer l.Unlock()
+	return c.removeMatching(func(entry CacheEntry) bool { return globMatch(pattern, entry.Path) })
+}
+
+func (c *Cache) removeMatching(match func(CacheEntry) bool) int {
+	/* Removes every entry match accepts and returns how many were removed. Matches are collected first
+	so the store is not modified while it is being walked. Must be called holding storeLocker.*/
+	matched := map[string]CacheEntry{}
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		if match(entry) {
+			matched[key] = entry
+		}
+		return true
+	})
+	for key, entry := range matched {
+		c.remove(key, entry)
+	}
+	return len(matched)
+}
+
+func (c *Cache) ClearCache() {
+	//Clears all entries in the cache.
+	l := c.storeLocker()
+	l.Lock()
+	defer l.Unlock()
+	c.store.Clear()
+	if c.bodies != nil {
+		for h := range c.bodies {
+			delete(c.bodies, h)
+		}
+	}
+	for m := range c.metaIndex {
+		delete(c.metaIndex, m)
+	}
+	clear(c.variants)
+	c.usedBytes, c.pinnedCount = 0, 0
+	c.variesMu.Lock()
+	for k := range c.varies {
+		delete(c.varies, k)
+	}
+	c.variesMu.Unlock()
+	c.recencyMu.Lock()
+	c.recency, c.elements = nil, nil
+	c.recencyMu.Unlock()
+	c.summaryMu.Lock()
+	c.summarized = time.Time{}
+	c.summaryMu.Unlock()
+}
+
+func (p *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	/*
+		Handles incoming requests.
+		First checks the cache for a response:
+		If a cache hit occurs, the response is served directly with an X-Cache: HIT header, even if the client has already gone away.
+		A hit for a conditional request whose If-None-Match matches the cached ETag is answered with 304.
+		A hit whose Content-Encoding the client doesn't accept is decompressed or refetched, see negotiateEncoding.
+		A miss for a request whose context is already cancelled is dropped without contacting the upstream.
+		On a cache miss, the request is forwarded to the targetHost, and the response is cached for future requests.
+		An expired entry with an ETag or Last-Modified is revalidated with a conditional request instead, see addValidators.
+		Only one request per missing or expired key goes upstream; the others wait for its result, see joinFetch.
+		Responses include headers and the body from the upstream server.
+		Large responses can be streamed instead of buffered, see streams.
+		A request carrying the bypass header skips the cache and is fetched fresh with X-Cache: BYPASS, see BypassHeader.
+		With honorNoCache, so does a request with Cache-Control: no-cache or Pragma: no-cache, as a MISS whose response is stored.
+		A PURGE request removes the GET and HEAD entries for its URL instead of being proxied, see purgeHandler.
+		Once graceful shutdown has begun, new requests get 503 instead, see rejectShuttingDown.
+	*/
+	if p.rejectShuttingDown(w) {
+		return
+	}
+	if r.Method == methodPurge {
+		p.writePurged(w, r.URL.String(), p.purgeRequest(r, []string{http.MethodGet, http.MethodHead}))
+		return
+	}
+	if p.logHeaders {
+		log.Printf("Request headers for %s: %v", r.URL.Path, redactHeaders(r.Header, p.redactHeaders))
+	}
+	if r.Method == http.MethodPost && p.keyOptions.PostKey != "query" {
+		if err := bufferRequestBody(r); err != nil {
+			http.Error(w, "Error while reading request body", http.StatusBadRequest)
+			return
+		}
+	}
+	cache := p.cacheFor(r.URL.Path)
+	baseKey := generateCacheKey(r, p.keyOptions)
+	key := cache.variantKey(baseKey, p.variantHeaders(r))
+	if p.debugKeys {
+		p.logKeyInput(r, baseKey, key)
+	}
+	bypass := p.bypass.matches(r)
+	reload := !bypass && p.honorNoCache && clientNoCache(r.Header)
+	previous, revalidating := cache.GetExpired(key)
+	if bypass || reload {
+		// Both want the upstream's full answer, not a 304 confirming the expired copy.
+		revalidating = false
+	} else if entry, found := p.lookup(r, key); found && p.serveHit(w, r, baseKey, entry) {
+		return
+	}
+	if err := r.Context().Err(); err != nil {
+		log.Printf("Dropping cache miss for %s: %v", r.URL.Path, err)
+		return
+	}
+	var fetchErr error
+	shared := !bypass && p.cacheableMethod(r)
+	if shared {
+		served, finish := p.joinFetch(w, r, baseKey, key, revalidating)
+		if served {
+			return
+		}
+		defer func() { finish(fetchErr) }()
+	}
+	if p.fetchLock != nil && shared && !cache.local() {
+		served, release := p.awaitFetch(w, r, baseKey, key)
+		if served {
+			return
+		}
+		defer release()
+	}
+	if bypass {
+		p.setCacheStatus(w, "BYPASS")
+		log.Printf("Cache bypass for %s", r.URL.Path)
+	} else {
+		p.setCacheStatus(w, "MISS")
+		p.stats.misses.Add(1)
+		log.Printf("Cache miss for %s", r.URL.Path)
+	}
+	client := p.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	targetUrl := p.targetURL(r)
+
+	parent := r.Context()
+	if shared {
+		// Other requests may be waiting on this fetch, so it outlives its own client; the client's Timeout and readTimeout still bound it.
+		parent = context.WithoutCancel(parent)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetUrl, r.Body)
+	if err != nil {
+		http.Error(w, "Error while creating request", http.StatusInternalServerError)
+		return
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		req.ContentLength = r.ContentLength
+	}
+	for header, values := range r.Header {
+		for _, val := range values {
+			req.Header.Add(header, val)
+		}
+	}
+	removeHopByHop(req.Header)
+	if p.forwardedHeaders {
+		setForwardedHeaders(req.Header, r)
+	}
+	conditional := revalidating && (r.Method != http.MethodPost || p.revalidatePost) && addValidators(req, r, previous)
+
+	if p.limiter != nil {
+		release, err := p.limiter.acquire(r.Context())
+		if err != nil {
+			http.Error(w, "Upstream busy", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+
+	if p.preserveHost {
+		req.Host = r.Host
+	}
+	if p.upstreamEncoding != "" {
+		req.Header.Set("Accept-Encoding", p.upstreamEncoding)
+	}
+
+	upstreamStart := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		p.stats.upstreamErrors.Add(1)
+		fetchErr = err
+		if p.serveStale(w, r, key, warnRevalidationFailed) {
+			return
+		}
+		p.gatewayError(w, r, http.StatusBadGateway, "Error while sending request")
+		return
+	}
+	defer resp.Body.Close()
+	p.stats.recordUpstreamStatus(resp.StatusCode)
+	if sanitizeHeaders(resp.Header) {
+		log.Printf("Sanitized malformed upstream response headers for %s", r.URL.Path)
+	}
+	removeHopByHop(resp.Header)
+	if p.logHeaders {
+		log.Printf("Upstream response headers for %s: %v", r.URL.Path, redactHeaders(resp.Header, p.redactHeaders))
+	}
+
+	readTimedOut, stopReadTimer := p.readTimer(resp, cancel)
+	defer stopReadTimer()
+
+	if p.streams(r, resp) {
+		body, complete, broken := p.streamResponse(w, r, resp)
+		if broken != nil {
+			fetchErr = broken
+			// Returning would end the chunked body, or the short Content-Length one, as if it were whole;
+			// the server recovers this panic by dropping the connection.
+			panic(http.ErrAbortHandler)
+		}
+		if !complete {
+			return
+		}
+		if revalidating {
+			p.recordRevalidation(r, previous, resp.StatusCode, body)
+		}
+		if !bypass || p.bypass.Store {
+			p.storeResponse(r, baseKey, resp, body)
+		}
+		return
+	}
+
+	buf, err := p.bodyBuffers.readAll(resp.Body)
+	defer p.bodyBuffers.put(buf)
+	body := buf.Bytes()
+	if err != nil {
+		p.stats.upstreamErrors.Add(1)
+		fetchErr = err
+	}
+	if err != nil && readTimedOut() {
+		log.Printf("Timed out reading upstream body for %s: nothing received for %s", r.URL.Path, p.readTimeout)
+		p.gatewayError(w, r, http.StatusGatewayTimeout, "Upstream response timed out")
+		return
+	}
+	if err != nil {
+		p.gatewayError(w, r, http.StatusBadGateway, "Error while reading body")
+		return
+	}
+	if resp.StatusCode >= http.StatusInternalServerError && p.serveStale(w, r, key, warnRevalidationFailed) {
+		return
+	}
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		p.serveRevalidated(w, r, key, previous, resp)
+		return
+	}
+	upstreamDuration := time.Since(upstreamStart)
+	if revalidating {
+		p.recordRevalidation(r, previous, resp.StatusCode, body)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		p.passNotModified(w, r, resp)
+		return
+	}
+	if !bypass || p.bypass.Store {
+		p.storeResponse(r, baseKey, resp, body)
+	}
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	p.cookieRewrite.apply(w.Header())
+	body = decodeForClient(r, w.Header(), body)
+	if p.serverTiming {
+		w.Header().Add("Server-Timing", `cache;desc="MISS"`)
+		w.Header().Add("Server-Timing", fmt.Sprintf("upstream;dur=%.1f", float64(upstreamDuration.Microseconds())/1000))
+	}
+	p.writeBody(w, r, resp.StatusCode, body)
+}
+
+func (p *ProxyServer) readTimer(resp *http.Response, cancel context.CancelFunc) (timedOut func() bool, stop func()) {
+	/* Calls cancel, which must cancel the upstream request, once resp's body has gone readTimeout without delivering a byte,
+	so an upstream that sends headers and then stalls can't hold a fetch forever, while a large body that keeps arriving,
+	however slowly, is never cut off. Wraps resp.Body to see the reads; timedOut reports whether the timer fired.*/
+	var fired atomic.Bool
+	if p.readTimeout <= 0 {
+		return fired.Load, func() {}
+	}
+	timer := time.AfterFunc(p.readTimeout, func() {
+		fired.Store(true)
+		cancel()
+	})
+	resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, timer: timer, timeout: p.readTimeout}
+	return fired.Load, func() { timer.Stop() }
+}
+
+type idleTimeoutBody struct { //An upstream body that pushes back its read timer whenever bytes arrive.
+	io.ReadCloser
+	timer   *time.Timer   //timer: Cancels the upstream request when it fires.
+	timeout time.Duration //timeout: How long the body may stall.
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	// Reads from the body and restarts the timer if anything came in.
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (p *ProxyServer) serveHit(w http.ResponseWriter, r *http.Request, baseKey string, entry CacheEntry) bool {
+	/* Answers the request from a cache entry. Returns false without writing anything when the entry's
+	Content-Encoding can't be served to the client, in which case the request is treated as a miss.*/
+	entry, ok := p.negotiateEncoding(r, entry)
+	if !ok {
+		log.Printf("Cached encoding for %s not accepted by client, refetching", r.URL.Path)
+		return false
+	}
+	log.Printf("Cache hit for %s", r.URL.Path)
+	p.setCacheStatus(w, "HIT")
+	p.stats.hits.Add(1)
+	for k, v := range entry.Headers {
+		w.Header()[k] = v
+	}
+	p.setAge(w, entry)
+	p.cookieRewrite.apply(w.Header())
+	if p.serverTiming {
+		w.Header().Set("Server-Timing", `cache;desc="HIT"`)
+	}
+	if notModified(r, entry) {
+		p.refreshIfExpiring(r, baseKey, entry)
+	}
+	if entry.MetadataOnly || notModified(r, entry) {
+		p.writeMetadata(w, r, entry)
+		return true
+	}
+	p.writeBody(w, r, entry.Status, entry.Response)
+	return true
+}
+
+func (p *ProxyServer) setAge(w http.ResponseWriter, entry CacheEntry) {
+	/* Reports how long a hit has been cached: X-Cache-Age is the time in this cache, in whole seconds, and Age (RFC 7234, section 5.1)
+	adds that to the Age the upstream sent, so a response that was already old when fetched doesn't look fresh.*/
+	resident := int64(p.cache.clock().Sub(entry.Created) / time.Second)
+	w.Header().Set("X-Cache-Age", strconv.FormatInt(resident, 10))
+	age := resident
+	if upstream, err := strconv.ParseInt(entry.Headers.Get("Age"), 10, 64); err == nil && upstream > 0 {
+		age += upstream
+	}
+	w.Header().Set("Age", strconv.FormatInt(age, 10))
+}
+
+func (p *ProxyServer) targetURL(r *http.Request) string {
+	// Builds the upstream URL for a request: the targetHost, or in forward proxy mode the request's own scheme and host, followed by the request path and query.
+	targetPath := r.URL.Path
+	if p.collapseForward {
+		targetPath = collapseSlashes(targetPath)
+	}
+	targetUrl := p.targetHost + targetPath
+	if p.forward.forwards(r) {
+		targetUrl = r.URL.Scheme + "://" + r.URL.Host + targetPath
+	}
+
+	if r.URL.RawQuery != "" {
+		targetUrl += "?" + r.URL.RawQuery
+	}
+	return targetUrl
+}
+
+func (p *ProxyServer) storeResponse(r *http.Request, baseKey string, resp *http.Response, body []byte) {
+	/* Caches an upstream response under baseKey, or under its variant when the response carries Vary, unless its Cache-Control forbids storing it or the cache rules say otherwise.
+	Only statuses in cacheableStatuses are stored by default; a matching rule can still cache others.
+	The TTL comes from the rules, else Retry-After for a 503 or the Last-Modified heuristic when enabled,
+	else the longest matching ttl-rule path, else the content-type TTLs, else defaultTTL.*/
+	if !p.cacheableMethod(r) {
+		return
+	}
+	if p.memoryGuard != nil && !p.memoryGuard.allowWrite() {
+		return
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		// A range fragment shares its key with the full resource and must never be served as the full body.
+		return
+	}
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode < http.StatusOK {
+		// A 304 answers the client's own validators and has no body of its own; stored, it would replay an empty response.
+		return
+	}
+	if r.Method == http.MethodHead && (resp.ContentLength < 0 || p.keyOptions.OmitMethod) {
+		/* Without a body or a Content-Length there is nothing to answer later HEADs with.
+		Without the method in the key a HEAD entry would replace the GET entry, which answers HEADs anyway.*/
+		return
+	}
+	if forbidsCaching(resp.Header) {
+		return
+	}
+	varyNames, varyAny := varyHeaders(resp.Header)
+	if varyAny {
+		// Vary: * means no later request can be known to match this response.
+		return
+	}
+	ttl := p.defaultTTL
+	if contentTTL, ok := contentTypeTTLFor(resp.Header, p.contentTypeTTLs); ok {
+		ttl = contentTTL
+	}
+	if ruleTTL, ok := p.pathTTLs.lookup(r.URL.Path); ok {
+		ttl = ruleTTL
+	}
+	if p.heuristicCaching {
+		if heuristic, ok := heuristicTTL(resp.Header, p.heuristicMaxTTL, p.cache.clock()); ok {
+			ttl = heuristic
+		}
+	}
+	decision := CacheDecision{Cache: p.cacheableStatus(resp.StatusCode), TTL: ttl}
+	if p.cacheRetryAfter && resp.StatusCode == http.StatusServiceUnavailable {
+		// A short negative cache: repeat requests get the same 503 until the upstream said to retry.
+		if retry, ok := retryAfter(resp.Header, p.cache.clock()); ok {
+			decision = CacheDecision{Cache: true, TTL: retry}
+		}
+	}
+	if p.rules != nil {
+		if matched, found := p.rules.Evaluate(r, resp); found {
+			fallbackTTL := decision.TTL
+			decision = matched
+			if decision.TTL == 0 {
+				decision.TTL = fallbackTTL
+			}
+		}
+	}
+	if !decision.Cache {
+		return
+	}
+	entry := CacheEntry{
+		Response: bytes.Clone(body),   // body may live in a pooled buffer that is reused after this request.
+		Headers:  resp.Header.Clone(), // A copy, so header writes while serving a hit never reach the stored entry.
+		Status:   resp.StatusCode,
+		Created:  p.cache.clock(),
+		TTL:      decision.TTL,
+		Size:     len(body),
+		Path:     r.URL.Path,
+		BaseKey:  baseKey,
+		Vary:     varyNames,
+		Pinned:   p.pinned(r.URL.Path),
+	}
+	if p.keyOptions.perClient() {
+		entry.URLKey = generateCacheKey(r, p.keyOptions.urlOnly())
+	}
+	dropLegacyPragma(entry.Headers)
+	for name, header := range p.metaHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			if entry.Metadata == nil {
+				entry.Metadata = map[string]string{}
+			}
+			entry.Metadata[name] = value
+		}
+	}
+	if p.metadataAbove > 0 && len(body) > p.metadataAbove {
+		entry.Response = nil
+		entry.MetadataOnly = true
+	}
+	if r.Method == http.MethodHead {
+		// A HEAD response has no body; what it tells about the GET body is its Content-Length.
+		entry.Response = nil
+		entry.MetadataOnly = true
+		entry.Size = int(resp.ContentLength)
+	}
+	if p.compressBodies && !entry.MetadataOnly {
+		entry.Response, entry.Compressed = p.gzipWriters.compressBody(resp.Header, entry.Response)
+	}
+	p.cacheFor(r.URL.Path).Set(variantKey(baseKey, p.variantHeaders(r), varyNames), entry)
 }
 
-type Cache struct { //Stores cached data and handles cache operations.
-	store map[string]CacheEntry //store: A map with keys (unique identifiers) and values (cached entries).
-	mu    sync.RWMutex          //A mutex to ensure thread-safe access to the cache.
+func (p *ProxyServer) refreshIfExpiring(r *http.Request, key string, entry CacheEntry) {
+	/*
+		Starts a background refetch of an entry that was just used to answer a conditional request with 304
+		but expires within refreshWindow, so the next unconditional GET finds a fresh body.
+		At most one refresh per key runs at a time, and at most cap(refreshSlots) overall; the client's response is never delayed.
+		A refresh takes an upstream slot from the limiter like any fetch and is bounded by readTimeout once its headers are in;
+		all of it must finish within refreshWindow, by which time the entry has expired and the next request refetches anyway.
+		key is the key before Vary is applied, as storeResponse expects.
+	*/
+	if p.refreshWindow <= 0 || r.Method != http.MethodGet || entry.TTL-p.cache.clock().Sub(entry.Created) > p.refreshWindow {
+		return
+	}
+	if _, busy := p.refreshing.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, p.targetURL(r), nil)
+	if err != nil {
+		p.refreshing.Delete(key)
+		return
+	}
+	req.Header = r.Header.Clone()
+	removeHopByHop(req.Header)
+	if p.forwardedHeaders {
+		setForwardedHeaders(req.Header, r)
+	}
+	if p.preserveHost {
+		req.Host = r.Host
+	}
+	if p.upstreamEncoding != "" {
+		req.Header.Set("Accept-Encoding", p.upstreamEncoding)
+	}
+	// The refresh needs the full body, not another 304.
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if p.refreshSlots != nil {
+		select {
+		case p.refreshSlots <- struct{}{}:
+		default:
+			// Dropped rather than queued: the entry keeps being served and gets refreshed by a later 304, or revalidated once it expires.
+			p.refreshing.Delete(key)
+			return
+		}
+	}
+	go func() {
+		defer p.refreshing.Delete(key)
+		if p.refreshSlots != nil {
+			defer func() { <-p.refreshSlots }()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), p.refreshWindow)
+		defer cancel()
+		if p.limiter != nil {
+			release, err := p.limiter.acquire(ctx)
+			if err != nil {
+				log.Printf("Background refresh for %s found no free upstream slot: %v", r.URL.Path, err)
+				return
+			}
+			defer release()
+		}
+		client := p.client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			p.stats.upstreamErrors.Add(1)
+			log.Printf("Background refresh for %s failed: %v", r.URL.Path, err)
+			return
+		}
+		defer resp.Body.Close()
+		p.stats.recordUpstreamStatus(resp.StatusCode)
+		sanitizeHeaders(resp.Header)
+		removeHopByHop(resp.Header)
+		readTimedOut, stopReadTimer := p.readTimer(resp, cancel)
+		defer stopReadTimer()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil && readTimedOut() {
+			log.Printf("Background refresh for %s timed out: nothing received for %s", r.URL.Path, p.readTimeout)
+			return
+		}
+		if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+			log.Printf("Background refresh for %s failed: status %d, %v", r.URL.Path, resp.StatusCode, err)
+			return
+		}
+		p.recordRevalidation(r, entry, resp.StatusCode, body)
+		p.storeResponse(r, key, resp, body)
+		log.Printf("Refreshed %s in the background", r.URL.Path)
+	}()
 }
 
-type CacheEntry struct { //Represents a single cache entry.
+func (p *ProxyServer) setCacheStatus(w http.ResponseWriter, status string) {
+	// Reports the cache status (HIT, MISS, ...) using the configured header name and value mapping.
+	name := p.statusHeader
+	if name == "" {
+		name = "X-Cache"
+	}
+	if mapped, found := p.statusValues[status]; found {
+		status = mapped
+	}
+	w.Header().Set(name, status)
+}
 
-	Response []byte        //Response: The response body.
-	Headers  http.Header   //Headers: HTTP headers for the response.
-	TTL      time.Duration //TTL: Duration for which the entry is valid.
-	Created  time.Time     //Created: Timestamp when the entry was cached.
+func parseStatusValues(list string) (map[string]string, error) {
+	// Parses a comma-separated list of STATUS=value pairs, e.g. "HIT=TCP_HIT,MISS=TCP_MISS".
+	values := map[string]string{}
+	for _, pair := range splitList(list) {
+		status, value, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(status) == "" || strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("invalid cache status mapping %q, want STATUS=value", pair)
+		}
+		values[strings.ToUpper(strings.TrimSpace(status))] = strings.TrimSpace(value)
+	}
+	return values, nil
 }
 
-func generateCacheKey(r *http.Request) string {
-	/* Generates a unique cache key for each HTTP request.
-	Combines the request URL and method, hashed using MD5.*/
-	hasher := md5.New()
-	io.WriteString(hasher, r.URL.String())
-	io.WriteString(hasher, r.Method)
-	return hex.EncodeToString(hasher.Sum(nil))
+func (p *ProxyServer) cacheableMethod(r *http.Request) bool {
+	/*
+		Invariant: only requests whose method is cacheable ever read from or write to the cache.
+		The cacheable methods are cacheableMethods, GET and HEAD when unset.
+		The key covers URL and method but not the body, so caching other methods would let two POSTs with
+		different bodies collide. POST is therefore cacheable only when its body is part of the key (-post-key body or both),
+		which main enforces when building cacheableMethods.
+		lookup and storeResponse both check this, so no code path can bypass it.
+	*/
+	if p.cacheableMethods == nil {
+		return r.Method == http.MethodGet || r.Method == http.MethodHead
+	}
+	return p.cacheableMethods[r.Method]
 }
 
-func (c *Cache) Get(cacheKey string) (CacheEntry, bool) {
-	/* Fetches a cache entry if it exists and hasn’t expired. Deletes expired entries.*/
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	entry, found := c.store[cacheKey]
-	if !found {
-		return CacheEntry{}, false
+func (p *ProxyServer) cacheableStatus(code int) bool {
+	// Reports whether responses with this status are cached by default, using defaultCacheableStatus when cacheableStatuses is unset.
+	if p.cacheableStatuses == nil {
+		return defaultCacheableStatus[code]
 	}
-	if time.Since(entry.Created) > entry.TTL {
-		delete(c.store, cacheKey)
-		return CacheEntry{}, false
+	return p.cacheableStatuses[code]
+}
+
+func parseStatusList(list string) (map[int]bool, error) {
+	// Parses a comma-separated list of status codes into a set.
+	statuses := map[int]bool{}
+	for _, item := range splitList(list) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", item)
+		}
+		statuses[code] = true
 	}
-	return entry, true
+	return statuses, nil
 }
 
-func (c *Cache) Set(key string, cacheData CacheEntry) {
-	// Stores a new cache entry.
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.store[key] = cacheData
+func onlySafeMethods(methods map[string]bool) bool {
+	// Reports whether GET and HEAD are the only methods in the set, so the method adds nothing to a cache key.
+	for method := range methods {
+		if method != http.MethodGet && method != http.MethodHead {
+			return false
+		}
+	}
+	return true
 }
 
-func (c *Cache) ClearCache() {
-	//Clears all entries in the cache.
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	for k := range c.store {
-		delete(c.store, k)
+func parseMethods(list string) map[string]bool {
+	// Parses a comma-separated list of HTTP methods into a set, upper-casing each.
+	methods := map[string]bool{}
+	for _, method := range splitList(list) {
+		methods[strings.ToUpper(method)] = true
 	}
+	return methods
 }
 
-func (p *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+func (p *ProxyServer) lookup(r *http.Request, key string) (CacheEntry, bool) {
 	/*
-		Handles incoming requests.
-		First checks the cache for a response:
-		If a cache hit occurs, the response is served directly with an X-Cache: HIT header.
-		On a cache miss, the request is forwarded to the targetHost, and the response is cached for future requests.
-		Responses include headers and the body from the upstream server.
+		Finds a cache entry that can answer the request.
+		A HEAD without an entry of its own is answered from the GET entry for the same URL.
+		Metadata-only entries answer HEAD and conditional requests only; anything else needs the body from the upstream.
 	*/
-	key := generateCacheKey(r)
-	if entry, found := p.cache.Get(key); found {
-		log.Printf("Cache hit for %s", r.URL.Path)
-		w.Header().Add("X-Cache", "HIT")
-		for k, v := range entry.Headers {
-			w.Header()[k] = v
-		}
-		w.Write(entry.Response)
-		return
+	if !p.cacheableMethod(r) {
+		return CacheEntry{}, false
+	}
+	cache := p.cacheFor(r.URL.Path)
+	entry, found := cache.Get(key)
+	if !found && r.Method == http.MethodHead {
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		entry, found = cache.Get(cache.variantKey(generateCacheKey(get, p.keyOptions), p.variantHeaders(get)))
+	}
+	if !found {
+		return CacheEntry{}, false
 	}
-	w.Header().Add("X-Cache", "MISS")
-	log.Printf("Cache miss for %s", r.URL.Path)
-	client := &http.Client{}
+	if entry.MetadataOnly && r.Method != http.MethodHead && !notModified(r, entry) {
+		return CacheEntry{}, false
+	}
+	return entry, true
+}
 
-	targetUrl := p.targetHost + r.URL.Path
+func notModified(r *http.Request, entry CacheEntry) bool {
+	// Reports whether the request's If-None-Match matches the cached entry's ETag, ignoring weak-validator prefixes.
+	etag := strings.TrimPrefix(entry.Headers.Get("ETag"), "W/")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if etag == "" || ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
 
-	if r.URL.RawQuery != "" {
-		targetUrl += "?" + r.URL.RawQuery
+func (p *ProxyServer) serveStale(w http.ResponseWriter, r *http.Request, key, warning string) bool {
+	/* Serves an expired entry still within the max-stale window, marked with warning: when the upstream errors or answers 5xx
+	(stale-if-error), or while another instance holds the fetch lock for the key.*/
+	entry, found := p.cacheFor(r.URL.Path).GetStale(key)
+	if !found || entry.MetadataOnly {
+		return false
+	}
+	entry, ok := expandEntry(r, entry)
+	if !ok {
+		return false
+	}
+	log.Printf("Serving stale entry for %s: %s", r.URL.Path, warning)
+	p.setCacheStatus(w, "STALE")
+	for k, v := range entry.Headers {
+		w.Header()[k] = v
 	}
+	p.cookieRewrite.apply(w.Header())
+	p.addStaleWarning(w, warning)
+	p.writeBody(w, r, entry.Status, entry.Response)
+	return true
+}
 
-	req, err := http.NewRequest(r.Method, targetUrl, r.Body)
-	if err != nil {
-		http.Error(w, "Error while creating request", http.StatusInternalServerError)
+func (p *ProxyServer) addStaleWarning(w http.ResponseWriter, warning string) {
+	// Marks a stale response with an RFC 7234 Warning header, unless stale warnings are switched off.
+	if p.staleWarnings {
+		w.Header().Add("Warning", warning)
 	}
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Error while sending request", http.StatusInternalServerError)
+func (p *ProxyServer) writeMetadata(w http.ResponseWriter, r *http.Request, entry CacheEntry) {
+	/* Answers from the entry's headers alone: 304 for a matching conditional request, otherwise a HEAD with
+	the original status and Content-Length.*/
+	if r.Method == http.MethodHead && !notModified(r, entry) {
+		w.Header().Set("Content-Length", strconv.Itoa(entry.Size))
+		applyHeaderCase(w.Header(), p.headerCase)
+		w.WriteHeader(statusOrOK(entry.Status))
+		return
 	}
+	w.Header().Del("Content-Length")
+	applyHeaderCase(w.Header(), p.headerCase)
+	w.WriteHeader(http.StatusNotModified)
+}
 
-	for header, values := range r.Header {
-		for _, val := range values {
-			req.Header.Add(header, val)
-		}
+func (p *ProxyServer) writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	/*
+		Writes a fully buffered response body with an explicit Content-Length and the given status, 0 meaning 200.
+		HTTP/1.0 clients cannot read chunked responses, so the length is what delimits the body for them;
+		it also lets a 1.0 client that sent Connection: keep-alive reuse the connection.
+		When http10KeepAlive is off, 1.0 connections are always closed after the response.
+		204 and 304 never carry a body: a 204 gets no Content-Length at all, and a 304 keeps the upstream's, which
+		describes the full representation. So does the Content-Length of an empty upstream answer to a HEAD.
+	*/
+	w.Header().Del("Transfer-Encoding")
+	bodyless := status == http.StatusNoContent || status == http.StatusNotModified
+	switch {
+	case status == http.StatusNoContent:
+		w.Header().Del("Content-Length")
+	case bodyless, r.Method == http.MethodHead && len(body) == 0 && w.Header().Get("Content-Length") != "":
+	default:
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if !r.ProtoAtLeast(1, 1) && !p.http10KeepAlive {
+		w.Header().Set("Connection", "close")
 	}
+	applyHeaderCase(w.Header(), p.headerCase)
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	if !bodyless {
+		n, _ := w.Write(body)
+		p.stats.bytesServed.Add(int64(n))
+	}
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Error while reading body", http.StatusInternalServerError)
+func (p *ProxyServer) invalidateHandler(w http.ResponseWriter, r *http.Request) {
+	// A dedicated endpoint (POST /admin/invalidate?meta=name:value) removing all entries with matching metadata.
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	p.cache.Set(key, CacheEntry{
-		Response: body,
-		Headers:  req.Header,
-		Created:  time.Now(),
-		TTL:      p.defaultTTL,
-	})
+	name, value, found := strings.Cut(r.URL.Query().Get("meta"), ":")
+	if !found || name == "" {
+		http.Error(w, "meta must be name:value", http.StatusBadRequest)
+		return
+	}
+	removed := 0
+	for _, c := range p.caches() {
+		removed += c.InvalidateByMeta(name, value)
+	}
+	log.Printf("Invalidated %d entries with %s:%s", removed, name, value)
+	fmt.Fprintf(w, "Invalidated %d entries", removed)
+}
 
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+func parseMetaHeaders(list string) map[string]string {
+	/* Parses a comma-separated list of name=Header pairs; a bare header name is used as its own
+	lowercased metadata name, e.g. "version=X-Content-Version,X-Team".*/
+	headers := map[string]string{}
+	for _, item := range splitList(list) {
+		name, header, found := strings.Cut(item, "=")
+		if !found {
+			name, header = strings.ToLower(item), item
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(header)
 	}
-	w.Write([]byte(body))
+	return headers
 }
 
 func (p *ProxyServer) clearCacheHandler(w http.ResponseWriter, r *http.Request) {
 	// A dedicated endpoint (/clear-cache) to clear all cached entries.
-	p.cache.ClearCache()
+	for _, c := range p.caches() {
+		c.ClearCache()
+	}
 	log.Println("Cache cleared")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Cache cleared"))
 }
 
+func splitList(list string) []string {
+	// Splits a comma-separated flag value, trimming spaces and dropping empty items.
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseTTL(value string) (time.Duration, error) {
+	// Parses the ttl flag. A zero or negative TTL would make every entry expire at once, so it is rejected rather than used.
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("%q must be positive", value)
+	}
+	return ttl, nil
+}
+
+func checkDurations(durations map[string]time.Duration) error {
+	// Rejects negative values of duration flags, keyed by flag name; zero keeps its documented meaning.
+	for _, name := range slices.Sorted(maps.Keys(durations)) {
+		if durations[name] < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", name, durations[name])
+		}
+	}
+	return nil
+}
+
 func main() {
 	// Port for the server & Target URL where the requests should be forwarded
 	port := flag.Int("port", 8080, "")
 	targetHost := flag.String("target", "", "Requests to be forwarded on the server")
+	forwardHosts := flag.String("forward-hosts", "", "Comma-separated host globs clients may reach with absolute-form URIs (GET http://host/path), making this a forward proxy; \"*\" allows any host")
 	ttl := flag.String("ttl", "5m", "Time to live for cached data")
+	http10KeepAlive := flag.Bool("http10-keepalive", true, "Allow HTTP/1.0 clients that send Connection: keep-alive to reuse their connection")
+	sweepInterval := flag.Duration("sweep-interval", time.Minute, "How often expired entries are removed in the background, 0 to only remove them when requested again (memory backend only: Redis expires entries itself)")
+	cacheFile := flag.String("cache-file", "", "Save the cache to this file on shutdown and load it on startup, dropping expired entries")
+	cacheFileCompression := flag.String("cache-file-compression", "none", "How to compress the cache file: none, gzip or zstd; any of them is loaded back regardless")
+	backend := flag.String("backend", "memory", "Where cache entries are stored: memory (per instance) or redis (shared between instances)")
+	routeBackends := flag.String("route-backends", "", "Comma-separated glob=backend pairs storing matching paths in another backend than -backend, e.g. /media/*=redis; the first match wins")
+	fetchLockWait := flag.Duration("fetch-lock", 0, "With the redis backend, let one instance at a time fetch a missing key while the others wait up to this long for its entry, 0 to disable")
+	bypassHeader := flag.String("bypass-header", "", `Request header that makes the proxy skip the cache and fetch fresh, as "Name: value" or "Name" for any value`)
+	honorNoCache := flag.Bool("honor-client-no-cache", false, "Refetch instead of serving a hit when the request has Cache-Control: no-cache, max-age=0 or Pragma: no-cache")
+	bypassStore := flag.Bool("bypass-store", true, "Whether a response fetched because of bypass-header replaces the cached entry")
+	redisAddr := flag.String("redis-addr", "localhost:6379", "Address of the Redis server used by the redis backend")
+	redisTimeout := flag.Duration("redis-timeout", 500*time.Millisecond, "Time limit for each call to Redis, after which it counts as a miss or a skipped write, 0 for none")
+	redisCooldown := flag.Duration("redis-cooldown", 10*time.Second, "After 5 failed Redis calls in a row, pass requests through without trying Redis for this long before probing it again, 0 to always try")
+	exposeExpvars := flag.Bool("expvar", false, "Serve hits, misses, entries and upstream errors through the expvar package at /debug/vars, along with Go's memstats and the command line")
+	compressBodies := flag.Bool("compress-bodies", false, "Store compressible response bodies gzipped; clients accepting gzip get them compressed, others decompressed")
+	compressLevel := flag.Int("compress-level", gzip.DefaultCompression, "gzip level for compress-bodies, from 1 (fastest) to 9 (smallest), or -1 for gzip's default")
+	dedupBodies := flag.Bool("dedup-bodies", false, "Store identical response bodies once, shared between cache entries")
+	forwardedHeaders := flag.Bool("forwarded-headers", true, "Send the client's address, scheme and host upstream in X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host")
+	preserveHost := flag.Bool("preserve-host", false, "Forward the client's Host header to the target; the Host then also becomes part of the cache key")
+	cacheableMethods := flag.String("cacheable-methods", "GET,HEAD", "Comma-separated methods whose responses are cached; all others are always forwarded")
+	cacheableStatus := flag.String("cacheable-status", "200,203,300,301,404,410", "Comma-separated upstream status codes that are cached; others are forwarded uncached unless a cache rule says otherwise")
+	revalidatePost := flag.Bool("revalidate-post", false, "Revalidate expired POST entries with If-None-Match/If-Modified-Since on a replay of the POST body, serving the cached body on 304")
+	postKey := flag.String("post-key", "query", "What identifies a POST in the cache key: query, body or both")
+	serverTiming := flag.Bool("server-timing", false, "Add a Server-Timing header with the cache status and upstream duration")
+	maxUpstream := flag.Int("max-upstream", 0, "Maximum concurrent upstream fetches, 0 for unlimited")
+	warmupPeriod := flag.Duration("warmup-period", 0, "Period after startup during which warmup-concurrency applies")
+	warmupConcurrency := flag.Int("warmup-concurrency", 4, "Maximum concurrent upstream fetches during the warmup period")
+	gzipMismatch := flag.String("gzip-mismatch", "decompress", "How to serve a gzip-cached entry to a client not accepting gzip: decompress or refetch")
+	metadataAbove := flag.Int("metadata-only-above", 0, "Cache only headers for bodies larger than this many bytes, 0 to always cache bodies")
+	upstreamHTTPVersion := flag.String("upstream-http-version", "auto", "HTTP version for upstream requests: 1.1, 2 (requires h2 over https) or auto")
+	omitMethod := flag.Bool("key-omit-method", false, "Leave the method out of cache keys while only GET and HEAD are cacheable")
+	normalizeQuery := flag.Bool("normalize-query", false, "Sort query parameters in the cache key, so the same parameters in another order hit the same entry")
+	collapse := flag.String("collapse-slashes", "off", "Collapse repeated slashes in paths: off, key (cache key only) or forward (cache key and upstream path)")
+	upstreamTimeout := flag.Duration("upstream-timeout", 0, "Overall time limit for an upstream request, 0 for none")
+	dialTimeout := flag.Duration("dial-timeout", 30*time.Second, "Time limit for connecting to the upstream")
+	keepAlive := flag.Duration("keepalive", 30*time.Second, "TCP keep-alive interval for upstream connections")
+	deviceKey := flag.Bool("device-key", false, "Cache mobile, tablet and desktop clients separately based on User-Agent")
+	maxRequestBody := flag.Int64("max-request-body", 0, "Reject request bodies larger than this many bytes with 413, 0 for no limit")
+	maxChunkedBody := flag.String("max-chunked-request-body", "10M", "Without max-request-body, buffer chunked request bodies up to this size (e.g. 10M) to forward them with a Content-Length, rejecting larger ones with 413; 0 forwards them chunked")
+	tenantKey := flag.String("tenant-key", "", "Keep tenants apart in the cache by a tenant ID from header:Name (e.g. header:X-Tenant-ID) or path:N (the Nth path segment)")
+	authPartition := flag.Bool("auth-partition", false, "Share cache entries between anonymous requests and isolate authenticated ones per user")
+	keyHeaderList := flag.String("key-headers", "", "Comma-separated request headers whose values are part of every cache key, e.g. Accept-Language")
+	authHeaders := flag.String("auth-headers", "Authorization", "Comma-separated request headers that mark a request as authenticated")
+	authCookies := flag.String("auth-cookies", "", "Comma-separated cookie names that mark a request as authenticated")
+	readTimeout := flag.Duration("response-read-timeout", 0, "Longest an upstream body may go without sending any data after its headers arrive, 0 for none; slow but steady bodies are never cut off")
+	statusHeader := flag.String("cache-status-header", "X-Cache", "Name of the response header reporting the cache status")
+	statusValues := flag.String("cache-status-values", "", "Comma-separated STATUS=value pairs renaming cache statuses, e.g. HIT=TCP_HIT,MISS=TCP_MISS")
+	maxEntries := flag.Int("max-entries", 10000, "Maximum number of cache entries, pinned ones aside; the least recently used are evicted beyond it, 0 for no limit (memory backend only). Bounds the count, not the size: see max-bytes")
+	maxBytes := flag.String("max-bytes", "1G", "Maximum total size of cached bodies (e.g. 512M); the least recently used entries are evicted beyond it, 0 for no limit (memory backend only)")
+	pinPaths := flag.String("pin-paths", "", "Comma-separated path globs whose entries are never evicted to make room, only dropped when they expire (memory backend only)")
+	pinnedSize := flag.Int("pinned-size", 10, "Maximum number of pinned entries; further pin-paths matches are cached as regular entries")
+	maxStale := flag.Duration("max-stale", 0, "How long past expiry an entry may still be served when the upstream fails, 0 to never serve stale")
+	debugKeys := flag.Bool("debug-keys", false, "Log every request's cache key and the input it was hashed from, with credentials redacted")
+	logHeaders := flag.Bool("log-headers", false, "Log request and upstream response headers, with credentials redacted")
+	redact := flag.String("redact-headers", "", "Comma-separated extra headers to redact in logs, besides Authorization, Cookie and Set-Cookie")
+	heuristicCaching := flag.Bool("heuristic-caching", false, "Use 10% of the time since Last-Modified as TTL when the upstream sends no max-age or Expires")
+	heuristicMaxTTL := flag.Duration("heuristic-max-ttl", 24*time.Hour, "Upper bound for heuristic TTLs")
+	maxRefreshes := flag.Int("max-background-refreshes", 0, "Most background refreshes (refresh-on-304) running at once; more are skipped until a slot frees up, 0 for no limit")
+	refreshWindow := flag.Duration("refresh-on-304", 0, "Refresh entries in the background when they answer a conditional request within this long of expiry, 0 to disable")
+	segmentPattern := flag.String("key-segment-pattern", "", "Regular expression for path segments replaced by a placeholder in the cache key, e.g. ^[0-9]+$")
+	var ttlRules pathTTLs
+	flag.Var(&ttlRules, "ttl-rule", "TTL for request paths starting with a prefix or matching a glob, as /path=ttl; repeat for more rules, the longest match wins")
+	contentTypeTTL := flag.String("content-type-ttl", "", "Comma-separated type=ttl pairs overriding ttl by response media type, e.g. \"image/*=24h, text/html=1m\"")
+	cacheRetryAfter := flag.Bool("cache-retry-after", false, "Cache 503 responses with a Retry-After header for the Retry-After duration")
+	staleWarnings := flag.Bool("stale-warnings", true, "Add a Warning header (110/111) to responses served stale")
+	upstreamEncoding := flag.String("upstream-accept-encoding", "", "Send this Accept-Encoding upstream instead of the client's: gzip or identity, empty to leave it alone")
+	streamThreshold := flag.String("stream-threshold", "0", "Stream upstream responses larger than this (e.g. 1M), or of unknown length, to the client instead of buffering them, 0 to always buffer")
+	streamCacheMax := flag.String("stream-cache-max", "10M", "Streamed responses up to this size are still cached; larger ones pass through uncached")
+	bodyPoolMax := flag.String("body-pool-max", "1M", "Pool buffers for reading upstream bodies up to this size (e.g. 1M) to reduce allocations, 0 to disable pooling")
+	minFreeMem := flag.String("min-free-mem", "0", "Skip cache writes while available system memory is below this size (e.g. 512M), 0 to disable")
+	metaHeaders := flag.String("meta-headers", "", "Comma-separated name=Header pairs stored as entry metadata for purging, e.g. version=X-Content-Version")
+	maxURLLength := flag.Int("max-url-length", 0, "Reject request URLs longer than this many bytes with 414, 0 for no limit")
+	maxHeaderBytes := flag.Int("max-header-bytes", 0, "Reject requests whose headers exceed this many bytes with 431, 0 for no limit")
+	maxResponseBody := flag.Int64("max-response-body", 0, "Replace upstream responses larger than this many bytes with 502, 0 for no limit")
+	cookieDomain := flag.String("rewrite-cookie-domain", "", "Rewrite the Domain of Set-Cookie headers from the target, as from=to; an empty to drops the Domain")
+	cookiePath := flag.String("rewrite-cookie-path", "", "Rewrite the Path prefix of Set-Cookie headers from the target, as from=to")
+	scheduledPurge := flag.String("scheduled-purge", "", "Semicolon-separated rules of a cron expression and a path glob whose entries are purged at those times, e.g. \"0 2 * * * /homepage\"")
+	shutdownDrain := flag.Duration("shutdown-drain", 0, "On SIGTERM, keep answering new requests with 503 for this long before closing the listener")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "On SIGTERM, how long in-flight requests may take to finish")
+	logRevalidations := flag.Bool("log-revalidations", false, "Log whether each refetch of an expired entry returned a changed or an unchanged body")
+	allowPaths := flag.String("allow-paths", "", "Comma-separated path globs; when set, only matching paths are proxied and all others get 403")
+	denyPaths := flag.String("deny-paths", "", "Comma-separated path globs answered with 403 instead of being proxied, e.g. /admin*")
+	headerCase := flag.String("header-case", "", "Comma-separated response header names to send in exactly this casing, e.g. X-API-Key, for clients that depend on it")
+	errorTemplate := flag.String("error-template", "", "Template file rendered for 502 and 504 responses; .html files are served to clients accepting text/html, others as text/plain")
+	rulesFile := flag.String("cache-rules", "", "File of rules deciding per response whether and how long to cache")
 	flag.Parse()
 
-	if *targetHost == "" {
+	if *targetHost == "" && *forwardHosts == "" {
 		log.Fatal("Target host is required")
 	}
 
-	duration, _ := time.ParseDuration(*ttl)
+	duration, err := parseTTL(*ttl)
+	if err != nil {
+		log.Fatalf("Invalid TTL duration: %v", err)
+	}
+	if err := checkDurations(map[string]time.Duration{
+		"warmup-period":         *warmupPeriod,
+		"upstream-timeout":      *upstreamTimeout,
+		"dial-timeout":          *dialTimeout,
+		"keepalive":             *keepAlive,
+		"response-read-timeout": *readTimeout,
+		"max-stale":             *maxStale,
+		"heuristic-max-ttl":     *heuristicMaxTTL,
+		"refresh-on-304":        *refreshWindow,
+		"shutdown-drain":        *shutdownDrain,
+		"shutdown-timeout":      *shutdownTimeout,
+		"fetch-lock":            *fetchLockWait,
+		"sweep-interval":        *sweepInterval,
+		"redis-timeout":         *redisTimeout,
+		"redis-cooldown":        *redisCooldown,
+	}); err != nil {
+		log.Fatalf("Invalid duration: %v", err)
+	}
+
+	if *maxEntries < 0 {
+		log.Fatalf("Invalid max-entries %d: must be 0 or more", *maxEntries)
+	}
+	if *pinnedSize < 0 {
+		log.Fatalf("Invalid pinned-size %d: must be 0 or more", *pinnedSize)
+	}
+	cacheBytes, err := parseByteSize(*maxBytes)
+	if err != nil {
+		log.Fatalf("Invalid max-bytes: %v", err)
+	}
+	routes, err := parseRouteBackends(*routeBackends)
+	if err != nil {
+		log.Fatalf("Invalid route-backends: %v", err)
+	}
+	var fetchLock FetchLock
+	openBackend := func(backend string) *Cache {
+		// Creates the cache of a backend named by -backend or route-backends.
+		cache := &Cache{
+			store:      MemoryStore{},
+			maxStale:   *maxStale,
+			maxEntries: *maxEntries,
+			maxBytes:   int64(cacheBytes),
+			maxPinned:  *pinnedSize,
+		}
+		switch backend {
+		case "memory":
+			if *dedupBodies {
+				cache.bodies = map[string]*sharedBody{}
+			}
+		case "redis":
+			store, err := NewRedisStore(*redisAddr, *maxStale, *redisTimeout, *redisCooldown)
+			if err != nil {
+				log.Fatalf("Connecting to Redis at %s: %v", *redisAddr, err)
+			}
+			cache.store = store
+			// Redis bounds the shared cache itself (maxmemory-policy); this instance sees only the keys it wrote.
+			cache.maxEntries, cache.maxBytes = 0, 0
+			fetchLock = NewRedisLock(store)
+		default:
+			log.Fatalf("Invalid backend %q: must be memory or redis", backend)
+		}
+		return cache
+	}
+	caches := map[string]*Cache{*backend: openBackend(*backend)}
+	for i, route := range routes {
+		if caches[route.backend] == nil {
+			caches[route.backend] = openBackend(route.backend)
+		}
+		routes[i].cache = caches[route.backend]
+	}
+	memoryCache := caches["memory"]
+	if *dedupBodies && memoryCache == nil {
+		log.Fatal("dedup-bodies needs the memory backend: bodies are shared within one process only")
+	}
+	if *cacheFile != "" && memoryCache == nil {
+		log.Fatal("cache-file needs the memory backend: Redis keeps the shared cache across restarts itself")
+	}
+	if *fetchLockWait > 0 && fetchLock == nil {
+		log.Fatal("fetch-lock needs the redis backend: it coordinates instances sharing one cache")
+	}
+	if *cacheFile != "" {
+		loaded, err := memoryCache.LoadFile(*cacheFile)
+		if err != nil {
+			log.Fatalf("Loading cache file: %v", err)
+		}
+		log.Printf("Loaded %d cache entries from %s", loaded, *cacheFile)
+	}
+
+	if *postKey != "query" && *postKey != "body" && *postKey != "both" {
+		log.Fatalf("Invalid post-key %q: must be query, body or both", *postKey)
+	}
+	methods := parseMethods(*cacheableMethods)
+	if *postKey != "query" {
+		// Keying POSTs by their body is an explicit opt-in to caching them.
+		methods[http.MethodPost] = true
+	} else if methods[http.MethodPost] {
+		log.Fatal("Invalid cacheable-methods: POST can only be cached with -post-key body or both")
+	} else if *revalidatePost {
+		log.Fatal("Invalid revalidate-post: POST is only cached with -post-key body or both")
+	}
+
+	if c := *cacheFileCompression; c != "none" && c != "gzip" && c != "zstd" {
+		log.Fatalf("Invalid cache-file-compression %q: must be none, gzip or zstd", c)
+	}
+	if *gzipMismatch != "decompress" && *gzipMismatch != "refetch" {
+		log.Fatalf("Invalid gzip-mismatch %q: must be decompress or refetch", *gzipMismatch)
+	}
+
+	if *collapse != "off" && *collapse != "key" && *collapse != "forward" {
+		log.Fatalf("Invalid collapse-slashes %q: must be off, key or forward", *collapse)
+	}
+
+	if *upstreamEncoding != "" && *upstreamEncoding != "gzip" && *upstreamEncoding != "identity" {
+		log.Fatalf("Invalid upstream-accept-encoding %q: must be gzip or identity", *upstreamEncoding)
+	}
+
+	minFree, err := parseByteSize(*minFreeMem)
+	if err != nil {
+		log.Fatalf("Invalid min-free-mem: %v", err)
+	}
+	chunkedMax, err := parseByteSize(*maxChunkedBody)
+	if err != nil {
+		log.Fatalf("Invalid max-chunked-request-body: %v", err)
+	}
+
+	statusMapping, err := parseStatusValues(*statusValues)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tenantHeader, tenantSegment, err := parseTenantKey(*tenantKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keyHeaders, err := parseKeyHeaders(*keyHeaderList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	statuses, err := parseStatusList(*cacheableStatus)
+	if err != nil {
+		log.Fatalf("Invalid cacheable-status: %v", err)
+	}
+
+	contentTTLs, err := parseContentTypeTTLs(*contentTypeTTL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	purgeSchedules, err := parsePurgeSchedules(*scheduledPurge)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var cookieRewrite CookieRewrite
+	if cookieRewrite.DomainFrom, cookieRewrite.DomainTo, err = parseRewrite(*cookieDomain); err != nil {
+		log.Fatalf("Invalid rewrite-cookie-domain: %v", err)
+	}
+	if cookieRewrite.PathFrom, cookieRewrite.PathTo, err = parseRewrite(*cookiePath); err != nil {
+		log.Fatalf("Invalid rewrite-cookie-path: %v", err)
+	}
+
+	bypass, err := parseBypassHeader(*bypassHeader, *bypassStore)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var segmentRegexp *regexp.Regexp
+	if *segmentPattern != "" {
+		if segmentRegexp, err = regexp.Compile(*segmentPattern); err != nil {
+			log.Fatalf("Invalid key-segment-pattern: %v", err)
+		}
+	}
+
+	transport, err := newUpstreamTransport(*upstreamHTTPVersion, *dialTimeout, *keepAlive)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var rules *RuleSet
+	if *rulesFile != "" {
+		rules, err = loadCacheRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("Invalid cache rules: %v", err)
+		}
+	}
 
 	p := &ProxyServer{
 		targetHost: *targetHost,
-		cache: &Cache{
-			store: map[string]CacheEntry{},
-		},
+		cache:      caches[*backend],
 		defaultTTL: duration,
+		client:     &http.Client{Transport: transport, Timeout: *upstreamTimeout},
+
+		cacheableMethods:  methods,
+		cacheableStatuses: statuses,
+
+		http10KeepAlive: *http10KeepAlive,
+		preserveHost:    *preserveHost,
+		rules:           rules,
+		keyOptions: KeyOptions{
+			PostKey:         *postKey,
+			CollapseSlashes: *collapse != "off",
+			NormalizeQuery:  *normalizeQuery,
+			DeviceClass:     *deviceKey,
+			SegmentPattern:  segmentRegexp,
+			AuthPartition:   *authPartition,
+			AuthHeaders:     splitList(*authHeaders),
+			AuthCookies:     splitList(*authCookies),
+			Host:            *preserveHost,
+			OmitMethod:      *omitMethod && onlySafeMethods(methods),
+			TenantHeader:    tenantHeader,
+			TenantSegment:   tenantSegment,
+			Headers:         keyHeaders,
+		},
+		serverTiming:    *serverTiming,
+		gzipMismatch:    *gzipMismatch,
+		metadataAbove:   *metadataAbove,
+		collapseForward: *collapse == "forward",
+		readTimeout:     *readTimeout,
+
+		statusHeader: *statusHeader,
+		statusValues: statusMapping,
+
+		logHeaders:    *logHeaders,
+		redactHeaders: splitList(*redact),
+		pinPaths:      splitList(*pinPaths),
+		debugKeys:     *debugKeys,
+
+		heuristicCaching: *heuristicCaching,
+		heuristicMaxTTL:  *heuristicMaxTTL,
+		cacheRetryAfter:  *cacheRetryAfter,
+
+		contentTypeTTLs: contentTTLs,
+		pathTTLs:        ttlRules,
+
+		refreshWindow: *refreshWindow,
+		staleWarnings: *staleWarnings,
+
+		revalidatePost: *revalidatePost,
+
+		upstreamEncoding: *upstreamEncoding,
+
+		metaHeaders: parseMetaHeaders(*metaHeaders),
+		limits: Limits{
+			MaxURLLength:    *maxURLLength,
+			MaxHeaderBytes:  *maxHeaderBytes,
+			MaxRequestBody:  *maxRequestBody,
+			MaxChunkedBody:  int64(chunkedMax),
+			MaxResponseBody: *maxResponseBody,
+		},
+		access: PathAccess{
+			Allow: splitList(*allowPaths),
+			Deny:  splitList(*denyPaths),
+		},
+		cookieRewrite: cookieRewrite,
+
+		logRevalidations: *logRevalidations,
+
+		headerCase: splitList(*headerCase),
+
+		forwardedHeaders: *forwardedHeaders,
+
+		bypass:       bypass,
+		honorNoCache: *honorNoCache,
+
+		compressBodies: *compressBodies,
+
+		cacheRoutes: routes,
+
+		forward: ForwardProxy{
+			Hosts:    splitList(*forwardHosts),
+			Required: *targetHost == "",
+		},
+	}
+	if *errorTemplate != "" {
+		if p.errorPage, err = loadErrorPage(*errorTemplate); err != nil {
+			log.Fatalf("Invalid error template: %v", err)
+		}
+	}
+	threshold, err := parseByteSize(*streamThreshold)
+	if err != nil {
+		log.Fatalf("Invalid stream-threshold: %v", err)
+	}
+	streamMax, err := parseByteSize(*streamCacheMax)
+	if err != nil {
+		log.Fatalf("Invalid stream-cache-max: %v", err)
+	}
+	p.streamThreshold, p.streamCacheMax = int64(threshold), int64(streamMax)
+	poolMax, err := parseByteSize(*bodyPoolMax)
+	if err != nil {
+		log.Fatalf("Invalid body-pool-max: %v", err)
+	}
+	if poolMax > 0 {
+		p.bodyBuffers = newBufferPool(int(poolMax))
+	}
+	if *compressBodies {
+		if p.gzipWriters, err = newGzipPool(*compressLevel); err != nil {
+			log.Fatalf("Invalid compress-level: %v", err)
+		}
+	}
+	if *fetchLockWait > 0 {
+		p.fetchLock = fetchLock
+		p.fetchLockWait = *fetchLockWait
+	}
+	if minFree > 0 {
+		p.memoryGuard = newMemoryGuard(minFree)
+	}
+	if *maxRefreshes > 0 {
+		p.refreshSlots = make(chan struct{}, *maxRefreshes)
+	}
+	// Background work stops before the cache file is saved, so nothing purges or sweeps the cache while it is written.
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+	if len(purgeSchedules) > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			p.runScheduledPurges(backgroundCtx, purgeSchedules)
+		}()
+	}
+	if *maxUpstream > 0 || *warmupPeriod > 0 {
+		p.limiter = newUpstreamLimiter(*maxUpstream, *warmupConcurrency, *warmupPeriod)
 	}
 
 	log.Printf("Starting proxy server on port %d", *port)
-	log.Printf("Proxying requests to %s", *targetHost)
+	if *targetHost != "" {
+		log.Printf("Proxying requests to %s", *targetHost)
+	}
+	if len(p.forward.Hosts) > 0 {
+		log.Printf("Forward proxying to %s", strings.Join(p.forward.Hosts, ", "))
+	}
 
-	http.HandleFunc("/", p.handleProxy)
-	http.HandleFunc("/clear-cache", p.clearCacheHandler)
+	proxy := p.forward.middleware(p.access.middleware(p.limits.middleware(http.HandlerFunc(p.handleProxy))))
+	admin := http.NewServeMux()
+	admin.HandleFunc("/clear-cache", p.clearCacheHandler)
+	admin.HandleFunc("/admin/invalidate", p.invalidateHandler)
+	admin.HandleFunc("/purge", p.purgeHandler)
+	admin.HandleFunc("/stats", p.statsHandler)
+	admin.HandleFunc("/cache-stats", p.cacheStatsHandler)
+	admin.Handle("/metrics", p.metricsHandler())
+	if *exposeExpvars {
+		// Without the flag /debug/vars is proxied like any other path, and cmdline and memstats stay private.
+		p.publishExpvars()
+		admin.Handle(expvarPath, expvar.Handler())
+	}
 
 	serverPort := fmt.Sprintf(":%d", *port)
-	log.Fatal(http.ListenAndServe(serverPort, nil))
+	srv := &http.Server{Addr: serverPort, Handler: routeRequests(admin, proxy, p.forward)}
+	if *sweepInterval > 0 && memoryCache != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			memoryCache.runSweeper(backgroundCtx, *sweepInterval)
+		}()
+	}
+	if err := p.serveUntilSignal(srv, *shutdownDrain, *shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+	stopBackground()
+	background.Wait()
+	if *cacheFile != "" {
+		if err := memoryCache.SaveFile(*cacheFile, *cacheFileCompression); err != nil {
+			log.Fatalf("Saving cache file: %v", err)
+		}
+		log.Printf("Saved cache to %s", *cacheFile)
+	}
+	log.Printf("Proxy server stopped")
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestProxy(t *testing.T, upstream http.HandlerFunc) *ProxyServer {
+	// Returns a proxy with an in-memory cache in front of an httptest server running upstream, closed when t ends.
+	srv := httptest.NewServer(upstream)
+	t.Cleanup(srv.Close)
+	return &ProxyServer{targetHost: srv.URL, cache: &Cache{store: MemoryStore{}}, defaultTTL: time.Minute}
+}
+
+func serveTest(t *testing.T, h http.Handler) *httptest.Server {
+	// Runs h, usually the proxy behind its middleware, on a real server, for tests that need connection-level behaviour.
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func do(p *ProxyServer, r *http.Request) *httptest.ResponseRecorder {
+	// Sends r straight to handleProxy and returns the recorded response.
+	rec := httptest.NewRecorder()
+	p.handleProxy(rec, r)
+	return rec
+}
+
+func get(p *ProxyServer, target string) *httptest.ResponseRecorder {
+	// Sends a GET for target straight to handleProxy.
+	return do(p, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func entryCount(c *Cache) int {
+	// Returns how many entries c holds.
+	return c.Summary().Entries
+}
+
+type fakeClock struct { //A settable clock for Cache.now, so tests age entries without sleeping.
+	now time.Time //now: The current fake time.
+}
+
+func newFakeClock(c *Cache) *fakeClock {
+	// Installs a fake clock on c starting at the real current time.
+	clock := &fakeClock{now: time.Now()}
+	c.now = func() time.Time { return clock.now }
+	return clock
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	// Moves the fake time forward by d.
+	f.now = f.now.Add(d)
+}
+
+func captureLog(t *testing.T) *strings.Builder {
+	// Redirects the standard logger into the returned builder until t ends.
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	// Reads and closes resp's body, failing t on error.
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetadataOnlyEntryAnswersHeadButNotGet(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("ETag", `"big"`)
+		w.Write([]byte(strings.Repeat("x", 5000)))
+	})
+	p.metadataAbove = 1000
+
+	if rec := get(p, "/big"); rec.Body.Len() != 5000 {
+		t.Fatalf("first GET body = %d bytes, want 5000", rec.Body.Len())
+	}
+	head := do(p, httptest.NewRequest(http.MethodHead, "/big", nil))
+	if head.Code != http.StatusOK || head.Header().Get("X-Cache") != "HIT" || head.Header().Get("Content-Length") != "5000" {
+		t.Fatalf("HEAD = %d %v, want a 200 HIT with Content-Length 5000", head.Code, head.Header())
+	}
+	if rec := get(p, "/big"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.Len() != 5000 {
+		t.Fatalf("second GET = %s with %d bytes, want a full MISS", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("upstream fetches = %d, want 2", n)
+	}
+}
+
+func TestMetadataOnlyHeadKeepsCachedStatus(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(strings.Repeat("x", 5000)))
+	})
+	p.metadataAbove = 1000
+	get(p, "/gone")
+	head := do(p, httptest.NewRequest(http.MethodHead, "/gone", nil))
+	if head.Header().Get("X-Cache") != "HIT" || head.Code != http.StatusNotFound {
+		t.Fatalf("HEAD = %d %s, want the cached 404 as a HIT", head.Code, head.Header().Get("X-Cache"))
+	}
+}
+
+func TestParseTTLRejectsInvalidDurations(t *testing.T) {
+	if ttl, err := parseTTL("90s"); err != nil || ttl != 90*time.Second {
+		t.Fatalf("parseTTL(90s) = %v, %v", ttl, err)
+	}
+	for _, value := range []string{"", "10", "ten minutes", "0s", "-1m"} {
+		if ttl, err := parseTTL(value); err == nil {
+			t.Errorf("parseTTL(%q) = %v, want an error", value, ttl)
+		}
+	}
+}
+
+func TestCheckDurationsRejectsNegativeFlags(t *testing.T) {
+	if err := checkDurations(map[string]time.Duration{"max-stale": 0, "lock-wait": time.Second}); err != nil {
+		t.Fatalf("valid durations rejected: %v", err)
+	}
+	err := checkDurations(map[string]time.Duration{"max-stale": -time.Second})
+	if err == nil || !strings.Contains(err.Error(), "max-stale") {
+		t.Fatalf("err = %v, want one naming max-stale", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const memoryCheckInterval = time.Second // How long a free-memory reading is reused before /proc/meminfo is read again.
+
+type memoryGuard struct { //Pauses cache writes while the host is short on available memory.
+	minFree   uint64                 //minFree: Cache writes are skipped while available memory is below this many bytes.
+	available func() (uint64, error) //available: Reports available system memory in bytes; readMemAvailable by default.
+
+	mu      sync.Mutex //mu: Guards the cached reading below.
+	checked time.Time  //checked: When available memory was last read.
+	low     bool       //low: Whether the last reading was below minFree.
+}
+
+func newMemoryGuard(minFree uint64) *memoryGuard {
+	// Creates a guard reading available memory from /proc/meminfo.
+	return &memoryGuard{minFree: minFree, available: readMemAvailable}
+}
+
+func (g *memoryGuard) allowWrite() bool {
+	/* Reports whether the cache may store a new entry. Available memory is re-read at most once per
+	memoryCheckInterval; if it can't be read at all, writes are allowed so the guard never disables caching by accident.*/
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.checked) < memoryCheckInterval {
+		return !g.low
+	}
+	g.checked = time.Now()
+	free, err := g.available()
+	if err != nil {
+		return true
+	}
+	low := free < g.minFree
+	if low != g.low {
+		if low {
+			log.Printf("Available memory %d bytes is below %d, pausing cache writes", free, g.minFree)
+		} else {
+			log.Printf("Available memory recovered to %d bytes, resuming cache writes", free)
+		}
+	}
+	g.low = low
+	return !low
+}
+
+func readMemAvailable() (uint64, error) {
+	// Returns MemAvailable from /proc/meminfo in bytes.
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+func parseByteSize(size string) (uint64, error) {
+	// Parses a byte count with an optional K, M or G suffix (powers of 1024), e.g. "512M".
+	size = strings.ToUpper(strings.TrimSpace(size))
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(size, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(size, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(size, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseUint(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryGuardPausesCacheWrites(t *testing.T) {
+	var free atomic.Uint64
+	free.Store(64 << 20)
+	guard := &memoryGuard{minFree: 256 << 20, available: func() (uint64, error) { return free.Load(), nil }}
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	p.memoryGuard = guard
+
+	if rec := get(p, "/a"); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("response under memory pressure = %d %q, want it served", rec.Code, rec.Body.String())
+	}
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("%d entries stored while memory was low", n)
+	}
+
+	free.Store(1 << 30)
+	guard.checked = time.Time{} // Skip the reuse interval so the recovery is noticed now.
+	get(p, "/a")
+	if rec := get(p, "/a"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("cache writes did not resume after memory recovered")
+	}
+}
+
+func TestMemoryGuardReusesReadings(t *testing.T) {
+	var reads atomic.Int32
+	guard := &memoryGuard{minFree: 1, available: func() (uint64, error) { reads.Add(1); return 0, nil }}
+	for range 100 {
+		if guard.allowWrite() {
+			t.Fatal("write allowed below the minimum")
+		}
+	}
+	if n := reads.Load(); n != 1 {
+		t.Fatalf("available memory read %d times within one interval, want once", n)
+	}
+}
+
+func TestMemoryGuardAllowsWritesWhenMemoryIsUnknown(t *testing.T) {
+	guard := &memoryGuard{minFree: 1 << 30, available: func() (uint64, error) { return 0, errors.New("no /proc") }}
+	if !guard.allowWrite() {
+		t.Fatal("an unreadable memory reading disabled caching")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]uint64{"512": 512, "4k": 4 << 10, "512M": 512 << 20, " 2G ": 2 << 30} {
+		if got, err := parseByteSize(in); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "M", "1.5G", "-1", "10T"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) accepted", in)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"container/list"
 	"crypto/md5"
 	"encoding/hex"
 	"flag"
@@ -8,6 +9,8 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,13 +20,30 @@ type ProxyServer struct {
 	cache      *Cache
 	defaultTTL time.Duration
 	client     *http.Client
+	pinPaths   []string
 }
 
 type Cache struct {
-	store    map[string]CacheEntry
-	mu       sync.RWMutex
-	maxSize  int
-	eviction chan string
+	store   map[string]CacheEntry
+	mu      sync.RWMutex
+	maxSize int
+	policy  string // Eviction policy: "lru" (default), "lfu" or "fifo".
+
+	// Limit on the summed length of all cached bodies (0 for none) and the
+	// current sum.
+	maxBytes  int
+	usedBytes int
+
+	// Unpinned keys in recency order, most recently used at the front
+	// (insertion order under fifo), and each key's element for O(1) moves
+	// and removals.
+	recency  *list.List
+	elements map[string]*list.Element
+
+	// Pinned entries never enter the eviction queue; they are limited by
+	// their own budget instead of maxSize.
+	maxPinned   int
+	pinnedCount int
 }
 
 type CacheEntry struct {
@@ -31,6 +51,8 @@ type CacheEntry struct {
 	Headers  http.Header
 	TTL      time.Duration
 	Created  time.Time
+	Pinned   bool
+	Hits     int // Number of cache hits, used by the lfu policy.
 }
 
 func generateCacheKey(r *http.Request) string {
@@ -40,33 +62,109 @@ func generateCacheKey(r *http.Request) string {
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-// Get retrieves a cache entry if it exists and hasn't expired.
+// Get retrieves a cache entry if it exists and hasn't expired, recording
+// the hit for the eviction policy: lru moves the entry to the front of the
+// recency list, lfu counts it, fifo ignores it. Recording a hit mutates the
+// cache, so Get takes the write lock.
 func (c *Cache) Get(cacheKey string) (CacheEntry, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	entry, found := c.store[cacheKey]
-	if !found || time.Since(entry.Created) > entry.TTL {
-		if found {
-			delete(c.store, cacheKey)
-		}
+	if !found {
+		return CacheEntry{}, false
+	}
+	if time.Since(entry.Created) > entry.TTL {
+		c.remove(cacheKey, entry)
 		return CacheEntry{}, false
 	}
+	switch c.policy {
+	case "lfu":
+		entry.Hits++
+		c.store[cacheKey] = entry
+	case "fifo":
+	default:
+		if elem, ok := c.elements[cacheKey]; ok {
+			c.recency.MoveToFront(elem)
+		}
+	}
 	return entry, true
 }
 
-// Set adds a new entry to the cache and ensures size limits are maintained.
+// Set adds a new entry to the cache and ensures size limits are maintained
+// by evicting unpinned entries as chosen by the eviction policy: the entry
+// count limit for unpinned entries, and the byte limit for all bodies.
+// Pinned entries are kept out of the recency list; once the pinned budget
+// is used up, further pinned entries are stored as regular ones.
+// An entry that can't fit within maxBytes even after evicting everything
+// unpinned is not stored.
 func (c *Cache) Set(key string, cacheData CacheEntry) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if len(c.store) >= c.maxSize {
-		// Evict the oldest entry
-		oldestKey := <-c.eviction
-		delete(c.store, oldestKey)
+	if old, found := c.store[key]; found {
+		c.remove(key, old)
+	}
+
+	size := len(cacheData.Response)
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+
+	if cacheData.Pinned && c.pinnedCount >= c.maxPinned {
+		cacheData.Pinned = false
+	}
+	overCount := func() bool { return !cacheData.Pinned && len(c.store)-c.pinnedCount >= c.maxSize }
+	overBytes := func() bool { return c.maxBytes > 0 && c.usedBytes+size > c.maxBytes }
+	for (overCount() || overBytes()) && c.recency.Len() > 0 {
+		victim := c.victim()
+		c.remove(victim, c.store[victim])
+	}
+	if overBytes() {
+		// Only pinned entries are left and they leave no room.
+		return
 	}
 
 	c.store[key] = cacheData
-	c.eviction <- key
+	c.usedBytes += size
+	if cacheData.Pinned {
+		c.pinnedCount++
+		return
+	}
+	c.elements[key] = c.recency.PushFront(key)
+}
+
+// victim picks the unpinned entry to evict next: the back of the recency
+// list for lru and fifo, and for lfu the entry with the fewest hits, ties
+// going to the oldest. The caller must hold the write lock and ensure the
+// recency list is not empty.
+func (c *Cache) victim() string {
+	if c.policy != "lfu" {
+		return c.recency.Back().Value.(string)
+	}
+	var victim string
+	var least CacheEntry
+	for key := range c.elements {
+		entry := c.store[key]
+		if victim == "" || entry.Hits < least.Hits ||
+			(entry.Hits == least.Hits && entry.Created.Before(least.Created)) {
+			victim, least = key, entry
+		}
+	}
+	return victim
+}
+
+// remove deletes an entry, keeping the recency list, pinned count and
+// byte total in step. The caller must hold the write lock.
+func (c *Cache) remove(key string, entry CacheEntry) {
+	delete(c.store, key)
+	c.usedBytes -= len(entry.Response)
+	if elem, ok := c.elements[key]; ok {
+		c.recency.Remove(elem)
+		delete(c.elements, key)
+	}
+	if entry.Pinned {
+		c.pinnedCount--
+	}
 }
 
 // ClearCache clears all entries from the cache.
@@ -74,9 +172,10 @@ func (c *Cache) ClearCache() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.store = make(map[string]CacheEntry)
-	for len(c.eviction) > 0 {
-		<-c.eviction
-	}
+	c.elements = make(map[string]*list.Element)
+	c.recency.Init()
+	c.pinnedCount = 0
+	c.usedBytes = 0
 }
 
 // handleProxy handles incoming requests and serves cached or forwarded responses.
@@ -129,6 +228,7 @@ func (p *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		Headers:  resp.Header,
 		Created:  time.Now(),
 		TTL:      p.defaultTTL,
+		Pinned:   p.isPinned(r.URL.Path),
 	})
 
 	copyHeaders(resp.Header, w.Header())
@@ -143,6 +243,16 @@ func (p *ProxyServer) clearCacheHandler(w http.ResponseWriter, r *http.Request)
 	w.Write([]byte("Cache cleared"))
 }
 
+// isPinned reports whether a request path matches one of the pin globs.
+func (p *ProxyServer) isPinned(urlPath string) bool {
+	for _, pattern := range p.pinPaths {
+		if matched, _ := path.Match(pattern, urlPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // Utility function to copy headers
 func copyHeaders(src, dst http.Header) {
 	for k, v := range src {
@@ -156,6 +266,10 @@ func main() {
 	targetHost := flag.String("target", "", "Upstream server to proxy requests to")
 	ttl := flag.String("ttl", "5m", "Time to live for cached entries")
 	cacheSize := flag.Int("cache-size", 100, "Maximum number of cache entries")
+	pinPaths := flag.String("pin-paths", "", "Comma-separated path globs whose entries are never evicted")
+	pinnedSize := flag.Int("pinned-size", 10, "Maximum number of pinned cache entries")
+	maxBytes := flag.Int("max-bytes", 0, "Maximum total size of cached bodies in bytes, 0 for no limit")
+	eviction := flag.String("eviction", "lru", "Eviction policy when the cache is full: lru, lfu or fifo")
 	flag.Parse()
 
 	if *targetHost == "" {
@@ -167,10 +281,29 @@ func main() {
 		log.Fatalf("Invalid TTL duration: %v", err)
 	}
 
+	if *eviction != "lru" && *eviction != "lfu" && *eviction != "fifo" {
+		log.Fatalf("Invalid eviction policy %q: must be lru, lfu or fifo", *eviction)
+	}
+
+	var pins []string
+	for _, pattern := range strings.Split(*pinPaths, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid pin path %q: %v", pattern, err)
+		}
+		pins = append(pins, pattern)
+	}
+
 	cache := &Cache{
-		store:    make(map[string]CacheEntry),
-		eviction: make(chan string, *cacheSize),
-		maxSize:  *cacheSize,
+		store:     make(map[string]CacheEntry),
+		maxSize:   *cacheSize,
+		policy:    *eviction,
+		maxBytes:  *maxBytes,
+		recency:   list.New(),
+		elements:  make(map[string]*list.Element),
+		maxPinned: *pinnedSize,
 	}
 
 	proxy := &ProxyServer{
@@ -178,6 +311,7 @@ func main() {
 		cache:      cache,
 		defaultTTL: duration,
 		client:     &http.Client{Timeout: 10 * time.Second},
+		pinPaths:   pins,
 	}
 
 	log.Printf("Starting proxy server on port %d", *port)
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCache returns an empty cache holding at most maxSize unpinned and
+// maxPinned pinned entries, evicting by policy.
+func newTestCache(maxSize, maxPinned int, policy string) *Cache {
+	return &Cache{
+		store:     make(map[string]CacheEntry),
+		maxSize:   maxSize,
+		policy:    policy,
+		recency:   list.New(),
+		elements:  make(map[string]*list.Element),
+		maxPinned: maxPinned,
+	}
+}
+
+// fresh returns an entry that stays valid for the rest of the test.
+func fresh(body string, pinned bool) CacheEntry {
+	return CacheEntry{Response: []byte(body), TTL: time.Hour, Created: time.Now(), Pinned: pinned}
+}
+
+// cached reports whether key is in the cache, without recording a hit.
+func cached(c *Cache, key string) bool {
+	_, found := c.store[key]
+	return found
+}
+
+func TestPinnedEntriesSurviveEviction(t *testing.T) {
+	c := newTestCache(2, 1, "lru")
+	c.Set("home", fresh("home", true))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Set(key, fresh(key, false))
+	}
+	if !cached(c, "home") {
+		t.Fatal("pinned entry was evicted")
+	}
+	if cached(c, "a") || cached(c, "b") || !cached(c, "c") || !cached(c, "d") {
+		t.Fatalf("unpinned entries left: %v, want only c and d", c.elements)
+	}
+	if len(c.store) != 3 || c.pinnedCount != 1 || c.recency.Len() != 2 {
+		t.Fatalf("store %d, pinned %d, recency %d; want 3, 1, 2", len(c.store), c.pinnedCount, c.recency.Len())
+	}
+}
+
+func TestPinnedBudget(t *testing.T) {
+	c := newTestCache(1, 1, "lru")
+	c.Set("home", fresh("home", true))
+	c.Set("bundle", fresh("bundle", true))
+	if c.pinnedCount != 1 || c.store["bundle"].Pinned {
+		t.Fatal("pinned entry stored beyond the pinned budget")
+	}
+	// Over budget, bundle became a regular entry and is evicted like one.
+	c.Set("a", fresh("a", false))
+	if cached(c, "bundle") || !cached(c, "home") || !cached(c, "a") {
+		t.Fatalf("cache holds %v, want home and a", c.store)
+	}
+
+	// Replacing a pinned entry frees its slot for the next one.
+	c.Set("home", fresh("home", false))
+	c.Set("bundle", fresh("bundle", true))
+	if !c.store["bundle"].Pinned || c.pinnedCount != 1 {
+		t.Fatalf("bundle pinned = %v, pinned count %d; want the freed slot reused", c.store["bundle"].Pinned, c.pinnedCount)
+	}
+}
+
+func TestHandleProxyPinsMatchingPaths(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+	p := &ProxyServer{
+		targetHost: upstream.URL,
+		cache:      newTestCache(1, 5, "lru"),
+		defaultTTL: time.Hour,
+		client:     upstream.Client(),
+		pinPaths:   []string{"/", "/static/*.js"},
+	}
+	for _, target := range []string{"/", "/static/app.js", "/a", "/b", "/c"} {
+		p.handleProxy(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	for target, want := range map[string]bool{"/": true, "/static/app.js": true, "/a": false, "/b": false, "/c": true} {
+		entry, found := p.cache.store[generateCacheKey(httptest.NewRequest(http.MethodGet, target, nil))]
+		if found != want {
+			t.Errorf("%s cached = %v, want %v", target, found, want)
+		} else if found && entry.Pinned != (target != "/c") {
+			t.Errorf("%s pinned = %v", target, entry.Pinned)
+		}
+	}
+}
+
+func TestLRUKeepsRecentlyUsedEntries(t *testing.T) {
+	c := newTestCache(3, 0, "lru")
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, fresh(key, false))
+	}
+	for _, key := range []string{"d", "e"} {
+		if _, found := c.Get("a"); !found {
+			t.Fatalf("a evicted before %s was inserted", key)
+		}
+		c.Set(key, fresh(key, false))
+	}
+	if !cached(c, "a") || cached(c, "b") || cached(c, "c") || !cached(c, "d") || !cached(c, "e") {
+		t.Fatalf("cache holds %v, want a, d and e", c.elements)
+	}
+	if c.recency.Len() != len(c.store) || len(c.elements) != len(c.store) {
+		t.Fatalf("recency %d, elements %d, store %d; want them in step", c.recency.Len(), len(c.elements), len(c.store))
+	}
+}
+
+func TestLFUEvictsTheRarelyUsedKey(t *testing.T) {
+	c := newTestCache(3, 0, "lfu")
+	for _, key := range []string{"hot", "warm", "rare"} {
+		c.Set(key, fresh(key, false))
+	}
+	for range 5 {
+		c.Get("hot")
+	}
+	c.Get("warm")
+	c.Get("warm")
+	c.Get("rare")
+	c.Set("new", fresh("new", false))
+	if cached(c, "rare") || !cached(c, "hot") || !cached(c, "warm") || !cached(c, "new") {
+		t.Fatalf("cache holds %v, want rare evicted", c.elements)
+	}
+}
+
+func TestLFUTiesGoToTheOldest(t *testing.T) {
+	c := newTestCache(2, 0, "lfu")
+	older := fresh("older", false)
+	older.Created = time.Now().Add(-time.Minute)
+	c.Set("newer", fresh("newer", false))
+	c.Set("older", older)
+	c.Set("next", fresh("next", false))
+	if cached(c, "older") || !cached(c, "newer") {
+		t.Fatal("a tie was not broken on the oldest Created")
+	}
+}
+
+func TestFIFOIgnoresHits(t *testing.T) {
+	c := newTestCache(2, 0, "fifo")
+	c.Set("first", fresh("first", false))
+	c.Set("second", fresh("second", false))
+	c.Get("first")
+	c.Set("third", fresh("third", false))
+	if cached(c, "first") || !cached(c, "second") || !cached(c, "third") {
+		t.Fatalf("cache holds %v, want first evicted despite its hit", c.elements)
+	}
+}
+
+func TestMaxBytesBoundsCachedBodies(t *testing.T) {
+	c := newTestCache(100, 1, "lru")
+	c.maxBytes = 2500
+	for i := range 10 {
+		c.Set(string(rune('a'+i)), fresh(strings.Repeat("x", 1000), false))
+		if c.usedBytes > c.maxBytes {
+			t.Fatalf("after %d inserts %d bytes are cached, limit %d", i+1, c.usedBytes, c.maxBytes)
+		}
+	}
+	if len(c.store) != 2 || !cached(c, "i") || !cached(c, "j") {
+		t.Fatalf("cache holds %v, want the two newest entries", c.elements)
+	}
+
+	// An entry larger than the whole budget is not stored and evicts nothing.
+	c.Set("huge", fresh(strings.Repeat("x", 3000), false))
+	if cached(c, "huge") || len(c.store) != 2 {
+		t.Fatal("an entry beyond max-bytes was stored or caused evictions")
+	}
+
+	// Pinned bytes count toward the limit but are never evicted to make room.
+	c.Set("pinned", fresh(strings.Repeat("x", 2000), true))
+	if !cached(c, "pinned") || c.usedBytes != 2000 || c.recency.Len() != 0 {
+		t.Fatalf("pinned entry cached %v, %d bytes used, %d unpinned left", cached(c, "pinned"), c.usedBytes, c.recency.Len())
+	}
+	c.Set("k", fresh(strings.Repeat("x", 1000), false))
+	if cached(c, "k") || !cached(c, "pinned") {
+		t.Fatal("an entry was stored without room beside the pinned one")
+	}
+
+	c.ClearCache()
+	if c.usedBytes != 0 {
+		t.Fatalf("ClearCache left %d bytes counted", c.usedBytes)
+	}
+}
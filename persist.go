@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type cacheSnapshot struct { //The on-disk form of a cache, written with encoding/gob.
+	Entries map[string]CacheEntry //Entries: Stored entries by cache key; each carries the Vary it was selected by, from which Set rebuilds Cache.varies.
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}             // First bytes of a gzip stream.
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd} // First bytes of a zstd frame.
+)
+
+func compressFile(w io.Writer, compression string) (io.WriteCloser, error) {
+	// Wraps w in the cache-file-compression named by compression: "none", "gzip" or "zstd".
+	switch compression {
+	case "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q: must be none, gzip or zstd", compression)
+}
+
+type nopWriteCloser struct{ io.Writer } //An io.Writer whose Close does nothing, for the uncompressed cache file.
+
+func (nopWriteCloser) Close() error {
+	// Does nothing.
+	return nil
+}
+
+func (c *Cache) SaveFile(path, compression string) error {
+	/* Writes every entry to path so a restarted proxy starts warm, compressed as cache-file-compression says.
+	The file is written next to path and renamed into place, so a crash mid-write never leaves a truncated cache file behind.*/
+	l := c.storeRLocker()
+	l.Lock()
+	snapshot := cacheSnapshot{Entries: map[string]CacheEntry{}}
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		snapshot.Entries[key] = entry
+		return true
+	})
+	l.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w, err := compressFile(tmp, compression)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := gob.NewEncoder(w).Encode(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (c *Cache) LoadFile(path string) (int, error) {
+	/* Restores entries saved by SaveFile, skipping those that expired in the meantime, and returns how many were loaded.
+	A compressed file is recognised by its first bytes, so changing cache-file-compression still loads the previous file.
+	A missing file is not an error: there is simply nothing to restore on the first start.*/
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var in io.Reader = r
+	switch magic, _ := r.Peek(len(zstdMagic)); {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		in = zr
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		in = zr
+	}
+	var snapshot cacheSnapshot
+	if err := gob.NewDecoder(in).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+	loaded := 0
+	for key, entry := range snapshot.Entries {
+		if c.clock().Sub(entry.Created) > entry.TTL {
+			continue
+		}
+		c.Set(key, entry)
+		loaded++
+	}
+	return loaded, nil
+}
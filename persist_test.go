@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	saved := &Cache{store: MemoryStore{}}
+	saved.Set("fresh", CacheEntry{Response: []byte("body"), Headers: http.Header{"Etag": {`"v1"`}}, TTL: time.Hour, Created: time.Now(), Status: http.StatusNotFound})
+	saved.Set("expired", CacheEntry{Response: []byte("old"), TTL: time.Minute, Created: time.Now().Add(-time.Hour)})
+	if err := saved.SaveFile(path, "none"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Cache{store: MemoryStore{}}
+	n, err := loaded.LoadFile(path)
+	if err != nil || n != 1 {
+		t.Fatalf("LoadFile = %d, %v; want 1 entry", n, err)
+	}
+	entry, found := loaded.Get("fresh")
+	if !found || string(entry.Response) != "body" || entry.Headers.Get("ETag") != `"v1"` || entry.Status != http.StatusNotFound || entry.TTL != time.Hour {
+		t.Fatalf("restored entry = %+v, %v", entry, found)
+	}
+	if _, found := loaded.GetStale("expired"); found {
+		t.Fatal("an expired entry was restored")
+	}
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 0 {
+		t.Fatalf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestCacheFileKeepsVaryVariants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("lang " + r.Header.Get("Accept-Language")))
+	}
+	request := func(p *ProxyServer, lang string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("Accept-Language", lang)
+		return do(p, r)
+	}
+	before := newTestProxy(t, upstream)
+	request(before, "en")
+	request(before, "de")
+	if err := before.cache.SaveFile(path, "none"); err != nil {
+		t.Fatal(err)
+	}
+
+	after := newTestProxy(t, upstream)
+	if _, err := after.cache.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, lang := range []string{"en", "de"} {
+		if rec := request(after, lang); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "lang "+lang {
+			t.Fatalf("%s after restart = %s %q, want its own variant from the cache", lang, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	c := &Cache{store: MemoryStore{}}
+	if n, err := c.LoadFile(filepath.Join(t.TempDir(), "missing.gob")); n != 0 || err != nil {
+		t.Fatalf("missing file = %d, %v; want nothing restored and no error", n, err)
+	}
+	corrupt := filepath.Join(t.TempDir(), "corrupt.gob")
+	os.WriteFile(corrupt, []byte("not gob"), 0o644)
+	if _, err := c.LoadFile(corrupt); err == nil {
+		t.Fatal("a corrupt file was accepted")
+	}
+}
+
+func TestCompressedCacheFileRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible "), 1000)
+	sizes := map[string]int64{}
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.gob")
+			saved := &Cache{store: MemoryStore{}}
+			saved.Set("/page", CacheEntry{Response: body, Headers: http.Header{"Etag": {`"v1"`}}, TTL: time.Hour, Created: time.Now()})
+			if err := saved.SaveFile(path, compression); err != nil {
+				t.Fatal(err)
+			}
+			info, _ := os.Stat(path)
+			sizes[compression] = info.Size()
+
+			loaded := &Cache{store: MemoryStore{}}
+			if n, err := loaded.LoadFile(path); err != nil || n != 1 {
+				t.Fatalf("LoadFile = %d, %v; want 1 entry", n, err)
+			}
+			entry, found := loaded.Get("/page")
+			if !found || !bytes.Equal(entry.Response, body) || entry.Headers.Get("ETag") != `"v1"` {
+				t.Fatalf("restored entry = %q, %v", entry.Headers, found)
+			}
+		})
+	}
+	for _, compression := range []string{"gzip", "zstd"} {
+		if sizes[compression] >= sizes["none"] {
+			t.Fatalf("%s file = %d bytes, want smaller than the uncompressed %d", compression, sizes[compression], sizes["none"])
+		}
+	}
+	if err := (&Cache{store: MemoryStore{}}).SaveFile(filepath.Join(t.TempDir(), "cache.gob"), "brotli"); err == nil {
+		t.Fatal("an unknown compression was accepted")
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func rawHTTP10(t *testing.T, addr, request string) *http.Response {
+	// Sends request verbatim on a new connection, closed when t ends, and returns the response.
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return resp
+}
+
+func TestHTTP10ResponsesCarryContentLength(t *testing.T) {
+	body := strings.Repeat("x", 10000)
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		// Large enough, and flushed, that the upstream itself answers chunked.
+		w.Write([]byte(body))
+		w.(http.Flusher).Flush()
+	})
+	srv := serveTest(t, http.HandlerFunc(p.handleProxy))
+	addr := srv.Listener.Addr().String()
+
+	for _, cache := range []string{"MISS", "HIT"} {
+		resp := rawHTTP10(t, addr, "GET /page HTTP/1.0\r\nHost: proxy\r\n\r\n")
+		if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) != 0 {
+			t.Fatalf("%s: Content-Length %d, Transfer-Encoding %v; want a plain %d byte body", cache, resp.ContentLength, resp.TransferEncoding, len(body))
+		}
+		if !resp.Close {
+			t.Errorf("%s: connection left open for a 1.0 client without keep-alive", cache)
+		}
+		if got := readBody(t, resp); got != body || resp.Header.Get("X-Cache") != cache {
+			t.Fatalf("got %d bytes as %s, want %d as %s", len(got), resp.Header.Get("X-Cache"), len(body), cache)
+		}
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	for _, allowed := range []bool{true, false} {
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+		p.http10KeepAlive = allowed
+		srv := serveTest(t, http.HandlerFunc(p.handleProxy))
+		resp := rawHTTP10(t, srv.Listener.Addr().String(), "GET /page HTTP/1.0\r\nHost: proxy\r\nConnection: keep-alive\r\n\r\n")
+		readBody(t, resp)
+		if resp.Close == allowed {
+			t.Errorf("http10KeepAlive %v: response closes the connection = %v", allowed, resp.Close)
+		}
+		if resp.ContentLength != 2 {
+			t.Errorf("http10KeepAlive %v: Content-Length = %d, want 2", allowed, resp.ContentLength)
+		}
+	}
+}
+
+func TestCancelledRequests(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("fresh"))
+	})
+	get(p, "/cached")
+
+	cancelled := func(target string) *http.Request {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+	}
+	if hit := do(p, cancelled("/cached")); hit.Body.String() != "fresh" || hit.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("cancelled hit = %q %s, want the cached body", hit.Body.String(), hit.Header().Get("X-Cache"))
+	}
+	do(p, cancelled("/uncached"))
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("upstream fetches = %d, want only the one for the first request", n)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	p.serverTiming = true
+
+	miss := get(p, "/page").Header().Values("Server-Timing")
+	if len(miss) != 2 || miss[0] != `cache;desc="MISS"` || !strings.HasPrefix(miss[1], "upstream;dur=") {
+		t.Fatalf("Server-Timing on a miss = %q, want the cache status and upstream duration", miss)
+	}
+	if _, err := strconv.ParseFloat(strings.TrimPrefix(miss[1], "upstream;dur="), 64); err != nil {
+		t.Fatalf("upstream duration %q is not a number", miss[1])
+	}
+	if hit := get(p, "/page").Header().Values("Server-Timing"); len(hit) != 1 || hit[0] != `cache;desc="HIT"` {
+		t.Fatalf("Server-Timing on a hit = %q", hit)
+	}
+
+	p.serverTiming = false
+	if rec := get(p, "/page"); rec.Header().Get("Server-Timing") != "" {
+		t.Fatalf("Server-Timing sent while disabled: %q", rec.Header().Get("Server-Timing"))
+	}
+}
+
+func TestStalledUpstreamBodyTimesOut(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	p.readTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	rec := get(p, "/stalled")
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %v, want about the 100ms read timeout", elapsed)
+	}
+	if strings.Contains(rec.Body.String(), "partial") || entryCount(p.cache) != 0 {
+		t.Fatal("the partial body was served or cached")
+	}
+}
+
+func TestSlowButSteadyBodyIsNotCutOff(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		for range 10 {
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	})
+	p.readTimeout = 100 * time.Millisecond
+
+	// The body takes about 300ms in all, three times the timeout, but never stalls for 100ms.
+	if rec := get(p, "/slow"); rec.Code != http.StatusOK || rec.Body.String() != strings.Repeat("x", 10) {
+		t.Fatalf("slow body = %d %q, want the whole of it", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCacheStatusHeaderAndValues(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	values, err := parseStatusValues("hit=TCP_HIT, MISS=TCP_MISS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.statusHeader, p.statusValues = "X-Proxy-Cache", values
+
+	for _, want := range []string{"TCP_MISS", "TCP_HIT"} {
+		rec := get(p, "/page")
+		if got := rec.Header().Get("X-Proxy-Cache"); got != want {
+			t.Fatalf("X-Proxy-Cache = %q, want %q", got, want)
+		}
+		if rec.Header().Get("X-Cache") != "" {
+			t.Fatal("X-Cache sent alongside the configured header")
+		}
+	}
+	// Statuses without a mapping keep their name.
+	p.statusValues = map[string]string{"HIT": "TCP_HIT"}
+	if got := get(p, "/other").Header().Get("X-Proxy-Cache"); got != "MISS" {
+		t.Fatalf("unmapped status = %q, want MISS", got)
+	}
+}
+
+func TestParseStatusValuesRejectsInvalidPairs(t *testing.T) {
+	for _, list := range []string{"HIT", "HIT=", "=TCP_HIT", "HIT=TCP_HIT,MISS"} {
+		if _, err := parseStatusValues(list); err == nil {
+			t.Errorf("parseStatusValues(%q) accepted", list)
+		}
+	}
+}
+
+func TestNonCacheableMethodsNeverTouchTheCache(t *testing.T) {
+	var received []string
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.Write(body)
+	})
+	for _, body := range []string{"first", "second", "first"} {
+		rec := do(p, httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body)))
+		if rec.Body.String() != body || rec.Header().Get("X-Cache") == "HIT" {
+			t.Fatalf("POST %q answered %s %q, want the upstream's answer to it", body, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+	}
+	if len(received) != 3 {
+		t.Fatalf("upstream received %q, want every POST", received)
+	}
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("POSTs left %d cache entries", n)
+	}
+
+	// A cached GET under the same URL is not served to a POST either.
+	get(p, "/submit")
+	if rec := do(p, httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader("third"))); rec.Body.String() != "third" {
+		t.Fatalf("POST after a cached GET = %q, want the upstream's answer", rec.Body.String())
+	}
+}
+
+func TestPartialContentIsNotCached(t *testing.T) {
+	const full = "0123456789abcdef"
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.txt", time.Time{}, strings.NewReader(full))
+	})
+	p.cacheableStatuses = map[int]bool{http.StatusOK: true, http.StatusPartialContent: true}
+
+	r := httptest.NewRequest(http.MethodGet, "/data.txt", nil)
+	r.Header.Set("Range", "bytes=0-4")
+	if rec := do(p, r); rec.Code != http.StatusPartialContent || rec.Body.String() != "01234" {
+		t.Fatalf("range request = %d %q, want the upstream's 206", rec.Code, rec.Body.String())
+	}
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("the 206 left %d entries", n)
+	}
+	for _, cache := range []string{"MISS", "HIT"} {
+		if rec := get(p, "/data.txt"); rec.Code != http.StatusOK || rec.Body.String() != full || rec.Header().Get("X-Cache") != cache {
+			t.Fatalf("full GET = %d %s %q, want the whole body as a %s", rec.Code, rec.Header().Get("X-Cache"), rec.Body.String(), cache)
+		}
+	}
+}
+
+func TestHitReplaysUpstreamResponseHeaders(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+	for _, cache := range []string{"MISS", "HIT"} {
+		r := httptest.NewRequest(http.MethodGet, "/data", nil)
+		r.Header.Set("Accept", "text/html")
+		r.Header.Set("User-Agent", "test-browser")
+		rec := do(p, r)
+		if rec.Header().Get("X-Cache") != cache || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: Content-Type %q, want the upstream's application/json", rec.Header().Get("X-Cache"), rec.Header().Get("Content-Type"))
+		}
+		if rec.Header().Get("Accept") != "" || rec.Header().Get("User-Agent") != "" {
+			t.Fatalf("%s: request headers replayed to the client: %v", cache, rec.Header())
+		}
+	}
+}
+
+func TestUnreachableTargetFailsCleanly(t *testing.T) {
+	p := newTestProxy(t, http.NotFound)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	p.targetHost = closed.URL
+	closed.Close()
+
+	rec := get(p, "/page")
+	if rec.Code != http.StatusBadGateway && rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 502 or 500", rec.Code)
+	}
+	if p.stats.upstreamErrors.Load() != 1 || entryCount(p.cache) != 0 {
+		t.Fatalf("upstream errors %d, entries %d; want the failure counted and nothing cached", p.stats.upstreamErrors.Load(), entryCount(p.cache))
+	}
+
+	p.targetHost = "http://bad host"
+	if rec := get(p, "/page"); rec.Code < 500 {
+		t.Fatalf("invalid target = %d, want a server error", rec.Code)
+	}
+}
+
+func TestCacheableMethods(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("ok"))
+	})
+	p.cacheableMethods = parseMethods("get, head, options")
+	for _, method := range []string{http.MethodPut, http.MethodDelete, http.MethodPost} {
+		for range 2 {
+			if rec := do(p, httptest.NewRequest(method, "/resource", nil)); rec.Header().Get("X-Cache") == "HIT" {
+				t.Fatalf("%s answered from the cache", method)
+			}
+		}
+	}
+	if n := fetches.Load(); n != 6 {
+		t.Fatalf("upstream fetches = %d, want every non-cacheable request forwarded", n)
+	}
+	do(p, httptest.NewRequest(http.MethodOptions, "/resource", nil))
+	if rec := do(p, httptest.NewRequest(http.MethodOptions, "/resource", nil)); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("a configured cacheable method was not cached")
+	}
+}
+
+func TestEmptyBodiedResponses(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/not-modified":
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+		}
+		// Anything else is an empty 200.
+	})
+	p.cacheableStatuses = map[int]bool{http.StatusOK: true, http.StatusNoContent: true}
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := get(p, "/no-content")
+		if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 || rec.Header().Get("X-Cache") != want {
+			t.Fatalf("204 = %d %s with %d bytes, want an empty 204 %s", rec.Code, rec.Header().Get("X-Cache"), rec.Body.Len(), want)
+		}
+		if _, set := rec.Header()["Content-Length"]; set {
+			t.Fatalf("204 %s carries Content-Length %q", want, rec.Header().Get("Content-Length"))
+		}
+
+		rec = get(p, "/empty")
+		if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("X-Cache") != want || rec.Header().Get("Content-Length") != "0" {
+			t.Fatalf("empty 200 = %d %s, Content-Length %q, want an empty 200 %s", rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("Content-Length"), want)
+		}
+	}
+
+	for range 2 {
+		if rec := get(p, "/not-modified"); rec.Code != http.StatusNotModified || rec.Header().Get("X-Cache") == "HIT" {
+			t.Fatalf("upstream 304 = %d %s, want it passed through uncached", rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+	if n := fetches.Load(); n != 4 {
+		t.Fatalf("upstream fetches = %d, want 4", n)
+	}
+}
+
+func TestHitsCarryTheirAge(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/aged" {
+			w.Header().Set("Age", "100")
+		}
+		w.Write([]byte("body"))
+	})
+	clock := newFakeClock(p.cache)
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache-Age") != "" || rec.Header().Get("Age") != "" {
+		t.Fatalf("a MISS carries ages %q and %q", rec.Header().Get("X-Cache-Age"), rec.Header().Get("Age"))
+	}
+	get(p, "/aged")
+	clock.advance(42*time.Second + 500*time.Millisecond)
+
+	rec := get(p, "/page")
+	if rec.Header().Get("X-Cache-Age") != "42" || rec.Header().Get("Age") != "42" {
+		t.Fatalf("HIT ages = %q and %q, want 42", rec.Header().Get("X-Cache-Age"), rec.Header().Get("Age"))
+	}
+	// Age also counts the time the upstream's response had already spent in caches before this one.
+	rec = get(p, "/aged")
+	if rec.Header().Get("X-Cache-Age") != "42" || rec.Header().Get("Age") != "142" {
+		t.Fatalf("HIT of an aged response = %q and %q, want 42 and 142", rec.Header().Get("X-Cache-Age"), rec.Header().Get("Age"))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const methodPurge = "PURGE" // Non-standard method understood by Varnish, Squid and most CDNs for evicting one URL.
+
+func (c *Cache) Purge(baseKey string) int {
+	/* Removes the entry stored under baseKey together with all its Vary variants. Returns how many were removed.
+	Variants are found by their BaseKey; on a shared store other instances may have written variants this one never recorded.*/
+	c.variesMu.Lock()
+	_, varied := c.varies[baseKey]
+	delete(c.varies, baseKey)
+	c.variesMu.Unlock()
+	l := c.storeLocker()
+	l.Lock()
+	defer l.Unlock()
+	removed := 0
+	if entry, found := c.store.Get(baseKey); found {
+		c.remove(baseKey, entry)
+		removed++
+	}
+	if varied || !c.local() {
+		removed += c.removeMatching(func(entry CacheEntry) bool { return entry.BaseKey == baseKey })
+	}
+	return removed
+}
+
+func (c *Cache) PurgeURL(urlKey string) int {
+	// Removes every entry stored with urlKey as its URLKey, whichever client it was stored for. Returns how many were removed.
+	l := c.storeLocker()
+	l.Lock()
+	defer l.Unlock()
+	return c.removeMatching(func(entry CacheEntry) bool { return entry.URLKey == urlKey })
+}
+
+func (p *ProxyServer) purgeRequest(r *http.Request, methods []string) int {
+	/* Purges the entries of r's URL when requested with each of methods, together with their Vary variants.
+	When keys depend on the client, every client's entry goes, not just the one r's own headers would select. Returns how many were removed.*/
+	cache := p.cacheFor(r.URL.Path)
+	removed := 0
+	for _, method := range methods {
+		keyed := r.Clone(r.Context())
+		keyed.Method = method
+		if p.keyOptions.perClient() {
+			removed += cache.PurgeURL(generateCacheKey(keyed, p.keyOptions.urlOnly()))
+		} else {
+			removed += cache.Purge(generateCacheKey(keyed, p.keyOptions))
+		}
+	}
+	return removed
+}
+
+func (p *ProxyServer) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	/* A dedicated endpoint (POST or PURGE /purge?url=/page&method=GET) removing the entry of a single URL.
+	The url is given as clients request it from the proxy: a path with query, or an absolute URL when forwarding.
+	Without method the GET and HEAD entries are both removed. Answers 404 when nothing was cached for the URL.*/
+	if r.Method != http.MethodPost && r.Method != methodPurge {
+		w.Header().Set("Allow", http.MethodPost+", "+methodPurge)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target, err := url.ParseRequestURI(r.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, "url must be a path or an absolute URL", http.StatusBadRequest)
+		return
+	}
+	keyed := &http.Request{URL: target, Host: r.Host, Header: r.Header}
+	if target.IsAbs() && len(p.forward.Hosts) == 0 {
+		// Without forwarding, clients send origin-form requests, which are keyed by path and query alone.
+		keyed.Host = target.Host
+		keyed.URL = &url.URL{Path: target.Path, RawPath: target.RawPath, RawQuery: target.RawQuery}
+	}
+	methods := []string{http.MethodGet, http.MethodHead}
+	if method := r.URL.Query().Get("method"); method != "" {
+		methods = []string{strings.ToUpper(method)}
+	}
+	p.writePurged(w, target.String(), p.purgeRequest(keyed, methods))
+}
+
+func (p *ProxyServer) writePurged(w http.ResponseWriter, target string, removed int) {
+	// Reports the outcome of a purge: 200 when entries were removed, 404 when nothing matched.
+	if removed == 0 {
+		http.Error(w, "Not cached", http.StatusNotFound)
+		return
+	}
+	log.Printf("Purged %d entries for %s", removed, target)
+	fmt.Fprintf(w, "Purged %d entries", removed)
+}
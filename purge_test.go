@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvalidateByMetadata(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		// /v5/... pages carry version 5, everything else version 6.
+		version := "6"
+		if strings.HasPrefix(r.URL.Path, "/v5/") {
+			version = "5"
+		}
+		w.Header().Set("X-Content-Version", version)
+		w.Write([]byte(r.URL.Path))
+	})
+	p.metaHeaders = parseMetaHeaders("version=X-Content-Version, X-Team")
+	for _, target := range []string{"/v5/a", "/v5/b", "/v6/c"} {
+		get(p, target)
+	}
+	p.cache.store.Range(func(key string, entry CacheEntry) bool {
+		if want := strings.TrimPrefix(entry.Path[:3], "/v"); entry.Metadata["version"] != want {
+			t.Errorf("%s stored with version %q, want %q", entry.Path, entry.Metadata["version"], want)
+		}
+		return true
+	})
+
+	invalidate := func(meta string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.invalidateHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/invalidate?meta="+meta, nil))
+		return rec
+	}
+	if rec := invalidate("version:5"); rec.Code != http.StatusOK || rec.Body.String() != "Invalidated 2 entries" {
+		t.Fatalf("invalidate = %d %q, want both version 5 entries removed", rec.Code, rec.Body.String())
+	}
+	if get(p, "/v5/a").Header().Get("X-Cache") != "MISS" || get(p, "/v6/c").Header().Get("X-Cache") != "HIT" {
+		t.Fatal("invalidation removed the wrong entries")
+	}
+	if rec := invalidate("version:7"); rec.Body.String() != "Invalidated 0 entries" {
+		t.Fatalf("invalidating an unknown version = %q", rec.Body.String())
+	}
+	if rec := invalidate("version"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("meta without a value = %d, want 400", rec.Code)
+	}
+	rec := httptest.NewRecorder()
+	p.invalidateHandler(rec, httptest.NewRequest(http.MethodGet, "/admin/invalidate?meta=version:6", nil))
+	if rec.Code != http.StatusMethodNotAllowed || entryCount(p.cache) != 2 {
+		t.Fatalf("GET invalidate = %d with %d entries left, want 405 and nothing removed", rec.Code, entryCount(p.cache))
+	}
+}
+
+func TestMetadataIndexFollowsReplacedEntries(t *testing.T) {
+	c := &Cache{store: MemoryStore{}}
+	c.Set("k", CacheEntry{Metadata: map[string]string{"version": "5"}, TTL: time.Hour, Created: time.Now()})
+	c.Set("k", CacheEntry{Metadata: map[string]string{"version": "6"}, TTL: time.Hour, Created: time.Now()})
+	if n := c.InvalidateByMeta("version", "5"); n != 0 {
+		t.Fatalf("invalidating the old version removed %d entries, want none", n)
+	}
+	if n := c.InvalidateByMeta("version", "6"); n != 1 {
+		t.Fatalf("invalidating the current version removed %d entries, want 1", n)
+	}
+	if len(c.metaIndex) != 0 {
+		t.Fatalf("index still holds %v", c.metaIndex)
+	}
+}
+
+func TestParseMetaHeaders(t *testing.T) {
+	got := parseMetaHeaders("version=X-Content-Version, X-Team")
+	if len(got) != 2 || got["version"] != "X-Content-Version" || got["x-team"] != "X-Team" {
+		t.Fatalf("parseMetaHeaders = %v", got)
+	}
+}
+
+func TestPurgeEndpointRemovesOneURL(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.String()))
+	})
+	for _, target := range []string{"/a?x=1", "/b", "/c"} {
+		get(p, target)
+	}
+	purge := func(method, query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.purgeHandler(rec, httptest.NewRequest(method, "/purge?"+query, nil))
+		return rec
+	}
+
+	if rec := purge(http.MethodPost, "url=%2Fa%3Fx%3D1"); rec.Code != http.StatusOK || rec.Body.String() != "Purged 1 entries" {
+		t.Fatalf("purge = %d %q, want the entry removed", rec.Code, rec.Body.String())
+	}
+	if n := entryCount(p.cache); n != 2 {
+		t.Fatalf("%d entries left, want the other two", n)
+	}
+	if rec := get(p, "/b"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("purging /a removed /b")
+	}
+	if rec := purge(methodPurge, "url=/a?x=1"); rec.Code != http.StatusNotFound {
+		t.Fatalf("purging an uncached URL = %d, want 404", rec.Code)
+	}
+
+	if rec := purge(http.MethodPost, "url=/c&method=head"); rec.Code != http.StatusNotFound {
+		t.Fatalf("purging the uncached HEAD entry of /c = %d, want 404", rec.Code)
+	}
+	if rec := purge(http.MethodPost, "url=/c&method=get"); rec.Code != http.StatusOK {
+		t.Fatalf("purging the GET entry of /c = %d, want 200", rec.Code)
+	}
+	if rec := purge(http.MethodGet, "url=/b"); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") == "" {
+		t.Fatalf("GET /purge = %d, want 405 with Allow", rec.Code)
+	}
+	if rec := purge(http.MethodPost, "url=::"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid url = %d, want 400", rec.Code)
+	}
+}
+
+func TestPurgeMethodRemovesOneURL(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("body"))
+	})
+	get(p, "/a")
+	get(p, "/b")
+	if rec := do(p, httptest.NewRequest(methodPurge, "/a", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("PURGE /a = %d, want 200", rec.Code)
+	}
+	if rec := do(p, httptest.NewRequest(methodPurge, "/a", nil)); rec.Code != http.StatusNotFound {
+		t.Fatalf("second PURGE /a = %d, want 404", rec.Code)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("PURGE reached the upstream: %d fetches", n)
+	}
+	if get(p, "/a").Header().Get("X-Cache") != "MISS" || get(p, "/b").Header().Get("X-Cache") != "HIT" {
+		t.Fatal("PURGE /a did not remove exactly /a")
+	}
+}
+
+func TestPurgeRemovesEveryClientsEntry(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	p.keyOptions = KeyOptions{DeviceClass: true, TenantHeader: "X-Tenant", Headers: []string{"Accept-Language"}, AuthPartition: true, AuthHeaders: []string{"Authorization"}}
+	request := func(method, target string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		return do(p, r)
+	}
+	clients := [][]string{
+		{"User-Agent", "iPhone", "Accept-Language", "en"},
+		{"X-Tenant", "acme", "Accept-Language", "de"},
+		{"Authorization", "Bearer alice"},
+	}
+	for _, headers := range clients {
+		request(http.MethodGet, "/page", headers...)
+	}
+	request(http.MethodGet, "/other")
+
+	if rec := request(methodPurge, "/page"); rec.Code != http.StatusOK || rec.Body.String() != "Purged 3 entries" {
+		t.Fatalf("PURGE without the clients' headers = %d %q, want all 3 of their entries removed", rec.Code, rec.Body.String())
+	}
+	for _, headers := range clients {
+		if rec := request(http.MethodGet, "/page", headers...); rec.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("%v after the purge = %s, want a MISS", headers, rec.Header().Get("X-Cache"))
+		}
+	}
+	if rec := request(http.MethodGet, "/other"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatal("PURGE of /page removed /other")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+func addValidators(req, r *http.Request, entry CacheEntry) bool {
+	/* Turns the upstream request for an expired entry into a conditional one using the entry's ETag and Last-Modified,
+	so an unchanged resource costs a 304 instead of the whole body. Reports whether it did: requests carrying their own
+	validators are left alone, since the 304 they may get answers the client, not the cache.
+	A POST qualifies once its body is buffered (see bufferRequestBody): the conditional POST replays that same body,
+	which is what its entry was keyed by, e.g. a GraphQL persisted query.*/
+	if entry.MetadataOnly || (r.Method != http.MethodGet && (r.Method != http.MethodPost || r.GetBody == nil)) ||
+		r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	if r.Method == http.MethodPost {
+		// Lets the transport send the body again should it have to retry on a fresh connection.
+		req.GetBody = r.GetBody
+	}
+	etag, lastModified := entry.Headers.Get("ETag"), entry.Headers.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+func (p *ProxyServer) serveRevalidated(w http.ResponseWriter, r *http.Request, key string, entry CacheEntry, resp *http.Response) {
+	/* Handles a 304 to a conditional revalidation: the entry is stored again as fresh, with the headers the 304 carried
+	merged in, and its cached body is served with the REVALIDATED cache status.*/
+	headers := entry.Headers.Clone()
+	for k, v := range resp.Header {
+		if k != "Content-Length" && k != "Transfer-Encoding" {
+			headers[k] = v
+		}
+	}
+	entry.Headers = headers
+	entry.Created = p.cache.clock()
+	p.cacheFor(r.URL.Path).Set(key, entry)
+	p.recordRevalidation(r, entry, resp.StatusCode, nil)
+	log.Printf("Revalidated %s with the upstream", r.URL.Path)
+	entry, ok := expandEntry(r, entry)
+	if !ok {
+		p.gatewayError(w, r, http.StatusBadGateway, "Error while reading cached body")
+		return
+	}
+
+	p.setCacheStatus(w, "REVALIDATED")
+	for k, v := range entry.Headers {
+		w.Header()[k] = v
+	}
+	p.cookieRewrite.apply(w.Header())
+	if p.serverTiming {
+		w.Header().Set("Server-Timing", `cache;desc="REVALIDATED"`)
+	}
+	if notModified(r, entry) {
+		p.writeMetadata(w, r, entry)
+		return
+	}
+	p.writeBody(w, r, entry.Status, entry.Response)
+}
+
+func (p *ProxyServer) recordRevalidation(r *http.Request, previous CacheEntry, status int, body []byte) {
+	/* Counts a refetch of an expired entry as changed or unchanged, comparing status and body hash with the
+	previous entry, and logs the outcome when logRevalidations is on. A 304 always counts as unchanged.
+	Metadata-only entries have no body to compare and are skipped.*/
+	if previous.MetadataOnly {
+		return
+	}
+	changed := false
+	if status != http.StatusNotModified {
+		previousHash := previous.BodyHash
+		if previous.Compressed {
+			// The stored bytes are the proxy's gzip of the body; the upstream sends it plain.
+			previousBody, _ := gunzip(previous.Response)
+			previousHash = bodyHash(previousBody)
+		} else if previousHash == "" {
+			previousHash = bodyHash(previous.Response)
+		}
+		changed = statusOrOK(status) != statusOrOK(previous.Status) || bodyHash(body) != previousHash
+	}
+	p.stats.recordRevalidation(changed)
+	if !p.logRevalidations {
+		return
+	}
+	if changed {
+		log.Printf("Revalidated %s: content changed", r.URL.Path)
+	} else {
+		log.Printf("Revalidated %s: content unchanged", r.URL.Path)
+	}
+}
+
+func statusOrOK(status int) int {
+	// Maps the zero status of entries stored without one to 200.
+	if status == 0 {
+		return http.StatusOK
+	}
+	return status
+}
+
+func (p *ProxyServer) passNotModified(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	/* Relays a 304 the upstream sent in answer to the client's own validators while the proxy holds no body for it:
+	the client's cache has the body, so the 304 goes through as is and nothing is stored.*/
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	p.cookieRewrite.apply(w.Header())
+	if p.serverTiming {
+		w.Header().Add("Server-Timing", `cache;desc="MISS"`)
+	}
+	p.writeBody(w, r, http.StatusNotModified, nil)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	// Polls cond until it holds, failing t if it doesn't within a few seconds.
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestNotModifiedNearExpiryRefreshesInBackground(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		v := strconv.Itoa(int(version.Load()))
+		w.Header().Set("ETag", `"v`+v+`"`)
+		w.Write([]byte("version " + v))
+	})
+	p.refreshWindow = 30 * time.Second
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	version.Store(2)
+
+	conditional := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.Header.Set("If-None-Match", `"v1"`)
+		return do(p, r)
+	}
+	if rec := conditional(); rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional hit = %d, want 304", rec.Code)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("a 304 far from expiry caused %d fetches", n-1)
+	}
+
+	clock.advance(p.defaultTTL - 10*time.Second)
+	if rec := conditional(); rec.Code != http.StatusNotModified {
+		t.Fatalf("conditional hit near expiry = %d, want an immediate 304", rec.Code)
+	}
+	waitFor(t, "the background refresh", func() bool {
+		_, busy := p.refreshing.Load(generateCacheKey(httptest.NewRequest(http.MethodGet, "/page", nil), p.keyOptions))
+		return fetches.Load() == 2 && !busy
+	})
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "version 2" {
+		t.Fatalf("next GET = %s %q, want the refreshed body from the cache", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestRevalidationCountsChangedAndUnchanged(t *testing.T) {
+	logs := captureLog(t)
+	var body atomic.Value
+	body.Store("first")
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		// No validators, so every refetch is a full 200 compared by body.
+		w.Write([]byte(body.Load().(string)))
+	})
+	p.logRevalidations = true
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+
+	refetch := func() {
+		clock.advance(p.defaultTTL + time.Second)
+		get(p, "/page")
+	}
+	refetch()
+	if c, u := p.stats.revalidationsChanged.Load(), p.stats.revalidationsUnchanged.Load(); c != 0 || u != 1 {
+		t.Fatalf("same body: changed %d, unchanged %d; want 0 and 1", c, u)
+	}
+	body.Store("second")
+	refetch()
+	if c, u := p.stats.revalidationsChanged.Load(), p.stats.revalidationsUnchanged.Load(); c != 1 || u != 1 {
+		t.Fatalf("new body: changed %d, unchanged %d; want 1 and 1", c, u)
+	}
+	if !strings.Contains(logs.String(), "content changed") || !strings.Contains(logs.String(), "unchanged") {
+		t.Fatalf("revalidations not logged:\n%s", logs.String())
+	}
+}
+
+func TestRevalidationNotModifiedCountsAsUnchanged(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	clock.advance(p.defaultTTL + time.Second)
+	if rec := get(p, "/page"); rec.Code != http.StatusOK || rec.Body.String() != "body" {
+		t.Fatalf("revalidated response = %d %q, want the cached body", rec.Code, rec.Body.String())
+	}
+	if c, u := p.stats.revalidationsChanged.Load(), p.stats.revalidationsUnchanged.Load(); c != 0 || u != 1 {
+		t.Fatalf("304: changed %d, unchanged %d; want 0 and 1", c, u)
+	}
+}
+
+func TestExpiredEntryIsRevalidatedConditionally(t *testing.T) {
+	var changed atomic.Bool
+	var conditional atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		etag := `"v1"`
+		if changed.Load() {
+			etag = `"v2"`
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Header.Get("If-None-Match") != "" {
+			conditional.Add(1)
+			if r.Header.Get("If-None-Match") == etag && r.Header.Get("If-Modified-Since") != "" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte("body " + etag))
+	})
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+
+	clock.advance(p.defaultTTL + time.Second)
+	rec := get(p, "/page")
+	if rec.Header().Get("X-Cache") != "REVALIDATED" || rec.Body.String() != `body "v1"` {
+		t.Fatalf("304 path = %s %q, want the cached body REVALIDATED", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("after a 304 the entry is %s, want it fresh again", rec.Header().Get("X-Cache"))
+	}
+
+	changed.Store(true)
+	clock.advance(p.defaultTTL + time.Second)
+	rec = get(p, "/page")
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != `body "v2"` {
+		t.Fatalf("200 path = %s %q, want the new body", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := get(p, "/page"); rec.Body.String() != `body "v2"` || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("replaced entry = %s %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if n := conditional.Load(); n != 2 {
+		t.Fatalf("conditional upstream requests = %d, want 2", n)
+	}
+}
+
+func TestUpstreamNotModifiedWithoutEntryIsPassedThrough(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	rec := do(p, r)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != `"v1"` {
+		t.Fatalf("conditional miss = %d %q, ETag %q; want the upstream's 304", rec.Code, rec.Body.String(), rec.Header().Get("ETag"))
+	}
+	if entryCount(p.cache) != 0 {
+		t.Fatal("the 304 was cached")
+	}
+	if rec := get(p, "/page"); rec.Code != http.StatusOK || rec.Body.String() != "body" {
+		t.Fatalf("unconditional GET = %d %q, want the full body", rec.Code, rec.Body.String())
+	}
+}
+
+func TestBackgroundRefreshesAreBounded(t *testing.T) {
+	var inFlight, peak, refreshes atomic.Int32
+	var prefetching atomic.Bool
+	prefetching.Store(true)
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if !prefetching.Load() {
+			refreshes.Add(1)
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for old := peak.Load(); n > old && !peak.CompareAndSwap(old, n); old = peak.Load() {
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.Write([]byte("body"))
+	})
+	p.refreshWindow = 30 * time.Second
+	p.refreshSlots = make(chan struct{}, 3)
+	clock := newFakeClock(p.cache)
+	paths := make([]string, 40)
+	for i := range paths {
+		paths[i] = "/page/" + strconv.Itoa(i)
+		get(p, paths[i])
+	}
+	prefetching.Store(false)
+	clock.advance(p.defaultTTL - 10*time.Second)
+
+	// Churn: many entries near expiry each answer a 304 at once, each asking for a refresh.
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("If-None-Match", `"v1"`)
+			if rec := do(p, r); rec.Code != http.StatusNotModified {
+				t.Errorf("%s = %d, want an immediate 304", path, rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the background refreshes", func() bool { return len(p.refreshSlots) == 0 })
+	if n := peak.Load(); n > 3 || n == 0 {
+		t.Fatalf("peak refreshes in flight = %d, want between 1 and 3", n)
+	}
+	if n := refreshes.Load(); n >= int32(len(paths)) {
+		t.Fatalf("%d refreshes ran for %d entries; excess ones were not dropped", n, len(paths))
+	}
+}
+
+func TestStalledRefreshGivesUpItsSlot(t *testing.T) {
+	stall := make(chan struct{})
+	defer close(stall)
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if fetches.Add(1) == 1 {
+			w.Write([]byte("body"))
+			return
+		}
+		// The refresh gets its headers and then nothing more.
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-stall
+	})
+	p.refreshWindow = 30 * time.Second
+	p.refreshSlots = make(chan struct{}, 1)
+	p.readTimeout = 50 * time.Millisecond
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	clock.advance(p.defaultTTL - 10*time.Second)
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	do(p, r)
+	waitFor(t, "the stalled refresh to give up", func() bool {
+		_, busy := p.refreshing.Load(generateCacheKey(r, p.keyOptions))
+		return fetches.Load() == 2 && !busy && len(p.refreshSlots) == 0
+	})
+}
+
+func TestRefreshWaitsForTheLimiter(t *testing.T) {
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("body"))
+	})
+	p.refreshWindow = 100 * time.Millisecond
+	p.limiter = newUpstreamLimiter(1, 0, 0)
+	clock := newFakeClock(p.cache)
+	get(p, "/page")
+	release, _ := p.limiter.acquire(context.Background())
+	defer release()
+	clock.advance(p.defaultTTL - 50*time.Millisecond)
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("If-None-Match", `"v1"`)
+	do(p, r)
+	waitFor(t, "the refresh to give up waiting for a slot", func() bool {
+		_, busy := p.refreshing.Load(generateCacheKey(r, p.keyOptions))
+		return !busy
+	})
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("upstream fetches = %d with the limiter full, want the refresh to wait for a slot", n)
+	}
+}
+
+func TestPostRevalidation(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		var conditional atomic.Int32
+		var replayed atomic.Value
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			replayed.Store(string(body))
+			w.Header().Set("ETag", `"q1"`)
+			if r.Header.Get("If-None-Match") == `"q1"` {
+				conditional.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("result"))
+		})
+		p.keyOptions.PostKey = "body"
+		p.cacheableMethods = map[string]bool{http.MethodGet: true, http.MethodPost: true}
+		p.revalidatePost = enabled
+		clock := newFakeClock(p.cache)
+		post := func() *httptest.ResponseRecorder {
+			return do(p, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(`{"id":"q"}`)))
+		}
+		post()
+		clock.advance(p.defaultTTL + time.Second)
+
+		rec := post()
+		if rec.Body.String() != "result" || replayed.Load() != `{"id":"q"}` {
+			t.Fatalf("revalidate-post=%v: got %q, upstream saw body %q", enabled, rec.Body.String(), replayed.Load())
+		}
+		if !enabled {
+			if conditional.Load() != 0 || rec.Header().Get("X-Cache") != "MISS" {
+				t.Fatalf("revalidate-post off: %s after %d conditional POSTs, want a plain refetch", rec.Header().Get("X-Cache"), conditional.Load())
+			}
+			continue
+		}
+		if conditional.Load() != 1 || rec.Header().Get("X-Cache") != "REVALIDATED" {
+			t.Fatalf("revalidate-post on: %s after %d conditional POSTs, want the cached body REVALIDATED", rec.Header().Get("X-Cache"), conditional.Load())
+		}
+		// The 304 restarted the entry's TTL.
+		clock.advance(p.defaultTTL - time.Second)
+		if rec := post(); rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("after the 304 = %s, want a HIT within the renewed TTL", rec.Header().Get("X-Cache"))
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"path"
+)
+
+func routeRequests(admin *http.ServeMux, proxy http.Handler, forward ForwardProxy) http.Handler {
+	/* Sends requests for the endpoints registered on admin to their handlers and everything else straight to proxy.
+	ServeMux cleans paths, answering /a//b or /a/../b with a redirect, so proxied requests must never pass through it:
+	the path reaches the proxy exactly as the client sent it, for collapse-slashes to collapse or keep.
+	Only clean paths can name an admin endpoint; anything else is the upstream's business. So is every absolute-form
+	request in forward proxy mode: GET http://origin/purge is for the origin, not for this proxy's purge endpoint.*/
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !forward.forwards(r) && r.URL.Path == path.Clean(r.URL.Path) {
+			if h, pattern := admin.Handler(r); pattern != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
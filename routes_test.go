@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func noRedirects(req *http.Request, via []*http.Request) error {
+	// Makes a client return redirects instead of following them.
+	return http.ErrUseLastResponse
+}
+
+func TestRepeatedSlashesReachTheProxy(t *testing.T) {
+	for _, mode := range []string{"off", "key", "forward"} {
+		var paths []string
+		p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			w.Write([]byte("ok"))
+		})
+		p.keyOptions.CollapseSlashes = mode != "off"
+		p.collapseForward = mode == "forward"
+		srv := serveTest(t, routeRequests(http.NewServeMux(), http.HandlerFunc(p.handleProxy), ForwardProxy{}))
+		client := &http.Client{CheckRedirect: noRedirects}
+		fetch := func(path string) *http.Response {
+			resp, err := client.Get(srv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readBody(t, resp)
+			return resp
+		}
+
+		if resp := fetch("//a//b"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: //a//b = %d, want it proxied rather than redirected", mode, resp.StatusCode)
+		}
+		want := map[string]string{"off": "//a//b", "key": "//a//b", "forward": "/a/b"}[mode]
+		if paths[0] != want {
+			t.Fatalf("%s: upstream got %s, want %s", mode, paths[0], want)
+		}
+		wantCache := map[string]string{"off": "MISS", "key": "HIT", "forward": "HIT"}[mode]
+		if got := fetch("/a/b").Header.Get("X-Cache"); got != wantCache {
+			t.Fatalf("%s: /a/b after //a//b = %s, want %s", mode, got, wantCache)
+		}
+	}
+}
+
+func TestAdminEndpointsAndProxiedPaths(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.Path))
+	})
+	admin := http.NewServeMux()
+	admin.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("stats")) })
+	srv := serveTest(t, routeRequests(admin, http.HandlerFunc(p.handleProxy), ForwardProxy{}))
+	client := &http.Client{CheckRedirect: noRedirects}
+	for path, want := range map[string]string{
+		"/stats":      "stats",
+		"/stats/":     "upstream /stats/",
+		"//stats":     "upstream //stats",
+		"/debug/vars": "upstream /debug/vars", // Not registered, so the upstream's.
+		"/page":       "upstream /page",
+	} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, resp); got != want {
+			t.Errorf("%s answered %q, want %q", path, got, want)
+		}
+	}
+}
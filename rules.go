@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Cache rules decide per response whether it is stored and for how long.
+A rules file holds one rule per line; blank lines and lines starting with # are ignored:
+
+	method == GET && path ~ /static/* && status == 200 => cache 1h
+	content-type ~ text/* => cache 1m
+	status >= 500 => no-cache
+	header:Cache-Control ~ *private* => no-cache
+	* => cache
+
+Rules are tried in file order and the first one whose conditions all hold wins.
+"cache" without a TTL keeps the proxy's default TTL. When no rule matches the response is cached as usual.
+*/
+
+const (
+	maxCacheRules     = 256  // Upper bound on rules per file, keeps evaluation cost per response bounded.
+	maxRuleConditions = 16   // Upper bound on conditions joined with && in a single rule.
+	maxRuleLineLength = 1024 // Upper bound on the length of a single rule line.
+)
+
+type RuleSet struct { //An ordered list of cache rules loaded from a rules file.
+	rules []CacheRule //rules: Rules in file order; the first match wins.
+}
+
+type CacheRule struct { //A single "conditions => action" rule.
+	conditions []ruleCondition //conditions: All must hold for the rule to match; empty matches everything.
+	decision   CacheDecision   //decision: The outcome when the rule matches.
+}
+
+type CacheDecision struct { //The outcome of evaluating rules for a response.
+	Cache bool          //Cache: Whether the response may be stored.
+	TTL   time.Duration //TTL: Time to live for the stored entry, zero to use the default TTL.
+}
+
+type ruleCondition struct { //A single comparison such as status >= 500.
+	field  string //field: One of method, path, status, content-type or header.
+	header string //header: Canonical header name when field is header.
+	op     string //op: Comparison operator.
+	value  string //value: Right-hand side of the comparison.
+}
+
+var ruleOperators = []string{"==", "!=", "<=", ">=", "!~", "~", "<", ">"} // Two-character operators first so "<=" is not read as "<".
+
+func loadCacheRules(path string) (*RuleSet, error) {
+	// Reads and parses a rules file.
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCacheRules(f)
+}
+
+func parseCacheRules(r io.Reader) (*RuleSet, error) {
+	/* Parses rules from r, rejecting anything the evaluator would not understand
+	so mistakes surface at startup instead of silently changing what gets cached.*/
+	rs := &RuleSet{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, maxRuleLineLength), maxRuleLineLength)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseCacheRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if len(rs.rules) == maxCacheRules {
+			return nil, fmt.Errorf("line %d: more than %d rules", lineNo, maxCacheRules)
+		}
+		rs.rules = append(rs.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseCacheRule(line string) (CacheRule, error) {
+	// Parses a single "conditions => action" line.
+	lhs, rhs, found := strings.Cut(line, "=>")
+	if !found {
+		return CacheRule{}, fmt.Errorf("missing \"=>\" in %q", line)
+	}
+	var rule CacheRule
+	action := strings.Fields(rhs)
+	switch {
+	case len(action) == 1 && action[0] == "no-cache":
+		rule.decision = CacheDecision{Cache: false}
+	case len(action) >= 1 && len(action) <= 2 && action[0] == "cache":
+		rule.decision = CacheDecision{Cache: true}
+		if len(action) == 2 {
+			ttl, err := time.ParseDuration(action[1])
+			if err != nil || ttl <= 0 {
+				return CacheRule{}, fmt.Errorf("invalid TTL %q", action[1])
+			}
+			rule.decision.TTL = ttl
+		}
+	default:
+		return CacheRule{}, fmt.Errorf("invalid action %q, want \"cache [ttl]\" or \"no-cache\"", strings.TrimSpace(rhs))
+	}
+
+	lhs = strings.TrimSpace(lhs)
+	if lhs == "*" {
+		return rule, nil
+	}
+	parts := strings.Split(lhs, "&&")
+	if len(parts) > maxRuleConditions {
+		return CacheRule{}, fmt.Errorf("more than %d conditions", maxRuleConditions)
+	}
+	for _, part := range parts {
+		cond, err := parseRuleCondition(strings.TrimSpace(part))
+		if err != nil {
+			return CacheRule{}, err
+		}
+		rule.conditions = append(rule.conditions, cond)
+	}
+	return rule, nil
+}
+
+func parseRuleCondition(expr string) (ruleCondition, error) {
+	// Parses "field op value", where field is method, path, status, content-type or header:Name.
+	at, op := -1, ""
+	for _, candidate := range ruleOperators {
+		if i := strings.Index(expr, candidate); i >= 0 && (at < 0 || i < at) {
+			at, op = i, candidate
+		}
+	}
+	if at < 0 {
+		return ruleCondition{}, fmt.Errorf("no operator in condition %q", expr)
+	}
+	cond := ruleCondition{
+		field: strings.ToLower(strings.TrimSpace(expr[:at])),
+		op:    op,
+		value: strings.Trim(strings.TrimSpace(expr[at+len(op):]), `"`),
+	}
+	if name, ok := strings.CutPrefix(cond.field, "header:"); ok && name != "" {
+		cond.field = "header"
+		cond.header = http.CanonicalHeaderKey(name)
+	}
+	switch cond.field {
+	case "status":
+		if _, err := strconv.Atoi(cond.value); err != nil {
+			return ruleCondition{}, fmt.Errorf("status must be compared with a number in %q", expr)
+		}
+		if op == "~" || op == "!~" {
+			return ruleCondition{}, fmt.Errorf("status does not support %q in %q", op, expr)
+		}
+	case "method", "path", "content-type", "header":
+		if op != "==" && op != "!=" && op != "~" && op != "!~" {
+			return ruleCondition{}, fmt.Errorf("%s does not support %q in %q", cond.field, op, expr)
+		}
+	default:
+		return ruleCondition{}, fmt.Errorf("unknown field %q", cond.field)
+	}
+	return cond, nil
+}
+
+func (rs *RuleSet) Evaluate(r *http.Request, resp *http.Response) (CacheDecision, bool) {
+	// Returns the decision of the first rule matching the request/response pair, and whether any rule matched.
+	for _, rule := range rs.rules {
+		if rule.matches(r, resp) {
+			return rule.decision, true
+		}
+	}
+	return CacheDecision{}, false
+}
+
+func (rule CacheRule) matches(r *http.Request, resp *http.Response) bool {
+	// Reports whether every condition of the rule holds.
+	for _, cond := range rule.conditions {
+		if !cond.holds(r, resp) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c ruleCondition) holds(r *http.Request, resp *http.Response) bool {
+	// Evaluates one condition against the request/response pair.
+	var actual string
+	switch c.field {
+	case "status":
+		want, _ := strconv.Atoi(c.value)
+		return compareInts(resp.StatusCode, c.op, want)
+	case "method":
+		return compareStrings(strings.ToUpper(r.Method), c.op, strings.ToUpper(c.value))
+	case "path":
+		actual = r.URL.Path
+	case "content-type":
+		actual = resp.Header.Get("Content-Type")
+		if mediaType, _, err := mime.ParseMediaType(actual); err == nil {
+			actual = mediaType
+		}
+	case "header":
+		actual = resp.Header.Get(c.header)
+		if actual == "" {
+			actual = r.Header.Get(c.header)
+		}
+	}
+	return compareStrings(actual, c.op, c.value)
+}
+
+func compareInts(actual int, op string, want int) bool {
+	// Applies a numeric comparison operator.
+	switch op {
+	case "==":
+		return actual == want
+	case "!=":
+		return actual != want
+	case "<":
+		return actual < want
+	case "<=":
+		return actual <= want
+	case ">":
+		return actual > want
+	case ">=":
+		return actual >= want
+	}
+	return false
+}
+
+func compareStrings(actual, op, want string) bool {
+	// Applies an equality or glob comparison operator.
+	switch op {
+	case "==":
+		return actual == want
+	case "!=":
+		return actual != want
+	case "~":
+		return globMatch(want, actual)
+	case "!~":
+		return !globMatch(want, actual)
+	}
+	return false
+}
+
+func globMatch(pattern, s string) bool {
+	/* Matches s against a glob where * matches any run of characters (including /) and ? matches one character.
+	Runs in O(len(pattern)*len(s)) without recursion, so untrusted input can't blow it up.*/
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starI = p, i
+			p++
+		case starP >= 0:
+			starI++
+			p, i = starP+1, starI
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRules = `
+# Errors are never cached, even under /static.
+status >= 500 => no-cache
+method == GET && path ~ /static/* && status == 200 => cache 1h
+content-type ~ text/* => cache 1m
+header:Cache-Control ~ *private* => no-cache
+* => cache
+`
+
+func TestRuleSetEvaluate(t *testing.T) {
+	rs, err := parseCacheRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		status      int
+		contentType string
+		cacheCtl    string
+		want        CacheDecision
+	}{
+		{"static asset", "GET", "/static/app.js", 200, "application/javascript", "", CacheDecision{Cache: true, TTL: time.Hour}},
+		{"static html wins over content type", "GET", "/static/index.html", 200, "text/html", "", CacheDecision{Cache: true, TTL: time.Hour}},
+		{"earlier no-cache wins over static", "GET", "/static/app.js", 503, "text/plain", "", CacheDecision{}},
+		{"static rule needs GET", "POST", "/static/app.js", 200, "application/javascript", "", CacheDecision{Cache: true}},
+		{"content type with parameters", "GET", "/page", 200, "text/html; charset=utf-8", "", CacheDecision{Cache: true, TTL: time.Minute}},
+		{"header glob", "GET", "/me", 200, "application/json", "private, max-age=60", CacheDecision{}},
+		{"catch-all keeps default TTL", "GET", "/api", 200, "application/json", "", CacheDecision{Cache: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{"Content-Type": {tt.contentType}}}
+			if tt.cacheCtl != "" {
+				resp.Header.Set("Cache-Control", tt.cacheCtl)
+			}
+			got, found := rs.Evaluate(r, resp)
+			if !found || got != tt.want {
+				t.Fatalf("Evaluate = %+v, %v; want %+v", got, found, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSetWithoutMatch(t *testing.T) {
+	rs, err := parseCacheRules(strings.NewReader("status == 404 => no-cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := rs.Evaluate(httptest.NewRequest("GET", "/", nil), &http.Response{StatusCode: 200, Header: http.Header{}}); found {
+		t.Fatal("a rule matched a 200")
+	}
+}
+
+func TestParseCacheRulesRejectsInvalidRules(t *testing.T) {
+	for _, line := range []string{
+		"status == 200",
+		"status == 200 => keep",
+		"status == 200 => cache soon",
+		"status == 200 => cache -1m",
+		"status == ok => cache",
+		"colour == red => cache",
+		"path => cache",
+		strings.Repeat("method == GET && ", maxRuleConditions) + "status == 200 => cache",
+		"path == /" + strings.Repeat("a", maxRuleLineLength) + " => cache",
+	} {
+		if _, err := parseCacheRules(strings.NewReader(line)); err == nil {
+			t.Errorf("parseCacheRules accepted %.60q", line)
+		}
+	}
+	if _, err := parseCacheRules(strings.NewReader(strings.Repeat("* => cache\n", maxCacheRules+1))); err == nil {
+		t.Errorf("parseCacheRules accepted more than %d rules", maxCacheRules)
+	}
+}
+
+func TestRulesDecideWhatTheProxyStores(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("body"))
+	})
+	p.cacheableStatuses = map[int]bool{200: true, 500: true}
+	rs, err := parseCacheRules(strings.NewReader(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.rules = rs
+	p.defaultTTL = 5 * time.Minute
+
+	get(p, "/static/app.js")
+	get(p, "/api")
+	get(p, "/fail")
+	ttls := map[string]time.Duration{}
+	p.cache.store.Range(func(key string, entry CacheEntry) bool {
+		ttls[entry.Path] = entry.TTL
+		return true
+	})
+	want := map[string]time.Duration{"/static/app.js": time.Hour, "/api": p.defaultTTL}
+	if len(ttls) != len(want) || ttls["/static/app.js"] != want["/static/app.js"] || ttls["/api"] != want["/api"] {
+		t.Fatalf("stored TTLs = %v, want %v", ttls, want)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scheduled purges drop matching entries at fixed times regardless of their TTL.
+// Each rule is a standard five-field cron expression (minute hour day-of-month month day-of-week)
+// followed by a path glob; rules are separated by semicolons:
+//
+//	0 2 * * * /homepage; */15 * * * 1-5 /news/*
+//
+// Fields accept *, numbers, lists (1,15), ranges (1-5) and steps (*/15, 0-30/10). As in cron, when both
+// day fields are restricted a time matches if either one does. Day of week counts from 0 for Sunday; 7 is also
+// Sunday, so 5-7 means Friday to Sunday. Times are evaluated in local time.
+
+type purgeSchedule struct { //A cron expression and the paths it purges.
+	fields [5]uint64 //fields: Allowed values of minute, hour, day of month, month and day of week as bit sets.
+	anyDay bool      //anyDay: Day of month is *, so only the day of week restricts the day.
+	anyDow bool      //anyDow: Day of week is *, so only the day of month restricts the day.
+	glob   string    //glob: Path glob of the entries to purge, see globMatch.
+}
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}} // Value bounds of the five cron fields; day of week allows 7 for Sunday.
+
+func parsePurgeSchedules(value string) ([]purgeSchedule, error) {
+	// Parses the scheduled-purge flag: semicolon-separated "cron-expression path-glob" rules.
+	var schedules []purgeSchedule
+	for _, rule := range strings.Split(value, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid scheduled purge %q, want five cron fields and a path glob", strings.TrimSpace(rule))
+		}
+		s := purgeSchedule{glob: fields[5], anyDay: fields[2] == "*", anyDow: fields[4] == "*"}
+		for i := range s.fields {
+			bits, err := parseCronField(fields[i], cronRanges[i][0], cronRanges[i][1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid scheduled purge %q: %w", strings.TrimSpace(rule), err)
+			}
+			if i == 4 && bits&(1<<7) != 0 {
+				// Sunday is 7 as well as 0; matches compares against time.Weekday, where it is 0.
+				bits = bits&^(1<<7) | 1
+			}
+			s.fields[i] = bits
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	// Parses one cron field into a bit set of the values in [lo, hi] it allows.
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		start, end := lo, hi
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				end = hi
+			}
+		}
+		if start < lo || end > hi || start > end {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, lo, hi)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (s purgeSchedule) matches(t time.Time) bool {
+	// Reports whether the schedule fires in the minute starting at t.
+	has := func(field, v int) bool { return s.fields[field]&(1<<v) != 0 }
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+	day, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	switch {
+	case s.anyDay && s.anyDow:
+		return true
+	case s.anyDay:
+		return dow
+	case s.anyDow:
+		return day
+	}
+	return day || dow
+}
+
+func (p *ProxyServer) runScheduledPurges(ctx context.Context, schedules []purgeSchedule) {
+	// Wakes at the start of every minute and purges the entries of each schedule that fires, until ctx is cancelled.
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			p.purgeDue(schedules, next)
+		}
+	}
+}
+
+func (p *ProxyServer) purgeDue(schedules []purgeSchedule, t time.Time) {
+	// Purges the entries of each schedule firing in the minute starting at t.
+	for _, s := range schedules {
+		if s.matches(t) {
+			removed := 0
+			for _, c := range p.caches() {
+				removed += c.InvalidateByPath(s.glob)
+			}
+			log.Printf("Scheduled purge of %s removed %d entries", s.glob, removed)
+		}
+	}
+}
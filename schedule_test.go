@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParsePurgeSchedules(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		ok   bool
+	}{
+		{"0 2 * * * /homepage", true},
+		{"*/15 * * * 1-5 /news/*; 30 6 1,15 * * /reports/*", true},
+		{"0 0 * * 7 /weekly", true},
+		{"0 0 * * 5-7 /weekend", true},
+		{"0 0 * * 8 /x", false},
+		{"60 * * * * /x", false},
+		{"0 24 * * * /x", false},
+		{"0 0 0 * * /x", false},
+		{"*/0 * * * * /x", false},
+		{"0 0 * * /x", false},
+		{"5-1 * * * * /x", false},
+	} {
+		_, err := parsePurgeSchedules(tc.spec)
+		if (err == nil) != tc.ok {
+			t.Errorf("parsePurgeSchedules(%q) error = %v, want ok %v", tc.spec, err, tc.ok)
+		}
+	}
+}
+
+func TestPurgeScheduleMatches(t *testing.T) {
+	// 2026-10-18 is a Sunday.
+	sunday := time.Date(2026, 10, 18, 2, 0, 0, 0, time.Local)
+	monday := sunday.AddDate(0, 0, 1)
+	for _, tc := range []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{"0 2 * * * /", sunday, true},
+		{"0 2 * * * /", sunday.Add(time.Minute), false},
+		{"*/15 * * * * /", sunday.Add(45 * time.Minute), true},
+		{"0 2 * * 0 /", sunday, true},
+		{"0 2 * * 7 /", sunday, true},
+		{"0 2 * * 7 /", monday, false},
+		{"0 2 * * 5-7 /", sunday, true},
+		{"0 2 * * 1-5 /", monday, true},
+		{"0 2 * * 1-5 /", sunday, false},
+		// Both day fields restricted: either one matching is enough.
+		{"0 2 19 * 0 /", monday, true},
+		{"0 2 20 * 2 /", monday, false},
+	} {
+		schedules, err := parsePurgeSchedules(tc.spec)
+		if err != nil {
+			t.Fatalf("parsePurgeSchedules(%q): %v", tc.spec, err)
+		}
+		if got := schedules[0].matches(tc.at); got != tc.want {
+			t.Errorf("%q matches %s = %v, want %v", tc.spec, tc.at.Format("Mon 15:04"), got, tc.want)
+		}
+	}
+}
+
+func TestPurgeDueRemovesMatchingEntries(t *testing.T) {
+	p := &ProxyServer{cache: &Cache{store: MemoryStore{}}}
+	for _, path := range []string{"/news/a", "/news/b", "/home"} {
+		p.cache.Set(path, CacheEntry{Path: path, TTL: time.Hour, Created: time.Now()})
+	}
+	schedules, err := parsePurgeSchedules("* * * * * /news/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.purgeDue(schedules, time.Now())
+	if _, found := p.cache.Get("/home"); !found {
+		t.Error("/home was purged, want it kept")
+	}
+	for _, path := range []string{"/news/a", "/news/b"} {
+		if _, found := p.cache.Get(path); found {
+			t.Errorf("%s survived the scheduled purge", path)
+		}
+	}
+}
+
+func TestScheduledPurgesStopWithTheirContext(t *testing.T) {
+	p := &ProxyServer{cache: &Cache{store: MemoryStore{}}}
+	schedules, err := parsePurgeSchedules("* * * * * /")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.runScheduledPurges(ctx, schedules)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runScheduledPurges kept running after its context was cancelled")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const shutdownRetryAfter = 5 * time.Second // Retry-After sent with the 503s answered while shutting down.
+
+func (p *ProxyServer) rejectShuttingDown(w http.ResponseWriter) bool {
+	/* Answers a request arriving after shutdown began with a clean 503, asking the client to retry elsewhere
+	and to drop the connection, so load balancers drain the instance instead of seeing resets. Reports whether it did.*/
+	if !p.shuttingDown.Load() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", strconv.Itoa(int(shutdownRetryAfter.Seconds())))
+	http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+	return true
+}
+
+func (p *ProxyServer) serveUntilSignal(srv *http.Server, drain, timeout time.Duration) error {
+	/*
+		Serves until SIGINT or SIGTERM, then shuts down gracefully: new requests get 503 for the drain period
+		while the listener stays open, then srv.Shutdown stops accepting and waits up to timeout for in-flight requests.
+	*/
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-served:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	}
+	p.shuttingDown.Store(true)
+	srv.SetKeepAlivesEnabled(false)
+	time.Sleep(drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
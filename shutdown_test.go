@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	release := make(chan struct{})
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("done"))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(p.handleProxy)}
+	stopped := make(chan error, 1)
+	go func() { stopped <- p.serveUntilSignal(srv, 500*time.Millisecond, 5*time.Second) }()
+	waitFor(t, "the server to listen", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+
+	inFlight := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			t.Error(err)
+			close(inFlight)
+			return
+		}
+		inFlight <- resp
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the slow request reach the upstream.
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "shutdown to begin", p.shuttingDown.Load)
+
+	resp, err := http.Get("http://" + addr + "/new")
+	if err != nil {
+		t.Fatalf("new request during the drain was dropped: %v", err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || !resp.Close {
+		t.Fatalf("new request = %d, Retry-After %q, close %v; want a 503 closing the connection", resp.StatusCode, resp.Header.Get("Retry-After"), resp.Close)
+	}
+
+	close(release)
+	if resp, ok := <-inFlight; !ok || resp.StatusCode != http.StatusOK || readBody(t, resp) != "done" {
+		t.Fatal("the in-flight request did not complete")
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("serveUntilSignal = %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var statusClasses = [...]string{"1xx", "2xx", "3xx", "4xx", "5xx"} // Labels for upstream status classes, by index.
+
+type ProxyStats struct { //Counters describing proxy traffic; the zero value is ready to use.
+	upstreamStatus [len(statusClasses)]atomic.Int64 //upstreamStatus: Upstream responses by status class, 1xx at index 0 up to 5xx.
+
+	revalidationsChanged   atomic.Int64 //revalidationsChanged: Refetches of expired entries that brought a different body.
+	revalidationsUnchanged atomic.Int64 //revalidationsUnchanged: Refetches of expired entries that brought the same body.
+
+	hits           atomic.Int64 //hits: Requests answered from the cache.
+	misses         atomic.Int64 //misses: Requests forwarded to the upstream.
+	upstreamErrors atomic.Int64 //upstreamErrors: Upstream requests that failed or whose body could not be read.
+	bytesServed    atomic.Int64 //bytesServed: Response body bytes written to clients.
+}
+
+func (s *ProxyStats) recordUpstreamStatus(code int) {
+	// Counts an upstream response under its status class; codes outside 100-599 are ignored.
+	if class := code/100 - 1; class >= 0 && class < len(statusClasses) {
+		s.upstreamStatus[class].Add(1)
+	}
+}
+
+func (s *ProxyStats) recordRevalidation(changed bool) {
+	// Counts a revalidation by whether the content changed.
+	if changed {
+		s.revalidationsChanged.Add(1)
+	} else {
+		s.revalidationsUnchanged.Add(1)
+	}
+}
+
+func (s *ProxyStats) upstreamStatusCounts() map[string]int64 {
+	// Returns the upstream response counts keyed by status class ("2xx", "5xx", ...).
+	counts := make(map[string]int64, len(statusClasses))
+	for i, class := range statusClasses {
+		counts[class] = s.upstreamStatus[i].Load()
+	}
+	return counts
+}
+
+func (p *ProxyServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	// A dedicated endpoint (/stats) reporting proxy counters as JSON.
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"upstream_status": p.stats.upstreamStatusCounts(),
+		"revalidations": map[string]int64{
+			"changed":   p.stats.revalidationsChanged.Load(),
+			"unchanged": p.stats.revalidationsUnchanged.Load(),
+		},
+	})
+}
+
+const topHitsReported = 10 // Number of entries listed in the top_hits of /cache-stats.
+
+func (p *ProxyServer) cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	/* A dedicated endpoint (/cache-stats) reporting cache health as JSON, for a quick look without Prometheus.
+	Entries and bytes span every route-backends cache; max_entries and max_bytes are the default cache's, 0 when unbounded. Ages are in seconds.
+	top_hits lists the topHitsReported most served entries of the memory cache by path.*/
+	summary := p.cacheSummary()
+	topHits := []map[string]any{}
+	for _, c := range p.caches() {
+		for _, entry := range c.TopHits(topHitsReported) {
+			topHits = append(topHits, map[string]any{"path": entry.Path, "hits": entry.Hits})
+		}
+	}
+	age := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return p.cache.clock().Sub(t).Seconds()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"entries":            summary.Entries,
+		"max_entries":        p.cache.maxEntries,
+		"bytes":              summary.Bytes,
+		"max_bytes":          p.cache.maxBytes,
+		"hits":               p.stats.hits.Load(),
+		"misses":             p.stats.misses.Load(),
+		"oldest_age_seconds": age(summary.Oldest),
+		"newest_age_seconds": age(summary.Newest),
+		"top_hits":           topHits,
+	})
+}
+
+var ( // Descriptions of the metrics served on /metrics.
+	upstreamResponsesDesc = prometheus.NewDesc("cache_proxy_upstream_responses_total", "Upstream responses by status class.", []string{"class"}, nil)
+	revalidationsDesc     = prometheus.NewDesc("cache_proxy_revalidations_total", "Refetches of expired entries by whether the content changed.", []string{"result"}, nil)
+	hitsDesc              = prometheus.NewDesc("cache_proxy_cache_hits_total", "Requests answered from the cache.", nil, nil)
+	missesDesc            = prometheus.NewDesc("cache_proxy_cache_misses_total", "Requests forwarded to the upstream.", nil, nil)
+	evictionsDesc         = prometheus.NewDesc("cache_proxy_evictions_total", "Entries dropped from the cache because they expired or the cache was full.", nil, nil)
+	upstreamErrorsDesc    = prometheus.NewDesc("cache_proxy_upstream_errors_total", "Upstream requests that failed or whose body could not be read.", nil, nil)
+	bytesServedDesc       = prometheus.NewDesc("cache_proxy_served_bytes_total", "Response body bytes written to clients.", nil, nil)
+	entriesDesc           = prometheus.NewDesc("cache_proxy_cache_entries", "Entries currently in the cache.", nil, nil)
+	cacheBytesDesc        = prometheus.NewDesc("cache_proxy_cache_bytes", "Size of the cached bodies, shared bodies counted once.", nil, nil)
+)
+
+type statsCollector struct { //Reports the proxy's counters and cache size to Prometheus at scrape time.
+	p *ProxyServer //p: The proxy whose stats and cache are reported.
+}
+
+func (c statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	// Sends the description of every metric Collect reports.
+	for _, desc := range []*prometheus.Desc{upstreamResponsesDesc, revalidationsDesc, hitsDesc, missesDesc, evictionsDesc,
+		upstreamErrorsDesc, bytesServedDesc, entriesDesc, cacheBytesDesc} {
+		ch <- desc
+	}
+}
+
+func (c statsCollector) Collect(ch chan<- prometheus.Metric) {
+	/* Reads the counters as they are at scrape time. The proxy keeps counting in its own atomics,
+	so the hot path never touches the Prometheus library.*/
+	stats := &c.p.stats
+	counter := func(desc *prometheus.Desc, value int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	for i, class := range statusClasses {
+		counter(upstreamResponsesDesc, stats.upstreamStatus[i].Load(), class)
+	}
+	counter(revalidationsDesc, stats.revalidationsChanged.Load(), "changed")
+	counter(revalidationsDesc, stats.revalidationsUnchanged.Load(), "unchanged")
+	counter(hitsDesc, stats.hits.Load())
+	counter(missesDesc, stats.misses.Load())
+	counter(evictionsDesc, c.p.cacheEvictions())
+	counter(upstreamErrorsDesc, stats.upstreamErrors.Load())
+	counter(bytesServedDesc, stats.bytesServed.Load())
+	summary := c.p.cacheSummary()
+	ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, float64(summary.Entries))
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(summary.Bytes))
+}
+
+func (p *ProxyServer) metricsHandler() http.Handler {
+	// A dedicated endpoint (/metrics) reporting proxy counters in the Prometheus text format.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(statsCollector{p})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func statusUpstream(w http.ResponseWriter, r *http.Request) {
+	// Answers /status/N with status N.
+	code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/status/"))
+	w.WriteHeader(code)
+}
+
+func TestUpstreamStatusDistribution(t *testing.T) {
+	p := newTestProxy(t, statusUpstream)
+	for i, code := range []int{200, 200, 204, 302, 404, 410, 404, 500, 503} {
+		// A distinct query each time, so repeated cacheable statuses are not answered from the cache.
+		get(p, "/status/"+strconv.Itoa(code)+"?n="+strconv.Itoa(i))
+	}
+	rec := httptest.NewRecorder()
+	p.statsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		UpstreamStatus map[string]int64 `json:"upstream_status"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"1xx": 0, "2xx": 3, "3xx": 1, "4xx": 3, "5xx": 2}
+	for class, n := range want {
+		if stats.UpstreamStatus[class] != n {
+			t.Errorf("%s = %d, want %d (all: %v)", class, stats.UpstreamStatus[class], n, stats.UpstreamStatus)
+		}
+	}
+}
+
+func TestRecordUpstreamStatusIgnoresInvalidCodes(t *testing.T) {
+	var s ProxyStats
+	for _, code := range []int{0, 99, 600, 999, -1} {
+		s.recordUpstreamStatus(code)
+	}
+	for class, n := range s.upstreamStatusCounts() {
+		if n != 0 {
+			t.Errorf("%s counted %d invalid codes", class, n)
+		}
+	}
+}
+
+func TestOnlyCacheableStatusesAreCached(t *testing.T) {
+	p := newTestProxy(t, statusUpstream)
+	for code, cached := range map[int]bool{200: true, 404: true, 410: true, 500: false, 502: false, 403: false} {
+		target := "/status/" + strconv.Itoa(code)
+		first, second := get(p, target), get(p, target)
+		if first.Code != code || first.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("%d: first request = %d %s", code, first.Code, first.Header().Get("X-Cache"))
+		}
+		want := "MISS"
+		if cached {
+			want = "HIT"
+		}
+		if got := second.Header().Get("X-Cache"); got != want || second.Code != code {
+			t.Errorf("%d: second request = %d %s, want a %s", code, second.Code, got, want)
+		}
+	}
+}
+
+func TestCacheableStatusFlag(t *testing.T) {
+	statuses, err := parseStatusList("200, 500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, statusUpstream)
+	p.cacheableStatuses = statuses
+	get(p, "/status/500")
+	get(p, "/status/404")
+	if get(p, "/status/500").Header().Get("X-Cache") != "HIT" || get(p, "/status/404").Header().Get("X-Cache") != "MISS" {
+		t.Fatal("the configured statuses replaced the defaults incorrectly")
+	}
+	for _, list := range []string{"20x", "99", "600"} {
+		if _, err := parseStatusList(list); err == nil {
+			t.Errorf("parseStatusList(%q) accepted", list)
+		}
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write([]byte("body"))
+	})
+	p.cache.maxEntries = 1
+	for _, target := range []string{"/a", "/a", "/a", "/b", "/fail"} {
+		get(p, target)
+	}
+	rec := httptest.NewRecorder()
+	p.metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"cache_proxy_cache_hits_total 2",
+		"cache_proxy_cache_misses_total 3",
+		"cache_proxy_evictions_total 1",
+		"cache_proxy_cache_entries 1",
+		"cache_proxy_cache_bytes 4",
+		"cache_proxy_served_bytes_total 20",
+		`cache_proxy_upstream_responses_total{class="2xx"} 2`,
+		`cache_proxy_upstream_responses_total{class="5xx"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), "\n"+line+"\n") {
+			t.Errorf("scrape lacks %q", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(rec.Body.String())
+	}
+}
+
+func TestCacheStatsReportsTraffic(t *testing.T) {
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("12345"))
+	})
+	p.cache.maxEntries = 10
+	clock := newFakeClock(p.cache)
+	get(p, "/old")
+	clock.advance(30 * time.Second)
+	get(p, "/new")
+	get(p, "/new")
+	get(p, "/new")
+	get(p, "/old")
+	clock.advance(10 * time.Second)
+
+	rec := httptest.NewRecorder()
+	p.cacheStatsHandler(rec, httptest.NewRequest(http.MethodGet, "/cache-stats", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var stats struct {
+		Entries    int     `json:"entries"`
+		MaxEntries int     `json:"max_entries"`
+		Bytes      int     `json:"bytes"`
+		Hits       int     `json:"hits"`
+		Misses     int     `json:"misses"`
+		OldestAge  float64 `json:"oldest_age_seconds"`
+		NewestAge  float64 `json:"newest_age_seconds"`
+		TopHits    []struct {
+			Path string `json:"path"`
+			Hits int    `json:"hits"`
+		} `json:"top_hits"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Entries != 2 || stats.MaxEntries != 10 || stats.Bytes != 10 || stats.Hits != 3 || stats.Misses != 2 {
+		t.Fatalf("stats = %+v, want 2 entries of 10, 10 bytes, 3 hits and 2 misses", stats)
+	}
+	if top := stats.TopHits; len(top) != 2 || top[0].Path != "/new" || top[0].Hits != 2 || top[1].Path != "/old" || top[1].Hits != 1 {
+		t.Fatalf("top_hits = %+v, want /new with 2 hits, then /old with 1", top)
+	}
+	if stats.OldestAge != 40 || stats.NewestAge != 10 {
+		t.Fatalf("ages = %v and %v, want 40 and 10", stats.OldestAge, stats.NewestAge)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type CacheStore interface { //Holds cache entries by key. Cache adds locking, body sharing and the purge indexes on top.
+	Get(key string) (CacheEntry, bool)
+	Set(key string, entry CacheEntry)
+	Delete(key string)
+	Range(f func(key string, entry CacheEntry) bool) //Range: Calls f for every entry until f returns false.
+	Clear()
+}
+
+type MemoryStore map[string]CacheEntry //The in-process store; Cache.mu guards it.
+
+func (m MemoryStore) Get(key string) (CacheEntry, bool) {
+	// Returns the entry under key.
+	entry, found := m[key]
+	return entry, found
+}
+
+func (m MemoryStore) Set(key string, entry CacheEntry) {
+	// Stores entry under key.
+	m[key] = entry
+}
+
+func (m MemoryStore) Delete(key string) {
+	// Removes the entry under key.
+	delete(m, key)
+}
+
+func (m MemoryStore) Range(f func(key string, entry CacheEntry) bool) {
+	// Calls f for every entry until f returns false.
+	for key, entry := range m {
+		if !f(key, entry) {
+			return
+		}
+	}
+}
+
+func (m MemoryStore) Clear() {
+	// Removes every entry.
+	clear(m)
+}
+
+const redisKeyPrefix = "cache-proxy:" // Prefix of every Redis key the proxy writes, so Range and Clear leave other data alone.
+
+type RedisStore struct { //A store shared by every proxy instance pointed at the same Redis.
+	client  *redis.Client   //client: Connection pool to the Redis server.
+	keep    time.Duration   //keep: How long past expiry entries are kept for stale serving and revalidation, see Cache.maxStale.
+	timeout time.Duration   //timeout: Limit on each Redis call, 0 for none.
+	breaker *circuitBreaker //breaker: Skips Redis while it is failing, nil to always try it.
+}
+
+func NewRedisStore(addr string, keep, timeout, cooldown time.Duration) (*RedisStore, error) {
+	/* Connects to the Redis server at addr and checks it answers, so a wrong address fails at startup
+	instead of turning every request into a miss. Once running, an outage degrades the proxy to pass-through:
+	failed calls count as misses and skipped writes, and after breakerThreshold failures in a row Redis is left alone
+	for cooldown at a time, so requests don't each wait out the timeout. A cooldown of 0 disables the breaker.*/
+	client := redis.NewClient(&redis.Options{Addr: addr, ContextTimeoutEnabled: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	store := &RedisStore{client: client, keep: keep, timeout: timeout}
+	if cooldown > 0 {
+		store.breaker = &circuitBreaker{cooldown: cooldown}
+	}
+	return store, nil
+}
+
+func redisContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	// Returns the context for one Redis call, bounded by timeout unless it is 0, so a stalled server holds up a request for at most that long.
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+func (s *RedisStore) Get(key string) (CacheEntry, bool) {
+	// Fetches and decodes the entry under key. Redis errors are logged and reported as a miss.
+	if !s.breaker.allow() {
+		return CacheEntry{}, false
+	}
+	ctx, cancel := redisContext(s.timeout)
+	defer cancel()
+	data, err := s.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if err == redis.Nil {
+		s.breaker.record(nil)
+		return CacheEntry{}, false
+	}
+	s.breaker.record(err)
+	if err != nil {
+		log.Printf("Redis get %s: %v", key, err)
+		return CacheEntry{}, false
+	}
+	var entry CacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		log.Printf("Decoding Redis entry %s: %v", key, err)
+		return CacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (s *RedisStore) Set(key string, entry CacheEntry) {
+	/* Encodes the entry and stores it with a Redis TTL matching its own, plus keep, so Redis drops it
+	at the moment the proxy would have.*/
+	expiry := time.Until(entry.Created.Add(entry.TTL + s.keep))
+	if expiry <= 0 || !s.breaker.allow() {
+		return
+	}
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(entry); err != nil {
+		log.Printf("Encoding Redis entry %s: %v", key, err)
+		return
+	}
+	ctx, cancel := redisContext(s.timeout)
+	defer cancel()
+	err := s.client.Set(ctx, redisKeyPrefix+key, data.Bytes(), expiry).Err()
+	s.breaker.record(err)
+	if err != nil {
+		log.Printf("Redis set %s: %v", key, err)
+	}
+}
+
+func (s *RedisStore) Delete(key string) {
+	// Removes the entry under key.
+	if !s.breaker.allow() {
+		return
+	}
+	ctx, cancel := redisContext(s.timeout)
+	defer cancel()
+	err := s.client.Del(ctx, redisKeyPrefix+key).Err()
+	s.breaker.record(err)
+	if err != nil {
+		log.Printf("Redis delete %s: %v", key, err)
+	}
+}
+
+func (s *RedisStore) Range(f func(key string, entry CacheEntry) bool) {
+	// Walks the proxy's keys with SCAN, so large caches don't block Redis the way KEYS would.
+	s.scan(func(redisKey string) bool {
+		key := redisKey[len(redisKeyPrefix):]
+		entry, found := s.Get(key)
+		return !found || f(key, entry)
+	})
+}
+
+func (s *RedisStore) Clear() {
+	// Removes every key the proxy wrote.
+	s.scan(func(redisKey string) bool {
+		ctx, cancel := redisContext(s.timeout)
+		defer cancel()
+		err := s.client.Del(ctx, redisKey).Err()
+		s.breaker.record(err)
+		if err != nil {
+			log.Printf("Redis delete %s: %v", redisKey, err)
+		}
+		return err == nil
+	})
+}
+
+func (s *RedisStore) scan(f func(redisKey string) bool) {
+	// Calls f for every key under redisKeyPrefix until f returns false. Each SCAN page gets its own timeout, not the whole walk.
+	if !s.breaker.allow() {
+		return
+	}
+	ctx, cancel := redisContext(s.timeout)
+	iter := s.client.Scan(ctx, 0, redisKeyPrefix+"*", 0).Iterator()
+	cancel()
+	for {
+		ctx, cancel := redisContext(s.timeout)
+		more := iter.Next(ctx)
+		cancel()
+		if !more || !f(iter.Val()) {
+			break
+		}
+	}
+	err := iter.Err()
+	s.breaker.record(err)
+	if err != nil {
+		log.Printf("Redis scan: %v", err)
+	}
+}
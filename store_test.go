@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type gobStore struct { //A shared store that, like RedisStore, keeps entries only in encoded form.
+	mu      sync.Mutex        //mu: Guards data; several Caches may use the store at once.
+	data    map[string][]byte //data: Gob-encoded entries by key.
+	gets    int               //gets: Number of Get calls.
+	setKeys []string          //setKeys: Keys passed to Set, in order.
+}
+
+func newGobStore() *gobStore {
+	// Returns an empty store.
+	return &gobStore{data: map[string][]byte{}}
+}
+
+func (s *gobStore) Get(key string) (CacheEntry, bool) {
+	// Decodes the entry under key.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	data, found := s.data[key]
+	if !found {
+		return CacheEntry{}, false
+	}
+	var entry CacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		panic(err)
+	}
+	return entry, true
+}
+
+func (s *gobStore) Set(key string, entry CacheEntry) {
+	// Encodes entry under key.
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(entry); err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = data.Bytes()
+	s.setKeys = append(s.setKeys, key)
+}
+
+func (s *gobStore) Delete(key string) {
+	// Removes the entry under key.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+}
+
+func (s *gobStore) Range(f func(key string, entry CacheEntry) bool) {
+	// Calls f for a snapshot of the keys, outside the lock, like a SCAN.
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	for _, key := range keys {
+		if entry, found := s.Get(key); found && !f(key, entry) {
+			return
+		}
+	}
+}
+
+func (s *gobStore) Clear() {
+	// Removes every entry.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.data)
+}
+
+func TestHandleProxyWorksAgainstEitherStore(t *testing.T) {
+	for name, store := range map[string]CacheStore{"memory": MemoryStore{}, "encoded": newGobStore()} {
+		t.Run(name, func(t *testing.T) {
+			var fetches atomic.Int32
+			p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				w.Header().Set("ETag", `"v1"`)
+				w.Write([]byte("body"))
+			})
+			p.cache = &Cache{store: store}
+			for _, want := range []string{"MISS", "HIT"} {
+				rec := get(p, "/page")
+				if rec.Header().Get("X-Cache") != want || rec.Body.String() != "body" || rec.Header().Get("ETag") != `"v1"` {
+					t.Fatalf("GET = %s %q, want a %s with the upstream's body and headers", rec.Header().Get("X-Cache"), rec.Body.String(), want)
+				}
+			}
+			if n := fetches.Load(); n != 1 {
+				t.Fatalf("upstream fetches = %d, want 1", n)
+			}
+			p.cache.ClearCache()
+			if rec := get(p, "/page"); rec.Header().Get("X-Cache") != "MISS" {
+				t.Fatal("ClearCache left the entry in the store")
+			}
+		})
+	}
+}
+
+func TestSharedStoreServesOtherInstancesEntries(t *testing.T) {
+	store := newGobStore()
+	var fetches atomic.Int32
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("body"))
+	}
+	first, second := newTestProxy(t, upstream), newTestProxy(t, upstream)
+	first.cache, second.cache = &Cache{store: store}, &Cache{store: store}
+
+	get(first, "/page")
+	if rec := get(second, "/page"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "body" {
+		t.Fatalf("second instance = %s %q, want a HIT on the first one's entry", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("upstream fetches = %d, want 1", n)
+	}
+	if len(store.setKeys) != 1 || store.gets == 0 {
+		t.Fatalf("store saw %d sets and %d gets", len(store.setKeys), store.gets)
+	}
+}
+
+func TestSweepLeavesSharedStoreAlone(t *testing.T) {
+	store := newGobStore()
+	c := &Cache{store: store}
+	clock := newFakeClock(c)
+	c.Set("/page", CacheEntry{Response: []byte("body"), TTL: time.Minute})
+	clock.advance(time.Hour)
+	store.gets = 0
+	if removed := c.Sweep(); removed != 0 {
+		t.Fatalf("Sweep removed %d entries from a shared store, want 0", removed)
+	}
+	if store.gets != 0 {
+		t.Fatalf("Sweep read %d entries of a shared store, want none", store.gets)
+	}
+}
+
+type stallingStore struct { //A shared store whose Set blocks until release is closed, like a Redis that stopped answering.
+	*gobStore
+	release chan struct{} //release: Closed to let blocked Set calls finish.
+}
+
+func (s stallingStore) Set(key string, entry CacheEntry) {
+	// Waits for release, then stores entry.
+	<-s.release
+	s.gobStore.Set(key, entry)
+}
+
+func TestSlowSharedStoreDoesNotBlockOtherKeys(t *testing.T) {
+	store := stallingStore{newGobStore(), make(chan struct{})}
+	defer close(store.release)
+	c := &Cache{store: store}
+	store.gobStore.Set("/other", CacheEntry{Response: []byte("body"), TTL: time.Minute, Created: time.Now()})
+	go c.Set("/slow", CacheEntry{Response: []byte("body"), TTL: time.Minute})
+	time.Sleep(20 * time.Millisecond) // Lets the Set reach the store.
+
+	done := make(chan bool)
+	go func() {
+		_, found := c.Get("/other")
+		c.varyNames("/other")
+		done <- found
+	}()
+	select {
+	case found := <-done:
+		if !found {
+			t.Fatal("Get missed an entry stored beforehand")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get waited on another key's stalled Set")
+	}
+}
+
+func TestSharedStoreSummaryIsReused(t *testing.T) {
+	store := newGobStore()
+	c := &Cache{store: store}
+	clock := newFakeClock(c)
+	c.Set("/a", CacheEntry{Response: []byte("body"), TTL: time.Hour})
+	if n := c.Summary().Entries; n != 1 {
+		t.Fatalf("Summary = %d entries, want 1", n)
+	}
+	gets := store.gets
+	c.Set("/b", CacheEntry{Response: []byte("body"), TTL: time.Hour})
+	if n := c.Summary().Entries; n != 1 || store.gets != gets {
+		t.Fatalf("second Summary = %d entries after %d reads, want the first one reused", n, store.gets-gets)
+	}
+	clock.advance(sharedSummaryInterval)
+	if n := c.Summary().Entries; n != 2 {
+		t.Fatalf("Summary after %s = %d entries, want the store walked again", sharedSummaryInterval, n)
+	}
+}
+
+func stallingRedis(t *testing.T) string {
+	/* Starts a server speaking just enough of the Redis protocol to pass NewRedisStore's PING,
+	then never answering anything else. Returns its address.*/
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					var args []string
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					for range n {
+						r.ReadString('\n')
+						arg, _ := r.ReadString('\n')
+						args = append(args, strings.TrimSpace(arg))
+					}
+					if len(args) == 0 {
+						return
+					}
+					switch strings.ToUpper(args[0]) {
+					case "PING":
+						conn.Write([]byte("+PONG\r\n"))
+					case "GET", "SET", "DEL":
+						// Stalls.
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRedisCallsTimeOut(t *testing.T) {
+	store, err := NewRedisStore(stallingRedis(t), 0, 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.client.Close()
+	start := time.Now()
+	if _, found := store.Get("/page"); found {
+		t.Fatal("Get found an entry on a server that never answered")
+	}
+	store.Set("/page", CacheEntry{TTL: time.Minute, Created: time.Now()})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Get and Set on a stalled Redis took %s, want the 50ms timeout each", elapsed)
+	}
+}
+
+func TestRedisOutagePassesRequestsThrough(t *testing.T) {
+	store, err := NewRedisStore(stallingRedis(t), 0, 50*time.Millisecond, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.client.Close()
+	var fetches atomic.Int32
+	p := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("body"))
+	})
+	p.cache = &Cache{store: store}
+	p.fetchLock, p.fetchLockWait = NewRedisLock(store), time.Second
+
+	for i := range 5 {
+		if rec := get(p, "/page"); rec.Code != http.StatusOK || rec.Body.String() != "body" {
+			t.Fatalf("request %d during the outage = %d %q, want the upstream's response", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := fetches.Load(); n != 5 {
+		t.Fatalf("upstream fetches = %d, want every request passed through", n)
+	}
+	start := time.Now()
+	if rec := get(p, "/page"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("request with the circuit open = %d %s, want a pass-through MISS", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Fatalf("request with the circuit open took %s, want Redis skipped instead of timing out", elapsed)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type cappedBuffer struct { //Collects what is streamed to a client, for caching, until more than max bytes have gone by.
+	buf      bytes.Buffer //buf: The bytes collected so far.
+	max      int64        //max: Size beyond which collection stops.
+	overflow bool         //overflow: More than max bytes were written; buf has been released.
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	// Appends p unless the cap has been passed. Never fails, so the stream to the client is never cut short by it.
+	if c.overflow {
+		return len(p), nil
+	}
+	if int64(c.buf.Len()+len(p)) > c.max {
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+type flushWriter struct { //Sends every write to the client right away instead of once the server's buffer fills.
+	w  io.Writer                //w: The response writer.
+	rc *http.ResponseController //rc: Flushes w.
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	// Writes p and flushes it. A writer that can't flush, such as a test recorder, is simply written to.
+	n, err := f.w.Write(p)
+	if err == nil {
+		if flushErr := f.rc.Flush(); flushErr != nil && !errors.Is(flushErr, http.ErrNotSupported) {
+			err = flushErr
+		}
+	}
+	return n, err
+}
+
+func (p *ProxyServer) streams(r *http.Request, resp *http.Response) bool {
+	/*
+		Reports whether a response is streamed to the client as it arrives instead of being buffered first:
+		when it is larger than streamThreshold or of unknown length. Responses that may still be replaced are always
+		buffered: 5xx (stale-if-error), 304 and bodyless answers, and gzip bodies the client needs decompressed.
+	*/
+	if p.streamThreshold <= 0 || r.Method == http.MethodHead {
+		return false
+	}
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusNoContent {
+		return false
+	}
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && !acceptsEncoding(r, "gzip") {
+		return false
+	}
+	return resp.ContentLength < 0 || resp.ContentLength > p.streamThreshold
+}
+
+func (p *ProxyServer) streamResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) (body []byte, complete bool, broken error) {
+	/*
+		Copies the upstream response to the client while it arrives, keeping a copy of up to streamCacheMax bytes.
+		Returns that copy and true when the whole body fit under the cap and arrived intact, so the caller can cache it;
+		larger responses pass straight through and are never held in memory in full.
+		broken is set when the body broke off after the headers went out, because the upstream failed or the response
+		passed -max-response-body; the caller must then abort the response, so the client sees an incomplete body
+		rather than a short but cleanly ended 200.
+	*/
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	p.cookieRewrite.apply(w.Header())
+	if p.serverTiming {
+		w.Header().Add("Server-Timing", `cache;desc="MISS"`)
+	}
+	w.Header().Del("Transfer-Encoding")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	} else {
+		w.Header().Del("Content-Length")
+	}
+	if !r.ProtoAtLeast(1, 1) && !p.http10KeepAlive {
+		w.Header().Set("Connection", "close")
+	}
+	applyHeaderCase(w.Header(), p.headerCase)
+	w.WriteHeader(resp.StatusCode)
+
+	captured := &cappedBuffer{max: p.streamCacheMax}
+	// Flushing each part as it arrives is what gives the client its first bytes before the upstream has finished.
+	n, err := io.Copy(flushWriter{w, http.NewResponseController(w)}, io.TeeReader(resp.Body, captured))
+	p.stats.bytesServed.Add(n)
+	if errors.Is(err, errResponseTooLarge) {
+		// The limiter already answered with a complete 502.
+		return nil, false, nil
+	}
+	if err != nil {
+		if !errors.Is(err, errResponseTruncated) {
+			p.stats.upstreamErrors.Add(1)
+		}
+		log.Printf("Streaming %s stopped after %d bytes: %v", r.URL.Path, n, err)
+		return nil, false, err
+	}
+	if captured.overflow {
+		log.Printf("Streamed %d bytes for %s without caching, over the %d byte cap", n, r.URL.Path, p.streamCacheMax)
+		return nil, false, nil
+	}
+	return captured.buf.Bytes(), true, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func chunkedUpstream(parts ...string) http.HandlerFunc {
+	// Returns an upstream sending parts as separate flushed chunks, so the response has no Content-Length.
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range parts {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+func fetchBroken(t *testing.T, url string) bool {
+	// Reports whether fetching url failed, either before the headers or while reading the body, as an aborted response does.
+	resp, err := http.Get(url)
+	if err != nil {
+		return true
+	}
+	defer resp.Body.Close()
+	_, err = io.ReadAll(resp.Body)
+	return err != nil
+}
+
+func newStreamingProxy(t *testing.T, upstream http.HandlerFunc, maxResponseBody int64) (*ProxyServer, string) {
+	// Returns a proxy streaming every response of unknown length, behind the limits middleware, and its URL.
+	p := newTestProxy(t, upstream)
+	p.streamThreshold, p.streamCacheMax = 1, 1<<20
+	p.limits = Limits{MaxResponseBody: maxResponseBody}
+	return p, serveTest(t, p.limits.middleware(http.HandlerFunc(p.handleProxy))).URL
+}
+
+func TestStreamedResponseIsCached(t *testing.T) {
+	p, url := newStreamingProxy(t, chunkedUpstream("hello ", "world"), 0)
+	resp, err := http.Get(url + "/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "hello world" {
+		t.Fatalf("body = %q", body)
+	}
+	if n := entryCount(p.cache); n != 1 {
+		t.Fatalf("entries = %d, want 1", n)
+	}
+}
+
+func TestStreamedResponseOverLimitIsAbortedAndNotCached(t *testing.T) {
+	p, url := newStreamingProxy(t, chunkedUpstream(strings.Repeat("a", 600), strings.Repeat("b", 600)), 1000)
+	if !fetchBroken(t, url+"/big") {
+		t.Fatal("got a complete response, want the truncated stream to be aborted")
+	}
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("entries = %d, want the truncated body not cached", n)
+	}
+}
+
+func TestStreamedResponseWithLengthOverLimitGets502(t *testing.T) {
+	p, url := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 2000)))
+	}, 1000)
+	resp, err := http.Get(url + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("entries = %d, want nothing cached", n)
+	}
+}
+
+func TestStreamBrokenByUpstreamIsAborted(t *testing.T) {
+	p, url := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+		buf.Flush()
+		conn.(*net.TCPConn).Close()
+	}, 0)
+	if !fetchBroken(t, url+"/broken") {
+		t.Fatal("got a complete response, want the broken stream to be aborted")
+	}
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("entries = %d, want nothing cached", n)
+	}
+	if got := p.stats.upstreamErrors.Load(); got != 1 {
+		t.Fatalf("upstream errors = %d, want 1", got)
+	}
+}
+
+func TestLargeResponseStreamsBeforeUpstreamFinishes(t *testing.T) {
+	release := make(chan struct{})
+	p, url := newStreamingProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		<-release // The rest only comes once the client has seen the first part.
+		io.WriteString(w, strings.Repeat("x", 4000))
+	}, 0)
+	p.streamCacheMax = 1000
+	defer close(release)
+	client := &http.Client{Timeout: 5 * time.Second} // Without streaming, the first part never arrives.
+	resp, err := client.Get(url + "/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, len("first "))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "first " {
+		t.Fatalf("first part = %q, %v", first, err)
+	}
+	release <- struct{}{}
+	if rest := readBody(t, resp); len(rest) != 4000 {
+		t.Fatalf("rest of the body = %d bytes, want 4000", len(rest))
+	}
+	if n := entryCount(p.cache); n != 0 {
+		t.Fatalf("entries = %d, want a body past stream-cache-max left uncached", n)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+func newUpstreamTransport(httpVersion string, dialTimeout, keepAlive time.Duration) (*http.Transport, error) {
+	/*
+		Builds the transport used for upstream requests.
+		httpVersion "1.1" forces HTTP/1.1 even when the origin offers h2 over ALPN,
+		"2" requires HTTP/2: only h2 is offered over ALPN and a connection to an origin that doesn't agree to it fails,
+		as does any cleartext connection, since HTTP/2 without TLS isn't supported. "auto" keeps Go's default negotiation.
+		dialTimeout bounds only the TCP connect, so a black-holed origin fails fast while slow responses may still take
+		as long as the client's overall timeout allows; keepAlive is the TCP keep-alive probe interval.
+	*/
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+	}
+	transport.DialContext = dialer.DialContext
+	switch httpVersion {
+	case "auto":
+	case "1.1":
+		transport.ForceAttemptHTTP2 = false
+		// A non-nil, empty TLSNextProto map disables the bundled HTTP/2 support.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	case "2":
+		transport.ForceAttemptHTTP2 = true
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.NextProtos = []string{"h2"}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("upstream %s: HTTP/2 requires an https target", addr)
+		}
+		// Read at dial time, so changes made to TLSClientConfig after this returns still apply.
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&tls.Dialer{NetDialer: dialer, Config: transport.TLSClientConfig}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if proto := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; proto != "h2" {
+				conn.Close()
+				return nil, fmt.Errorf("upstream %s does not speak HTTP/2 (negotiated %q)", addr, proto)
+			}
+			return conn, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown upstream HTTP version %q: must be 1.1, 2 or auto", httpVersion)
+	}
+	return transport, nil
+}
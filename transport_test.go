@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamHTTPVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for version, want := range map[string]string{"1.1": "HTTP/1.1", "2": "HTTP/2.0", "auto": "HTTP/2.0"} {
+		transport, err := newUpstreamTransport(version, time.Second, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = roots
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+		if got := readBody(t, resp); got != want {
+			t.Errorf("upstream-http-version %s negotiated %s, want %s", version, got, want)
+		}
+		transport.CloseIdleConnections()
+	}
+	if _, err := newUpstreamTransport("3", time.Second, time.Minute); err == nil {
+		t.Error("HTTP version 3 accepted")
+	}
+}
+
+func TestUpstreamHTTP2RequiresH2(t *testing.T) {
+	// An httptest TLS server without EnableHTTP2 speaks only HTTP/1.1.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	defer srv.Close()
+	roots := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	for version, wantErr := range map[string]bool{"2": true, "auto": false, "1.1": false} {
+		transport, err := newUpstreamTransport(version, time.Second, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = roots
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if (err != nil) != wantErr {
+			t.Fatalf("upstream-http-version %s against an HTTP/1-only origin: err = %v, want error %v", version, err, wantErr)
+		}
+		if err == nil {
+			if got := readBody(t, resp); got != "HTTP/1.1" {
+				t.Errorf("upstream-http-version %s negotiated %s, want HTTP/1.1", version, got)
+			}
+		}
+		transport.CloseIdleConnections()
+	}
+
+	transport, _ := newUpstreamTransport("2", time.Second, time.Minute)
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	if _, err := (&http.Client{Transport: transport}).Get(plain.URL); err == nil {
+		t.Fatal("a cleartext upstream was accepted with upstream-http-version 2")
+	}
+}
+
+func TestDialTimeoutBoundsConnect(t *testing.T) {
+	// 10.255.255.1 is unrouted in practice, so the SYN goes unanswered like with a black-holed origin.
+	const dialTimeout = 200 * time.Millisecond
+	transport, err := newUpstreamTransport("auto", dialTimeout, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	start := time.Now()
+	if resp, err := client.Get("http://10.255.255.1:81/"); err == nil {
+		resp.Body.Close()
+		t.Skip("10.255.255.1 is reachable from this network")
+	}
+	if elapsed := time.Since(start); elapsed > dialTimeout+time.Second {
+		t.Fatalf("connect failed after %v, want within the %v dial timeout", elapsed, dialTimeout)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+func varyHeaders(h http.Header) (names []string, any bool) {
+	/* Returns the request headers named by a response's Vary, canonicalized, deduplicated and sorted,
+	and whether Vary is "*", meaning the response may differ for every request and can't be reused.*/
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, true
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), false
+}
+
+func variantKey(baseKey string, h http.Header, names []string) string {
+	// Derives the key of the variant of baseKey selected by the values of the request headers in names.
+	if len(names) == 0 {
+		return baseKey
+	}
+	hasher := md5.New()
+	io.WriteString(hasher, baseKey)
+	for _, name := range names {
+		io.WriteString(hasher, "\x00"+name+"="+strings.Join(h.Values(name), ","))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func describeVariant(h http.Header, names []string, redact []string) string {
+	// Returns what variantKey adds to the base key for h, for debug-keys, with the values of sensitive headers redacted.
+	var b strings.Builder
+	for _, name := range names {
+		value := strings.Join(h.Values(name), ",")
+		if value != "" && sensitiveHeader(name, redact) {
+			value = "[REDACTED]"
+		}
+		b.WriteString("\x00" + name + "=" + value)
+	}
+	return b.String()
+}
+
+func (c *Cache) variantKey(baseKey string, h http.Header) string {
+	// Returns the key to look a request with headers h up under: baseKey itself, or its variant when the last response for baseKey carried Vary.
+	return variantKey(baseKey, h, c.varyNames(baseKey))
+}
+
+func (p *ProxyServer) variantHeaders(r *http.Request) http.Header {
+	/* Returns the request headers that pick r's variant: the client's, except that with upstreamEncoding the Accept-Encoding
+	is the one sent upstream, which is what the response really varied on. Clients then share one variant instead of one
+	per Accept-Encoding spelling, and get it decoded as needed, see negotiateEncoding.*/
+	if p.upstreamEncoding == "" {
+		return r.Header
+	}
+	h := r.Header.Clone()
+	h.Set("Accept-Encoding", p.upstreamEncoding)
+	return h
+}
+
+type varyRecord struct { //What varies holds for a key before Vary is applied.
+	names []string  //names: Request headers the stored variants were selected by.
+	until time.Time //until: When the last variant stored by this instance is past max-stale; a shared store has dropped them all by then.
+}
+
+func (c *Cache) varyNames(baseKey string) []string {
+	// Returns the request headers the last response for baseKey varied on, nil without Vary.
+	c.variesMu.RLock()
+	defer c.variesMu.RUnlock()
+	return c.varies[baseKey].names
+}
+
+func (c *Cache) recordVary(entry CacheEntry) {
+	/*
+		Remembers which request headers select the variants stored under entry.BaseKey, as Set stores it.
+		When the upstream's Vary changed since the last response, the variants stored under the old set are dropped: they were
+		picked by headers that no longer decide the response, and would otherwise linger unreachable or, on a change back, be served.
+		varies lives in this process only. With a MemoryStore it forgets a key when the key's last entry is removed, see remove;
+		with a shared store, once the variants this instance stored have expired, see forgetExpiredVaries. An instance learns
+		a URL's Vary from its own fetches, so it misses once on a variant another instance stored and fetches it itself.
+		Must be called holding storeLocker.
+	*/
+	if entry.BaseKey == "" {
+		return
+	}
+	baseKey, names := entry.BaseKey, entry.Vary
+	until := entry.Created.Add(entry.TTL + c.maxStale)
+	c.variesMu.Lock()
+	previous, found := c.varies[baseKey]
+	if len(names) == 0 {
+		delete(c.varies, baseKey)
+	} else {
+		if found && slices.Equal(previous.names, names) && previous.until.After(until) {
+			until = previous.until
+		}
+		if c.varies == nil {
+			c.varies = map[string]varyRecord{}
+		}
+		c.varies[baseKey] = varyRecord{names: names, until: until}
+	}
+	c.variesMu.Unlock()
+
+	switch {
+	case found && !slices.Equal(previous.names, names):
+		c.removeMatching(func(stored CacheEntry) bool {
+			return stored.BaseKey == baseKey && !slices.Equal(stored.Vary, names)
+		})
+	case !found && len(names) > 0:
+		// Without a recorded Vary, the only variant there can be is the one stored under baseKey itself.
+		if stored, ok := c.store.Get(baseKey); ok {
+			c.remove(baseKey, stored)
+		}
+	}
+}
+
+func (c *Cache) forgetExpiredVaries() {
+	// Drops the varies records of a shared store whose variants have all expired past max-stale.
+	c.variesMu.Lock()
+	defer c.variesMu.Unlock()
+	now := c.clock()
+	for baseKey, record := range c.varies {
+		if now.After(record.until) {
+			delete(c.varies, baseKey)
+		}
+	}
+}